@@ -0,0 +1,337 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	branchBucket     string
+	branchFrom       string
+	branchCommitPath string
+	branchForce      bool
+)
+
+var branchCmd = &cobra.Command{
+	Use:   "branch",
+	Short: "List, create, delete and promote branches",
+	Long: `Manage the branches of a step/version.
+
+A branch is a HEAD pointing to a commit. Creating a branch or promoting one
+to another points a HEAD to an existing commit, which may belong to another
+branch, without copying any data. Every change is recorded in HEAD.log.
+
+Example:
+
+$ paddle data branch list trained-model/version1
+$ paddle data branch create --from master trained-model/version1 experimental
+$ paddle data branch promote trained-model/version1 experimental master
+$ paddle data branch delete trained-model/version1 experimental
+`,
+}
+
+var branchListCmd = &cobra.Command{
+	Use:   "list [step/version]",
+	Short: "List the branches of a step/version and their HEADs",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		branches, err := listBranches(ctx, branchStorage(), strings.Trim(args[0], "/"))
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		writeBranches(os.Stdout, branches)
+	},
+}
+
+var branchCreateCmd = &cobra.Command{
+	Use:   "create [step/version] [branch]",
+	Short: "Create a branch pointing to an existing commit",
+	Args:  cobra.ExactArgs(2),
+	Long: `Create a branch whose HEAD points to the HEAD of another branch, master by
+default, or to the commit given with --path.
+
+Example:
+
+$ paddle data branch create trained-model/version1 experimental
+$ paddle data branch create --from experimental -p 2019/03/01/12/30_AbC123XyZ0 trained-model/version1 retrain
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		stepVersion := strings.Trim(args[0], "/")
+		target, err := createBranch(ctx, branchStorage(), stepVersion, args[1], branchFrom, branchCommitPath)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		fmt.Printf("Created %s/%s pointing to %s\n", stepVersion, args[1], target)
+	},
+}
+
+var branchDeleteCmd = &cobra.Command{
+	Use:   "delete [step/version] [branch]",
+	Short: "Delete a branch's HEAD",
+	Args:  cobra.ExactArgs(2),
+	Long: `Delete the HEAD of a branch along with its history and tags. The commits
+of the branch are left alone, for 'paddle data gc' to clean up. master, or a
+branch another command holds the lock of, can only be deleted with --force.
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if args[1] == gcDefaultBranch && !branchForce {
+			exitErrorf("Refusing to delete %s without --force", gcDefaultBranch)
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		branchPath := strings.Trim(args[0], "/") + "/" + args[1]
+		if err := deleteBranch(ctx, branchStorage(), branchPath, branchForce); err != nil {
+			exitErrorf("%v", err)
+		}
+		fmt.Printf("Deleted %s\n", branchPath)
+	},
+}
+
+var branchPromoteCmd = &cobra.Command{
+	Use:   "promote [step/version] [from] [to]",
+	Short: "Point a branch's HEAD to the commit another branch's HEAD points to",
+	Args:  cobra.RangeArgs(2, 3),
+	Long: `Promote the HEAD of one branch to another, master unless given, so that
+getting the latter fetches what the former holds without re-running the step.
+The previous HEAD is recorded in HEAD.log, so the promotion can be undone with
+'paddle data rollback'.
+
+Example:
+
+$ paddle data branch promote trained-model/version1 experimental
+$ paddle data branch promote trained-model/version1 experimental staging
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		to := gcDefaultBranch
+		if len(args) == 3 {
+			to = args[2]
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		stepVersion := strings.Trim(args[0], "/")
+		previous, target, err := promoteBranch(ctx, branchStorage(), stepVersion, args[1], to, branchForce)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		fmt.Printf("%s/%s/HEAD: %s -> %s\n", stepVersion, to, describeHead(previous), target)
+	},
+}
+
+func init() {
+	branchCmd.PersistentFlags().StringVar(&branchBucket, "bucket", "", "Bucket to use")
+	branchCreateCmd.Flags().StringVar(&branchFrom, "from", gcDefaultBranch, "Branch whose HEAD to start from")
+	branchCreateCmd.Flags().StringVarP(&branchCommitPath, "path", "p", "HEAD", "Commit of the --from branch to start from (instead of HEAD)")
+	branchDeleteCmd.Flags().BoolVar(&branchForce, "force", false, "Allow deleting master or a locked branch")
+	branchPromoteCmd.Flags().BoolVar(&branchForce, "force", false, "Update HEAD even if the branch is locked")
+
+	branchCmd.AddCommand(branchListCmd)
+	branchCmd.AddCommand(branchCreateCmd)
+	branchCmd.AddCommand(branchDeleteCmd)
+	branchCmd.AddCommand(branchPromoteCmd)
+}
+
+func branchStorage() Storage {
+	if branchBucket == "" {
+		branchBucket = viper.GetString("bucket")
+	}
+	if branchBucket == "" {
+		exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+	}
+	storage, err := openStorage(branchBucket)
+	if err != nil {
+		exitErrorf("%v", err)
+	}
+	return storage
+}
+
+type branchInfo struct {
+	Name    string
+	Head    string
+	Commits int
+}
+
+// listBranches returns the branches of a step/version with their HEADs
+func listBranches(ctx context.Context, storage Storage, stepVersion string) ([]branchInfo, error) {
+	if len(strings.Split(stepVersion, "/")) != 2 {
+		return nil, fmt.Errorf("expected step/version, got %s", stepVersion)
+	}
+
+	names, err := storage.ListPrefixes(ctx, stepVersion+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	branches := []branchInfo{}
+	for _, name := range names {
+		branchPath := stepVersion + "/" + name
+		head, err := headTarget(ctx, storage, branchPath)
+		if err != nil {
+			return nil, err
+		}
+		commits, err := listCommits(ctx, storage, branchPath+"/")
+		if err != nil {
+			return nil, err
+		}
+		branches = append(branches, branchInfo{Name: name, Head: head, Commits: len(commits)})
+	}
+	return branches, nil
+}
+
+func writeBranches(w io.Writer, branches []branchInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "BRANCH\tCOMMITS\tHEAD\t")
+	for _, branch := range branches {
+		fmt.Fprintf(tw, "%s\t%d\t%s\t\n", branch.Name, branch.Commits, describeHead(branch.Head))
+	}
+	return tw.Flush()
+}
+
+func validateBranchName(name string) error {
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid branch name %s", name)
+	}
+	return nil
+}
+
+// createBranch creates a branch of stepVersion pointing to commit on the
+// branch from, or to its HEAD, returning the commit it points to.
+func createBranch(ctx context.Context, storage Storage, stepVersion string, name string, from string, commit string) (string, error) {
+	if err := validateBranchName(name); err != nil {
+		return "", err
+	}
+	fromPath := stepVersion + "/" + from
+
+	var target string
+	if commit == "" || commit == "HEAD" {
+		head, err := headTarget(ctx, storage, fromPath)
+		if err != nil {
+			return "", err
+		}
+		if head == "" {
+			return "", fmt.Errorf("%s has no HEAD", fromPath)
+		}
+		target = head
+	} else {
+		target = qualifyHead(fromPath, commit)
+		found, err := hasObjects(ctx, storage, target+"/")
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", fmt.Errorf("commit %s not found", target)
+		}
+	}
+
+	branchPath := stepVersion + "/" + name
+	existing, err := headTarget(ctx, storage, branchPath)
+	if err != nil {
+		return "", err
+	}
+	if existing != "" {
+		return "", fmt.Errorf("branch %s already exists", branchPath)
+	}
+
+	err = updateHead(ctx, storage, branchPath, target, "", false, "create")
+	if err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// deleteBranch removes the HEAD of a branch, its history and its tags. It
+// holds the branch's lock while doing so, taking it over with force.
+func deleteBranch(ctx context.Context, storage Storage, branchPath string, force bool) error {
+	found, err := objectExists(ctx, storage, branchPath+"/HEAD")
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("branch %s not found", branchPath)
+	}
+
+	unlock, err := lockHead(ctx, storage, branchPath, force)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	tags, err := listTags(ctx, storage, branchPath)
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, tag := range tags {
+		names = append(names, tagsFolder+"/"+tag.Name)
+	}
+	for _, name := range append(names, "HEAD.log", "HEAD") {
+		err := transferRetries.do(ctx, "deleting "+branchPath+"/"+name, func() error {
+			return storage.Delete(ctx, branchPath+"/"+name)
+		})
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// promoteBranch points the HEAD of the branch to at the commit the HEAD of
+// the branch from points to, returning the previous and new HEAD of to.
+func promoteBranch(ctx context.Context, storage Storage, stepVersion string, from string, to string, force bool) (string, string, error) {
+	if err := validateBranchName(to); err != nil {
+		return "", "", err
+	}
+	fromPath := stepVersion + "/" + from
+	toPath := stepVersion + "/" + to
+
+	target, err := headTarget(ctx, storage, fromPath)
+	if err != nil {
+		return "", "", err
+	}
+	if target == "" {
+		return "", "", fmt.Errorf("%s has no HEAD", fromPath)
+	}
+
+	current, err := headTarget(ctx, storage, toPath)
+	if err != nil {
+		return "", "", err
+	}
+	if current == target {
+		return "", "", fmt.Errorf("%s already points to %s", toPath, target)
+	}
+
+	err = updateHead(ctx, storage, toPath, target, current, force, "promote")
+	if err != nil {
+		return "", "", err
+	}
+	return current, target, nil
+}
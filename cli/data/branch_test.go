@@ -0,0 +1,139 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+const branchCommit = "model/v1/master/2019/03/01/12/30_AbC123XyZ0"
+
+var branchObjects = map[string]string{
+	"model/v1/master/HEAD":                              branchCommit,
+	branchCommit + "/a":                                 "a",
+	"model/v1/master/2019/02/01/09/00_ZyX321cBa0/a":     "a",
+	"model/v1/experiment/HEAD":                          "model/v1/experiment/2019/03/02/12/30_QwE321cBa0",
+	"model/v1/experiment/2019/03/02/12/30_QwE321cBa0/a": "b",
+}
+
+func TestBranchList(t *testing.T) {
+	branches, err := listBranches(context.Background(), memStorage(branchObjects), "model/v1")
+	if err != nil {
+		t.Fatalf("It should list branches, but %v", err)
+	}
+	if len(branches) != 2 || branches[1].Name != "master" || branches[1].Commits != 2 || branches[1].Head != branchCommit {
+		t.Errorf("Unexpected branches: %+v", branches)
+	}
+
+	var out bytes.Buffer
+	writeBranches(&out, branches)
+	if !strings.Contains(out.String(), "master      2        "+branchCommit) {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
+
+func TestBranchCreate(t *testing.T) {
+	storage := memStorage(branchObjects)
+
+	target, err := createBranch(context.Background(), storage, "model/v1", "retrain", "master", "HEAD")
+	if err != nil || target != branchCommit {
+		t.Fatalf("It should create the branch from HEAD, got: %s (%v)", target, err)
+	}
+	if readString(storage, "model/v1/retrain/HEAD") != branchCommit {
+		t.Error("It should point the new branch's HEAD to the commit")
+	}
+	if log, _ := readHeadLog(context.Background(), storage, "model/v1/retrain"); len(log) != 1 || log[0].Action != "create" {
+		t.Errorf("It should record the creation, got: %+v", log)
+	}
+
+	if _, err := createBranch(context.Background(), storage, "model/v1", "retrain", "master", "HEAD"); err == nil {
+		t.Error("It should not overwrite an existing branch")
+	}
+
+	target, err = createBranch(context.Background(), storage, "model/v1", "old", "master", "2019/02/01/09/00_ZyX321cBa0")
+	if err != nil || target != "model/v1/master/2019/02/01/09/00_ZyX321cBa0" {
+		t.Errorf("It should create the branch from a commit, got: %s (%v)", target, err)
+	}
+
+	if _, err := createBranch(context.Background(), storage, "model/v1", "missing", "master", "2019/01/01/00/00_Nope"); err == nil {
+		t.Error("It should not create a branch from a missing commit")
+	}
+	if _, err := createBranch(context.Background(), storage, "model/v1", "a/b", "master", "HEAD"); err == nil {
+		t.Error("It should reject invalid branch names")
+	}
+}
+
+func TestBranchPromote(t *testing.T) {
+	storage := memStorage(branchObjects)
+
+	previous, target, err := promoteBranch(context.Background(), storage, "model/v1", "experiment", "master", false)
+	if err != nil {
+		t.Fatalf("It should promote, but %v", err)
+	}
+	if previous != branchCommit || target != "model/v1/experiment/2019/03/02/12/30_QwE321cBa0" {
+		t.Errorf("Unexpected promotion: %s -> %s", previous, target)
+	}
+	if readString(storage, "model/v1/master/HEAD") != target {
+		t.Error("It should update master's HEAD")
+	}
+	log, _ := readHeadLog(context.Background(), storage, "model/v1/master")
+	if len(log) != 1 || log[0].Action != "promote" || log[0].Previous != branchCommit {
+		t.Errorf("It should record the promotion, got: %+v", log)
+	}
+
+	rolledBack, err := rollbackTarget(context.Background(), storage, "model/v1/master", target, "", 1)
+	if err != nil || rolledBack != branchCommit {
+		t.Errorf("It should be possible to roll back a promotion, got: %s (%v)", rolledBack, err)
+	}
+
+	if _, _, err := promoteBranch(context.Background(), storage, "model/v1", "experiment", "master", false); err == nil {
+		t.Error("It should not promote twice")
+	}
+}
+
+func TestBranchDelete(t *testing.T) {
+	storage := memStorage(branchObjects)
+
+	if _, err := createTag(context.Background(), storage, "model/v1/experiment", "v1", "HEAD"); err != nil {
+		t.Fatalf("It should tag the branch, but %v", err)
+	}
+
+	if err := deleteBranch(context.Background(), storage, "model/v1/experiment", false); err != nil {
+		t.Fatalf("It should delete the branch, but %v", err)
+	}
+	for _, key := range []string{"HEAD", "HEAD.log", "HEAD.lock", "tags/v1"} {
+		if found, _ := objectExists(context.Background(), storage, "model/v1/experiment/"+key); found {
+			t.Errorf("It should delete %s", key)
+		}
+	}
+	if readString(storage, "model/v1/experiment/2019/03/02/12/30_QwE321cBa0/a") != "b" {
+		t.Error("It should leave the commits alone")
+	}
+	if err := deleteBranch(context.Background(), storage, "model/v1/missing", false); err == nil {
+		t.Error("It should return an error for a missing branch")
+	}
+}
+
+func TestBranchDeleteWhenLocked(t *testing.T) {
+	storage := memStorage(branchObjects)
+	lock, _ := json.Marshal(headLock{Owner: "other", Host: "pod", Created: time.Now().UTC()})
+	putObject(context.Background(), storage, "model/v1/experiment/HEAD.lock", lock)
+
+	err := deleteBranch(context.Background(), storage, "model/v1/experiment", false)
+	if err == nil || !strings.Contains(err.Error(), "is locked by pod") {
+		t.Errorf("It should refuse to delete a locked branch, got: %v", err)
+	}
+	if found, _ := objectExists(context.Background(), storage, "model/v1/experiment/HEAD"); !found {
+		t.Error("It should leave HEAD alone")
+	}
+
+	if err := deleteBranch(context.Background(), storage, "model/v1/experiment", true); err != nil {
+		t.Errorf("It should delete a locked branch when forced, but %v", err)
+	}
+	if found, _ := objectExists(context.Background(), storage, "model/v1/experiment/HEAD.lock"); found {
+		t.Error("It should release the lock")
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	catBranch     string
+	catBucket     string
+	catCommitPath string
+)
+
+var catCmd = &cobra.Command{
+	Use:   "cat [step/version] [key]",
+	Short: "Print a file stored in S3",
+	Args:  cobra.ExactArgs(2),
+	Long: `Stream a single file of a commit to stdout, without writing anything to disk.
+
+Example:
+
+$ paddle data cat -b experimental trained-model/version1 metrics.csv
+$ paddle data cat -p 2019/03/01/12/30_AbC123XyZ0 trained-model/version1 model.bin | some-tool
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if catBucket == "" {
+			catBucket = viper.GetString("bucket")
+		}
+		if catBucket == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+
+		source := S3Path{
+			bucket: catBucket,
+			path:   fmt.Sprintf("%s/%s/%s", args[0], catBranch, catCommitPath),
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		err := Cat(ctx, source, args[1], os.Stdout)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+	},
+}
+
+func init() {
+	catCmd.Flags().StringVarP(&catBranch, "branch", "b", "master", "Branch to work on")
+	catCmd.Flags().StringVar(&catBucket, "bucket", "", "Bucket to use")
+	catCmd.Flags().StringVarP(&catCommitPath, "path", "p", "HEAD", "Commit or tag:<name> to read from (instead of HEAD)")
+}
+
+// Cat writes the file key of the commit source refers to to w
+func Cat(ctx context.Context, source S3Path, key string, w io.Writer) error {
+	storage, err := openStorage(source.bucket)
+	if err != nil {
+		return err
+	}
+
+	commit, err := resolveCommit(ctx, storage, source)
+	if err != nil {
+		return err
+	}
+	prefix := commit + "/"
+	key = strings.TrimPrefix(key, "/")
+
+	objectKey := prefix + key
+	if !isReservedFile(key) {
+		manifest, err := readManifest(ctx, storage, prefix)
+		if err != nil {
+			return errors.Wrap(err, "reading manifest")
+		}
+		// the files of encrypted commits are read through a storage
+		// decrypting them
+		storage, err = commitStorage(ctx, storage, prefix)
+		if err != nil {
+			return err
+		}
+		if manifest != nil && (manifest.ObjectStore != "" || manifest.packed()) {
+			entries, err := manifest.filter(selection{keys: []string{key}})
+			if err != nil {
+				return err
+			}
+			if manifest.packed() {
+				body, err := openPackedFile(ctx, storage, prefix, entries[0])
+				if err != nil {
+					return err
+				}
+				defer body.Close()
+
+				_, err = io.Copy(w, body)
+				return err
+			}
+			objectKey = manifest.blobKey(entries[0].SHA256)
+		}
+	}
+
+	// Only opening the object is retried: once some of it is written out
+	// there is no taking it back.
+	var body io.ReadCloser
+	err = transferRetries.do(ctx, "fetching "+objectKey, func() error {
+		body, err = storage.Get(ctx, objectKey)
+		return err
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return fmt.Errorf("couldn't find %s in %s", key, prefix)
+		}
+		return err
+	}
+	defer body.Close()
+
+	_, err = io.Copy(w, body)
+	return err
+}
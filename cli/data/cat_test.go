@@ -0,0 +1,45 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func TestCat(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/dir/a.csv", []byte("a,b\n1,2\n"), 0644)
+
+	for _, dedup := range []bool{false, true} {
+		err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{Dedup: dedup})
+		if err != nil {
+			t.Fatalf("It should commit, but %v", err)
+		}
+
+		var out bytes.Buffer
+		err = Cat(context.Background(), NewS3Path("bucket", "model/v1/master/HEAD"), "dir/a.csv", &out)
+		if err != nil || out.String() != "a,b\n1,2\n" {
+			t.Errorf("It should print the file (dedup: %v), got: %q (%v)", dedup, out.String(), err)
+		}
+
+		err = Cat(context.Background(), NewS3Path("bucket", "model/v1/master/HEAD"), "missing.csv", &out)
+		if err == nil {
+			t.Errorf("It should fail on a missing file (dedup: %v)", dedup)
+		}
+	}
+
+	err := Cat(context.Background(), NewS3Path("bucket", "model/v1/other/HEAD"), "dir/a.csv", ioutil.Discard)
+	if err == nil || err.Error() != "model/v1/other/HEAD not found" {
+		t.Errorf("It should fail without a HEAD, got: %v", err)
+	}
+}
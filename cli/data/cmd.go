@@ -22,10 +22,35 @@ var DataCmd = &cobra.Command{
 	Use:   "data",
 	Short: "Commit and retrieve data",
 	Long: `Commands to commit data to S3 and retrieve it.
+
+Transfers report how far along they are with a progress bar when run in a
+terminal, or else with a line every --progress-interval, on stderr. They end
+with a summary of what was transferred, followed by the same as a line of
+JSON, on stdout.
 `,
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if err := checkProgressMode(); err != nil {
+			exitErrorf("%v", err)
+		}
+	},
 }
 
 func init() {
+	DataCmd.AddCommand(branchCmd)
+	DataCmd.AddCommand(catCmd)
 	DataCmd.AddCommand(commitCmd)
+	DataCmd.AddCommand(cpCmd)
+	DataCmd.AddCommand(diffCmd)
+	DataCmd.AddCommand(gcCmd)
 	DataCmd.AddCommand(getCmd)
+	DataCmd.AddCommand(lineageCmd)
+	DataCmd.AddCommand(lsCmd)
+	DataCmd.AddCommand(rollbackCmd)
+	DataCmd.AddCommand(showCmd)
+	DataCmd.AddCommand(tagCmd)
+
+	DataCmd.PersistentFlags().StringVar(&encryptionKeyFlag, "encryption-key", "", "Keyfile or kms://<key id> to encrypt commits with and decrypt keyfile encrypted ones (default the 'encryption-key' setting)")
+	DataCmd.PersistentFlags().StringVar(&progressMode, "progress", progressAuto, "How to report progress: auto, bar, lines or off")
+	DataCmd.PersistentFlags().DurationVar(&progressInterval, "progress-interval", defaultProgressInterval, "How often to report progress with --progress lines")
+	DataCmd.PersistentFlags().IntVar(&transferRetries.attempts, "retries", defaultRetryAttempts, "Number of times to try each get or put before giving up")
 }
@@ -14,81 +14,397 @@
 package data
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 	"github.com/deliveroo/paddle/rand"
+	"github.com/pkg/errors"
 	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"io"
 	"os"
-	"strings"
 	"time"
 )
 
 var commitBranch string
+var commitPartSizeMB int64
+var commitPackSizeMB int64
+var commitFromTar string
+var commitTags []string
+var commitRecordInputs string
+var commitEncrypt bool
+var commitFlags = CommitOptions{}
 var AppFs = afero.NewOsFs()
 
+// CommitOptions tweaks how Commit stores data and updates HEAD
+type CommitOptions struct {
+	// Dedup stores files by content hash in a shared object store
+	Dedup bool
+	// Pack stores the files in compressed chunks of about PackSize bytes
+	// instead of one object each
+	Pack     bool
+	PackSize int64
+	// ExpectHead is the commit HEAD must point to for it to be updated,
+	// instead of the one it pointed to when the commit started
+	ExpectHead string
+	// Force updates HEAD even if it moved or the branch is locked
+	Force bool
+	// Concurrency is how many files are uploaded at once
+	Concurrency int
+	// PartSize is the size in bytes of the parts large files are uploaded
+	// in, and PartConcurrency how many parts of a file are uploaded at once.
+	// Zero means the storage's default.
+	PartSize        int64
+	PartConcurrency int
+	// Tags are recorded in the commit's metadata
+	Tags map[string]string
+	// InputsLog is the inputs log to store as the commit's lineage, by
+	// default the one gets record to (see inputsLogPath), or "off" for none.
+	// It is cleared once the commit is made.
+	InputsLog string
+	// EncryptionKey is the master key to encrypt the files with, if any: a
+	// keyfile or kms://<key id>
+	EncryptionKey string
+}
+
+const defaultUploadConcurrency = 16
+
 var commitCmd = &cobra.Command{
 	Use:   "commit [source path] [version]",
 	Short: "Commit data to S3",
-	Args:  cobra.ExactArgs(2),
+	Args:  cobra.RangeArgs(1, 2),
 	Long: `Store data into S3 under a versioned path, and update HEAD.
 
+Data goes to S3 unless the 'storage' setting in your config file points
+somewhere else, e.g. 'storage: file:///tmp/paddle' to keep it on local disk.
+
 Example:
 
 $ paddle data commit -b experimental source/path trained-model/version1
+
+Every commit records a MANIFEST.json with the size and SHA-256 of its files,
+which 'paddle data get' uses to verify what it downloads, and a METADATA.json
+saying who or which pipeline run made it, shown by 'paddle data show'. The
+inputs log 'paddle data get' records to, $OUTPUT_PATH/inputs.log unless
+--record-inputs or 'record-inputs' say otherwise, is stored as the commit's
+LINEAGE.json instead of as a file, for 'paddle data lineage', and cleared for
+the next commit. Tags can be added to the metadata with --tag:
+
+$ paddle data commit --tag dataset=2019-03 --tag reviewed=yes source/path trained-model/version1
+
+With --dedup, files are stored once by content hash in a shared object store
+and the commit only records a manifest of paths and hashes, so unchanged
+files are not uploaded again:
+
+$ paddle data commit --dedup source/path trained-model/version1
+
+HEAD is only updated if it still points to the commit it pointed to when the
+commit started (or to the one given with --expect-head), so concurrent
+commits to the same branch fail instead of silently replacing each other:
+
+$ paddle data commit --expect-head 2019/03/01/12/30_AbC123XyZ0 source/path trained-model/version1
+
+With --pack, files are bundled into gzipped tar chunks of about --pack-size MB
+instead of being stored one object each, which is much faster for steps
+producing many small files. 'paddle data get' unpacks them, fetching only the
+files it needs from each chunk when given --keys:
+
+$ paddle data commit --pack --pack-size 128 source/path trained-model/version1
+
+With --encrypt, files are encrypted before they are uploaded, with a data key
+of the commit's own wrapped by the master key given with --encryption-key or
+the 'encryption-key' setting: a keyfile holding a 256 bit key, or a KMS key
+as kms://<key id, ARN or alias>. The wrapped data key is recorded in the
+commit's METADATA.json, and 'paddle data get' decrypts the files using the
+same keyfile, or KMS. Encrypted commits can't be deduplicated.
+
+Only the contents of the files are encrypted. Their paths stay readable in the
+bucket, and the commit's MANIFEST.json, which is not encrypted so that ls,
+show and gc work without the key, lists the size and SHA-256 of each file. A
+hash is enough to confirm a guess at what a file holds, so don't rely on
+--encrypt to hide files whose contents could be guessed.
+
+$ openssl rand -base64 32 > paddle.key
+$ paddle data commit --encrypt --encryption-key paddle.key source/path trained-model/version1
+$ paddle data commit --encrypt --encryption-key kms://alias/paddle source/path trained-model/version1
+
+Files are uploaded in parallel; --concurrency sets how many at once, and
+--part-size and --part-concurrency tune how large files are split up:
+
+$ paddle data commit --concurrency 64 --part-size 64 source/path trained-model/version1
+
+With --from-tar the data is read from a tar archive instead of a source
+path, '-' reading it from stdin:
+
+$ tar -cf - -C source/path . | paddle data commit --from-tar - trained-model/version1
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		if !viper.IsSet("bucket") {
 			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
 		}
 
+		if commitFromTar == "" && len(args) != 2 {
+			exitErrorf("Expected a source path and a version")
+		}
+		if commitFromTar != "" && len(args) != 1 {
+			exitErrorf("Expected only a version when committing a tar archive")
+		}
+
 		destination := S3Path{
 			bucket: viper.GetString("bucket"),
-			path:   fmt.Sprintf("%s/%s", args[1], commitBranch),
+			path:   fmt.Sprintf("%s/%s", args[len(args)-1], commitBranch),
+		}
+
+		commitFlags.PartSize = commitPartSizeMB * 1024 * 1024
+		commitFlags.PackSize = commitPackSizeMB * 1024 * 1024
+
+		tags, err := parseTags(commitTags)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		commitFlags.Tags = tags
+
+		commitFlags.InputsLog = commitRecordInputs
+
+		if commitEncrypt {
+			commitFlags.EncryptionKey = encryptionKey()
+			if commitFlags.EncryptionKey == "" {
+				exitErrorf("No encryption key given, set 'encryption-key' or use --encryption-key")
+			}
 		}
 
-		validatePath(args[0])
-		commitPath(args[0], destination)
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		if commitFromTar == "" {
+			err = Commit(ctx, args[0], destination, commitFlags)
+		} else {
+			err = commitTarFile(ctx, commitFromTar, destination, commitFlags)
+		}
+		if err != nil {
+			exitErrorf("%v", err)
+		}
 	},
 }
 
 func init() {
 	commitCmd.Flags().StringVarP(&commitBranch, "branch", "b", "master", "Branch to work on")
+	commitCmd.Flags().BoolVar(&commitFlags.Dedup, "dedup", false, "Store files by content hash, uploading only the ones not stored yet")
+	commitCmd.Flags().BoolVar(&commitFlags.Pack, "pack", false, "Store files in compressed chunks instead of one object each")
+	commitCmd.Flags().Int64Var(&commitPackSizeMB, "pack-size", defaultPackSizeMB, "Size in MB of the chunks files are packed in with --pack")
+	commitCmd.Flags().BoolVar(&commitEncrypt, "encrypt", false, "Encrypt the files with the key given with --encryption-key (their paths, sizes and hashes stay readable)")
+	commitCmd.Flags().StringVar(&commitFlags.ExpectHead, "expect-head", "", "Only update HEAD if it points to this commit")
+	commitCmd.Flags().BoolVar(&commitFlags.Force, "force", false, "Update HEAD even if it moved or the branch is locked")
+	commitCmd.Flags().IntVar(&commitFlags.Concurrency, "concurrency", defaultUploadConcurrency, "Number of files to upload at once")
+	commitCmd.Flags().Int64Var(&commitPartSizeMB, "part-size", 0, "Size in MB of the parts large files are uploaded in (default 5)")
+	commitCmd.Flags().StringArrayVar(&commitTags, "tag", []string{}, "Tag to record in the commit's metadata, as key=value (can be repeated)")
+	commitCmd.Flags().StringVar(&commitRecordInputs, "record-inputs", "", "Inputs log to store as the commit's lineage, or 'off' (default $OUTPUT_PATH/inputs.log)")
+	commitCmd.Flags().StringVar(&commitFromTar, "from-tar", "", "Commit the contents of a tar archive, or of stdin if '-', instead of a source path")
+	commitCmd.Flags().IntVar(&commitFlags.PartConcurrency, "part-concurrency", 0, "Number of parts of a large file to upload at once (default 5)")
 }
 
-func validatePath(path string) {
+func validatePath(path string) error {
 	fd, err := AppFs.Stat(path)
 	if err != nil {
-		exitErrorf("Source path %v not found", path)
+		return fmt.Errorf("source path %v not found", path)
 	}
 	if !fd.IsDir() {
-		exitErrorf("Source path %v must be a directory", path)
+		return fmt.Errorf("source path %v must be a directory", path)
 	}
+	return nil
 }
 
-func commitPath(path string, destination S3Path) {
-	sess := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+// Commit stores the files under path as a new commit of destination and
+// points its HEAD to it.
+func Commit(ctx context.Context, path string, destination S3Path, opts CommitOptions) error {
+	started := time.Now()
+	if err := validatePath(path); err != nil {
+		return err
+	}
+
+	if opts.Concurrency < 1 {
+		opts.Concurrency = defaultUploadConcurrency
+	}
+	if opts.Pack && opts.Dedup {
+		return errors.New("files can't be both packed and deduplicated")
+	}
+	if opts.EncryptionKey != "" && opts.Dedup {
+		return errors.New("files can't be both encrypted and deduplicated")
+	}
+	if opts.PackSize < 1 {
+		opts.PackSize = defaultPackSizeMB * 1024 * 1024
+	}
+
+	storage, err := openStorage(destination.bucket)
+	if err != nil {
+		return err
+	}
+	if multipart, ok := storage.(multipartStorage); ok {
+		err = multipart.setMultipart(opts.PartSize, opts.PartConcurrency)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Find out early whether HEAD already moved, rather than after uploading
+	expectedHead := qualifyHead(destination.path, opts.ExpectHead)
+	if !opts.Force {
+		currentHead, err := headTarget(ctx, storage, destination.path)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read %s/HEAD", destination.path)
+		}
+		if opts.ExpectHead == "" {
+			expectedHead = currentHead
+		} else if currentHead != expectedHead {
+			return fmt.Errorf("HEAD of %s moved: expected %s, found %s (use --force to overwrite it)",
+				destination.path, expectedHead, describeHead(currentHead))
+		}
+	}
+
+	// The inputs log is turned into the commit's lineage rather than stored
+	var (
+		inputs []lineageInput
+		logged int64
+	)
+	logPath := inputsLogPath(opts.InputsLog)
+	if logPath != "" {
+		inputs, logged, err = readInputsLog(logPath, destination.bucket)
+		if err != nil {
+			return errors.Wrap(err, "reading inputs log")
+		}
+	}
+
+	// The files go through dataStorage, which encrypts them if asked to,
+	// while everything paddle stores alongside them stays readable
+	dataStorage := storage
+	var encryption *commitEncryption
+	if opts.EncryptionKey != "" {
+		provider, err := openKeyProvider(opts.EncryptionKey)
+		if err != nil {
+			return err
+		}
+		encryption, dataStorage, err = newCommitEncryption(ctx, storage, provider)
+		if err != nil {
+			return err
+		}
+	}
 
 	rootKey := generateRootKey(destination)
-	keys := filesToKeys(path)
-	uploader := s3manager.NewUploader(sess)
+	keys := []string{}
+	for _, key := range filesToKeys(path) {
+		if logPath == "" || !samePath(key, logPath) {
+			keys = append(keys, key)
+		}
+	}
+
+	manifest, err := buildManifest(path, keys)
+	if err != nil {
+		return errors.Wrap(err, "unable to hash files")
+	}
+	for _, entry := range manifest.Files {
+		if isReservedFile(entry.Path) {
+			return fmt.Errorf("%s/%s clashes with a file paddle stores alongside the commit", path, entry.Path)
+		}
+	}
+
+	stats := newTransferStats("commit")
+	for _, entry := range manifest.Files {
+		stats.expect(1, entry.Size)
+	}
+	stats.start()
+	defer stats.halt()
+	if opts.Pack {
+		err = uploadPacks(ctx, dataStorage, rootKey, manifest, keys, opts.Concurrency, opts.PackSize, stats)
+	} else if opts.Dedup {
+		err = uploadBlobs(ctx, storage, manifest, keys, opts.Concurrency, stats)
+	} else {
+		err = uploadFiles(ctx, dataStorage, rootKey, manifest, keys, opts.Concurrency, stats)
+	}
+	if err != nil {
+		return err
+	}
+	stats.finish()
 
-	for _, file := range keys {
-		key := fmt.Sprintf("%s/%s", rootKey, strings.TrimPrefix(file, path+"/"))
-		fmt.Println(file + " -> " + key)
-		uploadFileToS3(uploader, destination.bucket, key, file)
+	if len(inputs) > 0 {
+		data, err := json.Marshal(lineage{Inputs: inputs})
+		if err != nil {
+			return errors.Wrap(err, "unable to encode lineage")
+		}
+		err = putObject(ctx, storage, rootKey+"/"+lineageFile, data)
+		if err != nil {
+			return err
+		}
+	}
+
+	metadata := newCommitMetadata(path, destination, started, opts.Tags)
+	metadata.Finished = time.Now().UTC()
+	metadata.Encryption = encryption
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode metadata")
+	}
+	err = putObject(ctx, storage, rootKey+"/"+metadataFile, data)
+	if err != nil {
+		return err
+	}
+
+	// The manifest goes last: a commit without one was never completed
+	data, err = json.Marshal(manifest)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode manifest")
+	}
+	err = putObject(ctx, storage, rootKey+"/"+manifestFile, data)
+	if err != nil {
+		return err
 	}
 
 	// Update HEAD
-	headKey := fmt.Sprintf("%s/HEAD", destination.path)
-	uploadDataToS3(sess, destination.bucket, headKey, rootKey)
+	err = updateHead(ctx, storage, destination.path, rootKey, expectedHead, opts.Force, "commit")
+	_, logFailed := err.(*headLogError)
+
+	// The inputs are this commit's lineage now, not the next one's
+	if (err == nil || logFailed) && logged > 0 {
+		if clearErr := clearInputsLog(logPath, logged); clearErr != nil {
+			fmt.Fprintf(os.Stderr, "Unable to clear %s, the next commit will list its inputs too: %v\n", logPath, clearErr)
+		}
+	}
+	if logFailed {
+		return errors.Wrapf(err, "committed %s", rootKey)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "committed %s but could not update HEAD", rootKey)
+	}
+	return nil
+}
+
+// CommitTar stores the files in a tar stream as a new commit of destination,
+// extracting them to a temporary directory first.
+func CommitTar(ctx context.Context, r io.Reader, destination S3Path, opts CommitOptions) error {
+	dir, err := afero.TempDir(AppFs, "", "paddle-commit")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temp directory")
+	}
+	defer AppFs.RemoveAll(dir)
+
+	if err := extractTar(r, dir); err != nil {
+		return err
+	}
+	return Commit(ctx, dir, destination, opts)
+}
+
+func commitTarFile(ctx context.Context, name string, destination S3Path, opts CommitOptions) error {
+	if name == "-" {
+		return CommitTar(ctx, os.Stdin, destination, opts)
+	}
+
+	file, err := AppFs.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return CommitTar(ctx, file, destination, opts)
 }
 
 func filesToKeys(path string) (keys []string) {
@@ -111,34 +427,73 @@ func generateRootKey(destination S3Path) string {
 	return fmt.Sprintf("%s/%s_%s", destination.path, datePath, rand.String(10))
 }
 
-func uploadFileToS3(uploader *s3manager.Uploader, bucket string, key string, filePath string) {
-	file, err := AppFs.Open(filePath)
-	if err != nil {
-		exitErrorf("Failed to open file", file, err)
+// uploadFiles stores the files under the commit, up to concurrency at a time
+func uploadFiles(ctx context.Context, storage Storage, rootKey string, manifest *Manifest, files []string, concurrency int, stats *transferStats) error {
+	uploads := newTransfers(ctx, concurrency)
+	for i, entry := range manifest.Files {
+		file, key, size := files[i], rootKey+"/"+entry.Path, entry.Size
+		uploads.Go(func() error {
+			progress := stats.track()
+			if err := uploadFile(ctx, storage, key, file, progress); err != nil {
+				return err
+			}
+			progress.done(1, size)
+			return nil
+		})
 	}
-	defer file.Close()
+	return uploads.Wait()
+}
 
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   file,
-	})
+// uploadBlobs stores every file not yet in the object store under its hash,
+// up to concurrency at a time, and points the manifest at the object store.
+func uploadBlobs(ctx context.Context, storage Storage, manifest *Manifest, files []string, concurrency int, stats *transferStats) error {
+	manifest.ObjectStore = objectStorePrefix
+	uploaded := make(map[string]bool)
 
-	if err != nil {
-		exitErrorf("Failed to upload data to %s/%s, %s", bucket, key, err.Error())
+	uploads := newTransfers(ctx, concurrency)
+	for i, entry := range manifest.Files {
+		key, size := manifest.blobKey(entry.SHA256), entry.Size
+		if uploaded[key] {
+			stats.unchanged(size)
+			continue
+		}
+		uploaded[key] = true
+
+		file := files[i]
+		uploads.Go(func() error {
+			exists, err := objectExists(ctx, storage, key)
+			if err != nil {
+				return errors.Wrapf(err, "unable to check %s", key)
+			}
+			if exists {
+				stats.unchanged(size)
+				return nil
+			}
+			progress := stats.track()
+			if err := uploadFile(ctx, storage, key, file, progress); err != nil {
+				return err
+			}
+			progress.done(1, size)
+			return nil
+		})
 	}
+	return uploads.Wait()
 }
 
-func uploadDataToS3(sess *session.Session, bucket string, key string, data string) {
-	s3Svc := s3.New(sess)
+// uploadFile stores a local file, its bytes counted by progress as they go
+func uploadFile(ctx context.Context, storage Storage, key string, filePath string, progress *fileProgress) error {
+	err := transferRetries.do(ctx, "uploading "+key, func() error {
+		file, err := AppFs.Open(filePath)
+		if err != nil {
+			return &permanentError{errors.Wrapf(err, "failed to open file %s", filePath)}
+		}
+		defer file.Close()
 
-	_, err := s3Svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(key),
-		Body:   bytes.NewReader([]byte(data)),
+		progress.rewind(0)
+		return storage.Put(ctx, key, progress.reader(file))
 	})
-
 	if err != nil {
-		exitErrorf("Unable to update %s", key)
+		return errors.Wrapf(err, "failed to upload data to %s", key)
 	}
+	return nil
 }
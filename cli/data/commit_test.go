@@ -1,10 +1,16 @@
 package data
 
 import (
+	"context"
+	"fmt"
 	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestFilesToKeys(t *testing.T) {
@@ -34,3 +40,106 @@ func TestFilesToKeysWhenEmptyFolder(t *testing.T) {
 		t.Errorf("expecting empty list but got: %s", strings.Join(list, ","))
 	}
 }
+
+func TestCommit(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/a", []byte("file a"), 0644)
+
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+
+	storage, _ := openStorage("bucket")
+	head := readString(storage, "model/v1/master/HEAD")
+	if readString(storage, head+"/a") != "file a" {
+		t.Errorf("It should store the files of the commit, HEAD: %s", head)
+	}
+	if found, _ := objectExists(context.Background(), storage, head+"/"+manifestFile); !found {
+		t.Error("It should store the manifest of the commit")
+	}
+}
+
+func TestCommitRecordsMetadata(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/a", []byte("file a"), 0644)
+
+	opts := CommitOptions{Tags: map[string]string{"dataset": "2019-03"}}
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), opts)
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+
+	storage, _ := openStorage("bucket")
+	head := readString(storage, "model/v1/master/HEAD")
+	metadata, err := readMetadata(context.Background(), storage, head+"/")
+	if err != nil || metadata == nil {
+		t.Fatalf("It should store the metadata of the commit, but %v", err)
+	}
+	if metadata.Tags["dataset"] != "2019-03" || metadata.Step != "model" || metadata.Committer == "" {
+		t.Errorf("Unexpected metadata: %+v", metadata)
+	}
+	if metadata.Finished.Before(metadata.Started) {
+		t.Errorf("It should finish after it started: %+v", metadata)
+	}
+}
+
+func TestCommitMissingPath(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{})
+	if err == nil || err.Error() != "source path src not found" {
+		t.Errorf("It should return an error, got: %v", err)
+	}
+}
+
+func TestCommitUploadsInParallel(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+
+	AppFs = afero.NewMemMapFs()
+	for i := 0; i < 20; i++ {
+		afero.WriteFile(AppFs, fmt.Sprintf("src/%02d", i), []byte("same"), 0644)
+	}
+
+	opts := CommitOptions{Dedup: true, Concurrency: 4}
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), opts)
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+
+	storage, _ := openStorage("bucket")
+	var blobs int
+	storage.List(context.Background(), objectStorePrefix+"/", func(objects []*Object) error {
+		blobs += len(objects)
+		return nil
+	})
+	if blobs != 1 {
+		t.Errorf("It should upload identical files once, got: %d blobs", blobs)
+	}
+}
+
+func TestUploadStats(t *testing.T) {
+	stats := newTransferStats("commit")
+	stats.started = time.Now().Add(-2 * time.Second)
+	stats.transferred(3 * 1024 * 1024)
+	stats.transferred(1024 * 1024)
+	stats.unchanged(1024)
+
+	summary := stats.String()
+	if !strings.HasPrefix(summary, "Uploaded 2 files (4.0 MB) in 2") || !strings.Contains(summary, "2.0 MB/s, skipped 1 unchanged files") {
+		t.Errorf("Summary was incorrect, got: %s", summary)
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	cpBranch     string
+	cpBucketFrom string
+	cpBucketTo   string
+	cpFlags      = CopyOptions{}
+)
+
+// CopyOptions tweaks how Copy copies a commit and updates HEAD
+type CopyOptions struct {
+	// Force updates HEAD even if it moved or the branch is locked
+	Force bool
+	// Concurrency is how many objects are copied at once
+	Concurrency int
+}
+
+var cpCmd = &cobra.Command{
+	Use:   "cp [step/version/ref] [step/version]",
+	Short: "Copy a commit to another branch, step or bucket",
+	Args:  cobra.ExactArgs(2),
+	Long: `Copy the files of a commit into a new commit of the given step and version,
+on the branch given with -b, and point its HEAD to it.
+
+The commit to copy is named by its step and version followed by a ref, as
+taken by 'paddle data diff': a branch for its HEAD, HEAD or tag:<name> on
+master, or the start of a commit path, e.g. trained-model/version1/experimental
+or trained-model/version1/tag:release-2019-q1. With no ref, the HEAD of master
+is copied.
+
+Objects are copied by S3 itself, up to --concurrency at a time, large ones
+in parts, so nothing goes through the machine running paddle. Commits can
+be copied to another bucket with --bucket-to, or from one with --bucket-from.
+The copy keeps the metadata of the original commit, noting what it was
+copied from. Encrypted commits stay encrypted with the same key.
+
+HEAD is only updated if it did not move while copying, unless --force is
+given.
+
+Example:
+
+$ paddle data cp -b staging trained-model/version1/master trained-model/version1
+$ paddle data cp --bucket-to staging-bucket trained-model/version1/tag:release-2019-q1 trained-model/version1
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if cpBucketFrom == "" {
+			cpBucketFrom = viper.GetString("bucket")
+		}
+		if cpBucketTo == "" {
+			cpBucketTo = viper.GetString("bucket")
+		}
+		if cpBucketFrom == "" || cpBucketTo == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+
+		parts := strings.SplitN(strings.Trim(args[0], "/"), "/", 3)
+		if len(parts) < 2 {
+			exitErrorf("Expected the commit to copy as step/version/ref, got %s", args[0])
+		}
+		ref := "HEAD"
+		if len(parts) == 3 {
+			ref = parts[2]
+		}
+		stepVersion := strings.Trim(args[1], "/")
+		if strings.Count(stepVersion, "/") != 1 {
+			exitErrorf("Expected the destination as step/version, got %s", args[1])
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		storage, err := openStorage(cpBucketFrom)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		commit, err := resolveRef(ctx, storage, parts[0]+"/"+parts[1], gcDefaultBranch, ref)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		source := NewS3Path(cpBucketFrom, commit)
+		destination := NewS3Path(cpBucketTo, stepVersion+"/"+cpBranch)
+		if err := Copy(ctx, source, destination, cpFlags); err != nil {
+			exitErrorf("%v", err)
+		}
+	},
+}
+
+func init() {
+	cpCmd.Flags().StringVarP(&cpBranch, "branch", "b", "master", "Branch to copy the commit to")
+	cpCmd.Flags().StringVar(&cpBucketFrom, "bucket-from", "", "Bucket to copy the commit from (default the 'bucket' setting)")
+	cpCmd.Flags().StringVar(&cpBucketTo, "bucket-to", "", "Bucket to copy the commit to (default the 'bucket' setting)")
+	cpCmd.Flags().BoolVar(&cpFlags.Force, "force", false, "Update HEAD even if it moved or the branch is locked")
+	cpCmd.Flags().IntVar(&cpFlags.Concurrency, "concurrency", defaultUploadConcurrency, "Number of objects to copy at once")
+}
+
+// Copy stores the commit at source as a new commit of destination, a
+// step/version/branch, and points its HEAD to it.
+func Copy(ctx context.Context, source S3Path, destination S3Path, opts CopyOptions) error {
+	started := time.Now()
+	if opts.Concurrency < 1 {
+		opts.Concurrency = defaultUploadConcurrency
+	}
+
+	from, err := openStorage(source.bucket)
+	if err != nil {
+		return err
+	}
+	to, err := openStorage(destination.bucket)
+	if err != nil {
+		return err
+	}
+
+	var expectedHead string
+	if !opts.Force {
+		expectedHead, err = headTarget(ctx, to, destination.path)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read %s/HEAD", destination.path)
+		}
+	}
+
+	prefix := strings.TrimSuffix(source.path, "/") + "/"
+	manifest, err := readManifest(ctx, from, prefix)
+	if err != nil {
+		return err
+	}
+	metadata, err := readMetadata(ctx, from, prefix)
+	if err != nil {
+		return err
+	}
+
+	// The manifest and metadata are written anew once everything else,
+	// chunks and lineage included, has been copied
+	var objects []*Object
+	err = from.List(ctx, prefix, func(page []*Object) error {
+		for _, object := range page {
+			name := strings.TrimPrefix(object.Key, prefix)
+			if name != manifestFile && name != metadataFile {
+				objects = append(objects, object)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "listing %s", source.path)
+	}
+	if len(objects) == 0 && manifest == nil {
+		return fmt.Errorf("no commit at %s", source.path)
+	}
+
+	rootKey := generateRootKey(destination)
+	fmt.Fprintln(os.Stderr, "Copying "+source.path+" to "+rootKey)
+	stats := newTransferStats("cp")
+	stats.start()
+	defer stats.halt()
+
+	copies := newTransfers(ctx, opts.Concurrency)
+	for _, object := range objects {
+		fromKey, toKey, size := object.Key, rootKey+"/"+strings.TrimPrefix(object.Key, prefix), object.Size
+		stats.expect(1, size)
+		copies.Go(func() error {
+			if err := copyObject(ctx, from, fromKey, to, toKey, size); err != nil {
+				return err
+			}
+			stats.transferred(size)
+			return nil
+		})
+	}
+
+	// Deduplicated files are shared by every commit in a bucket, so only
+	// have to be copied to another bucket, and only if it lacks them
+	if manifest != nil && manifest.ObjectStore != "" && source.bucket != destination.bucket {
+		seen := make(map[string]bool)
+		for _, entry := range manifest.Files {
+			key, size := manifest.blobKey(entry.SHA256), entry.Size
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			stats.expect(1, size)
+			copies.Go(func() error {
+				exists, err := objectExists(ctx, to, key)
+				if err != nil {
+					return errors.Wrapf(err, "unable to check %s", key)
+				}
+				if exists {
+					stats.unchanged(size)
+					return nil
+				}
+				if err := copyObject(ctx, from, key, to, key, size); err != nil {
+					return err
+				}
+				stats.transferred(size)
+				return nil
+			})
+		}
+	}
+	if err := copies.Wait(); err != nil {
+		return err
+	}
+	stats.finish()
+
+	// The copy is described by the original's metadata, which also holds
+	// the data key of encrypted commits
+	if metadata == nil {
+		host, _ := os.Hostname()
+		metadata = &commitMetadata{Host: host, Committer: committer(), Started: started.UTC()}
+		metadata.Finished = time.Now().UTC()
+	}
+	parts := strings.Split(destination.path, "/")
+	if len(parts) == 3 {
+		metadata.Step, metadata.Version, metadata.Branch = parts[0], parts[1], parts[2]
+	}
+	metadata.CopiedFrom = source.bucket + "/" + strings.TrimSuffix(source.path, "/")
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return errors.Wrap(err, "unable to encode metadata")
+	}
+	if err := putObject(ctx, to, rootKey+"/"+metadataFile, data); err != nil {
+		return err
+	}
+
+	// The manifest goes last: a commit without one was never completed
+	if manifest != nil {
+		data, err = json.Marshal(manifest)
+		if err != nil {
+			return errors.Wrap(err, "unable to encode manifest")
+		}
+		if err := putObject(ctx, to, rootKey+"/"+manifestFile, data); err != nil {
+			return err
+		}
+	}
+
+	err = updateHead(ctx, to, destination.path, rootKey, expectedHead, opts.Force, "copy")
+	if _, logFailed := err.(*headLogError); logFailed {
+		return errors.Wrapf(err, "copied %s", rootKey)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "copied %s but could not update HEAD", rootKey)
+	}
+	return nil
+}
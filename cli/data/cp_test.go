@@ -0,0 +1,132 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func TestCopy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/features.csv", []byte("user,score\n1,0.5\n"), 0644)
+	afero.WriteFile(AppFs, "src/model/weights.bin", []byte("weights"), 0644)
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{Tags: map[string]string{"dataset": "2019-03"}})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+	storage, _ := openStorage("bucket")
+	source := readString(storage, "model/v1/master/HEAD")
+
+	for _, destination := range []S3Path{
+		NewS3Path("bucket", "model/v1/staging"),
+		NewS3Path("bucket", "other-model/v2/master"),
+		NewS3Path("staging-bucket", "model/v1/master"),
+	} {
+		err := Copy(context.Background(), NewS3Path("bucket", source), destination, CopyOptions{})
+		if err != nil {
+			t.Fatalf("It should copy to %s/%s, but %v", destination.bucket, destination.path, err)
+		}
+
+		to, _ := openStorage(destination.bucket)
+		head := readString(to, destination.path+"/HEAD")
+		if !strings.HasPrefix(head, destination.path+"/") || head == source {
+			t.Fatalf("It should point HEAD of %s to a new commit, got: %s", destination.path, head)
+		}
+		if readString(to, head+"/model/weights.bin") != "weights" {
+			t.Errorf("It should copy the files to %s", head)
+		}
+		if readString(to, head+"/"+manifestFile) != readString(storage, source+"/"+manifestFile) {
+			t.Errorf("It should copy the manifest to %s", head)
+		}
+
+		metadata, _ := readMetadata(context.Background(), to, head+"/")
+		if metadata == nil || metadata.Step+"/"+metadata.Version+"/"+metadata.Branch != destination.path ||
+			metadata.CopiedFrom != "bucket/"+source || metadata.Tags["dataset"] != "2019-03" {
+			t.Errorf("It should record where the commit was copied from, got: %+v", metadata)
+		}
+		if !strings.Contains(readString(to, destination.path+"/HEAD.log"), "copy") {
+			t.Errorf("It should log the copy in %s/HEAD.log", destination.path)
+		}
+
+		local := filepath.Join(dir, "get", destination.bucket, destination.path)
+		err = Get(context.Background(), NewS3Path(destination.bucket, destination.path+"/HEAD"), local, GetOptions{})
+		contents, _ := ioutil.ReadFile(filepath.Join(local, "features.csv"))
+		if err != nil || string(contents) != "user,score\n1,0.5\n" {
+			t.Errorf("It should get the copy, got: %q (%v)", contents, err)
+		}
+	}
+}
+
+func TestCopyDeduped(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/a", []byte("a"), 0644)
+	afero.WriteFile(AppFs, "src/b", []byte("b"), 0644)
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{Dedup: true})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+	storage, _ := openStorage("bucket")
+	source := readString(storage, "model/v1/master/HEAD")
+
+	err = Copy(context.Background(), NewS3Path("bucket", source), NewS3Path("staging-bucket", "model/v1/master"), CopyOptions{})
+	if err != nil {
+		t.Fatalf("It should copy, but %v", err)
+	}
+
+	destination := filepath.Join(dir, "get")
+	err = Get(context.Background(), NewS3Path("staging-bucket", "model/v1/master/HEAD"), destination, GetOptions{})
+	contents, _ := ioutil.ReadFile(filepath.Join(destination, "b"))
+	if err != nil || string(contents) != "b" {
+		t.Errorf("It should copy the blobs the commit needs to the other bucket, got: %q (%v)", contents, err)
+	}
+}
+
+func TestCopyToLockedBranch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/a", []byte("a"), 0644)
+	Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{})
+	storage, _ := openStorage("bucket")
+	source := readString(storage, "model/v1/master/HEAD")
+
+	if err := Copy(context.Background(), NewS3Path("bucket", "model/v1/missing"), NewS3Path("bucket", "model/v1/staging"), CopyOptions{}); err == nil {
+		t.Error("It should not copy a commit that doesn't exist")
+	}
+
+	lock, _ := json.Marshal(headLock{Owner: "other", Host: "pod", Created: time.Now().UTC()})
+	putObject(context.Background(), storage, "model/v1/staging/HEAD.lock", lock)
+	if err := Copy(context.Background(), NewS3Path("bucket", source), NewS3Path("bucket", "model/v1/staging"), CopyOptions{}); err == nil {
+		t.Error("It should not move the HEAD of a locked branch")
+	}
+	if err := Copy(context.Background(), NewS3Path("bucket", source), NewS3Path("bucket", "model/v1/staging"), CopyOptions{Force: true}); err != nil {
+		t.Errorf("It should move HEAD with force, but %v", err)
+	}
+}
+
+func TestCopySource(t *testing.T) {
+	if got := copySource("bucket", "model/v1/master/2019/a b+c.csv"); got != "bucket/model/v1/master/2019/a%20b%2Bc.csv" {
+		t.Errorf("It should escape the key but not its slashes, got: %s", got)
+	}
+}
@@ -0,0 +1,538 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	diffBranch       string
+	diffBucket       string
+	diffContent      bool
+	diffContentLimit int64
+	diffOutput       string
+)
+
+// diffContextLines is how many unchanged lines surround each change shown
+// by --content
+const diffContextLines = 3
+
+// maxDiffCells bounds the lines of one file times the lines of the other
+// that --content compares, to keep the memory it needs in check
+const maxDiffCells = 1 << 24
+
+var diffCmd = &cobra.Command{
+	Use:   "diff [step/version] [ref] [ref]",
+	Short: "Show the files that differ between two commits",
+	Args:  cobra.ExactArgs(3),
+	Long: `List the files added, removed or changed from one commit to another.
+
+A ref is the name of a branch for its HEAD, HEAD or tag:<name> for the
+branch given with -b, or the start of a commit path on that branch, as long as
+it matches a single commit. Any of these but a branch name can be preceded by
+a branch, as in experimental/tag:baseline or experimental/2019/03/01/12/30.
+
+Files are compared by the hashes in the commits' MANIFEST.json, or else by
+size and ETag. Files uploaded in parts have different ETags even when their
+contents are the same, so commits made without a manifest may show changes
+that aren't there. Files of the same size are shown as unknown when only one
+of the commits has a manifest, as there is nothing to compare them by.
+
+--content also shows what changed in text files no larger than
+--content-limit bytes.
+
+Example:
+
+$ paddle data diff trained-model/version1 master experimental
+$ paddle data diff trained-model/version1 tag:release-2019-q1 HEAD
+$ paddle data diff --content trained-model/version1 2019/03/01/12/30 experimental/HEAD
+$ paddle data diff -o json trained-model/version1 master experimental/tag:baseline
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if diffBucket == "" {
+			diffBucket = viper.GetString("bucket")
+		}
+		if diffBucket == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+		if diffOutput != "table" && diffOutput != "json" {
+			exitErrorf("Unknown output format %s, expected table or json", diffOutput)
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		storage, err := openStorage(diffBucket)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		stepVersion := strings.Trim(args[0], "/")
+		from, err := resolveRef(ctx, storage, stepVersion, diffBranch, args[1])
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		to, err := resolveRef(ctx, storage, stepVersion, diffBranch, args[2])
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		d, err := diffCommits(ctx, storage, from, to)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		if diffContent {
+			if err := d.addContent(ctx, diffContentLimit); err != nil {
+				exitErrorf("%v", err)
+			}
+		}
+
+		if diffOutput == "json" {
+			err = d.writeJSON(os.Stdout)
+		} else {
+			err = d.writeTable(os.Stdout)
+		}
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+	},
+}
+
+func init() {
+	diffCmd.Flags().StringVarP(&diffBranch, "branch", "b", "master", "Branch of refs that don't name one")
+	diffCmd.Flags().StringVar(&diffBucket, "bucket", "", "Bucket to use")
+	diffCmd.Flags().BoolVar(&diffContent, "content", false, "Show what changed in small text files")
+	diffCmd.Flags().Int64Var(&diffContentLimit, "content-limit", 64*1024, "Largest file, in bytes, to show the changes of with --content")
+	diffCmd.Flags().StringVarP(&diffOutput, "output", "o", "table", "Output format (table or json)")
+}
+
+// resolveRef returns the commit of stepVersion a ref given to diff names:
+// a branch for its HEAD, or HEAD, tag:<name> or the start of a commit path,
+// on branch unless preceded by another, as in experimental/tag:baseline.
+func resolveRef(ctx context.Context, storage Storage, stepVersion string, branch string, ref string) (string, error) {
+	ref = strings.Trim(ref, "/")
+	if ref == "" {
+		return "", errors.New("empty ref")
+	}
+	parts := strings.SplitN(ref, "/", 2)
+	if parts[0] != "HEAD" && !strings.HasPrefix(parts[0], tagPrefix) && !commitFolderPatterns[0].MatchString(parts[0]) {
+		branch = parts[0]
+		ref = "HEAD"
+		if len(parts) == 2 {
+			ref = parts[1]
+		}
+	}
+	branchPath := stepVersion + "/" + branch
+
+	if ref == "HEAD" || strings.HasPrefix(ref, tagPrefix) {
+		return resolveCommit(ctx, storage, NewS3Path("", branchPath+"/"+ref))
+	}
+
+	commits, err := listCommits(ctx, storage, branchPath+"/")
+	if err != nil {
+		return "", err
+	}
+	var matches []string
+	for _, commit := range commits {
+		if strings.HasPrefix(commit.Name, ref) {
+			matches = append(matches, branchPath+"/"+commit.Name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no commit %s on %s", ref, branchPath)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("%s is ambiguous on %s, it matches %d commits", ref, branchPath, len(matches))
+}
+
+// committedFile is what diff knows of a file of a commit: its manifest entry
+// if there is one, or else what listing it says, and where its contents are.
+type committedFile struct {
+	Size   int64
+	SHA256 string
+	ETag   string
+	key    string
+	// packed is the manifest entry of a file in a chunk of a packed commit
+	packed *ManifestEntry
+	// storage reads the file, decrypting it if the commit was encrypted
+	storage Storage
+}
+
+// compare reports how two versions of a file differ, going by their hashes
+// when both have one, or else by size and ETag: "changed", "unknown" when
+// they are the same size but only one has a hash, or "" when they are the
+// same.
+func (f committedFile) compare(other committedFile) string {
+	if f.SHA256 != "" && other.SHA256 != "" {
+		if f.SHA256 != other.SHA256 {
+			return "changed"
+		}
+		return ""
+	}
+	if f.Size != other.Size {
+		return "changed"
+	}
+	if f.SHA256 != "" || other.SHA256 != "" {
+		return "unknown"
+	}
+	if f.ETag != "" && other.ETag != "" && f.ETag != other.ETag {
+		return "changed"
+	}
+	return ""
+}
+
+// listCommitFiles returns the files of a commit by their path in it
+func listCommitFiles(ctx context.Context, storage Storage, commit string) (map[string]committedFile, error) {
+	source := S3Path{path: commit + "/"}
+	files := make(map[string]committedFile)
+
+	manifest, err := readManifest(ctx, storage, source.path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading manifest of %s", commit)
+	}
+	if manifest != nil {
+		dataStorage, err := commitStorage(ctx, storage, source.path)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range manifest.Files {
+			entry := entry
+			file := committedFile{Size: entry.Size, SHA256: entry.SHA256, key: source.path + entry.Path, storage: dataStorage}
+			if manifest.ObjectStore != "" {
+				file.key = manifest.blobKey(entry.SHA256)
+			}
+			if manifest.packed() {
+				file.key, file.packed = source.path, &entry
+			}
+			files[entry.Path] = file
+		}
+		return files, nil
+	}
+
+	// the same listing copy downloads from, for commits made before
+	// manifests were recorded
+	err = storage.List(ctx, source.path, func(objects []*Object) error {
+		listed, err := filterObjects(source, objects, selection{})
+		if err != nil {
+			return err
+		}
+		for _, obj := range listed {
+			files[strings.TrimPrefix(obj.Key, source.path)] = committedFile{Size: obj.Size, ETag: obj.ETag, key: obj.Key, storage: storage}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s not found", commit)
+	}
+	return files, nil
+}
+
+type fileChange struct {
+	Status  string `json:"status"`
+	Path    string `json:"path"`
+	OldSize int64  `json:"old_size"`
+	NewSize int64  `json:"new_size"`
+	Diff    string `json:"diff,omitempty"`
+
+	from *committedFile
+	to   *committedFile
+}
+
+type commitDiff struct {
+	From      string       `json:"from"`
+	To        string       `json:"to"`
+	Changes   []fileChange `json:"changes"`
+	Unchanged int          `json:"unchanged"`
+}
+
+// diffCommits compares the files of two commits
+func diffCommits(ctx context.Context, storage Storage, from string, to string) (*commitDiff, error) {
+	fromFiles, err := listCommitFiles(ctx, storage, from)
+	if err != nil {
+		return nil, err
+	}
+	toFiles, err := listCommitFiles(ctx, storage, to)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &commitDiff{From: from, To: to, Changes: []fileChange{}}
+	for path, old := range fromFiles {
+		old := old
+		current, found := toFiles[path]
+		if !found {
+			d.Changes = append(d.Changes, fileChange{Status: "removed", Path: path, OldSize: old.Size, from: &old})
+			continue
+		}
+		if status := old.compare(current); status != "" {
+			d.Changes = append(d.Changes, fileChange{Status: status, Path: path, OldSize: old.Size, NewSize: current.Size, from: &old, to: &current})
+		} else {
+			d.Unchanged++
+		}
+	}
+	for path, current := range toFiles {
+		current := current
+		if _, found := fromFiles[path]; !found {
+			d.Changes = append(d.Changes, fileChange{Status: "added", Path: path, NewSize: current.Size, to: &current})
+		}
+	}
+
+	sort.Slice(d.Changes, func(i, j int) bool {
+		return d.Changes[i].Path < d.Changes[j].Path
+	})
+	return d, nil
+}
+
+// addContent fills in the diff of the text files no larger than limit
+func (d *commitDiff) addContent(ctx context.Context, limit int64) error {
+	for i := range d.Changes {
+		change := &d.Changes[i]
+		if change.OldSize > limit || change.NewSize > limit {
+			continue
+		}
+		old, err := readCommittedFile(ctx, change.from)
+		if err != nil {
+			return err
+		}
+		current, err := readCommittedFile(ctx, change.to)
+		if err != nil {
+			return err
+		}
+		if !isText(old) || !isText(current) {
+			continue
+		}
+
+		var buf bytes.Buffer
+		writeUnifiedDiff(&buf, change.Path, splitLines(old), splitLines(current))
+		change.Diff = buf.String()
+	}
+	return nil
+}
+
+// readCommittedFile returns the contents of a file, or nothing for a file
+// that isn't there
+func readCommittedFile(ctx context.Context, file *committedFile) ([]byte, error) {
+	if file == nil {
+		return nil, nil
+	}
+	if file.packed != nil {
+		body, err := openPackedFile(ctx, file.storage, file.key, *file.packed)
+		if err != nil {
+			return nil, err
+		}
+		defer body.Close()
+		return ioutil.ReadAll(body)
+	}
+
+	contents, found, err := readObjectIfExists(ctx, file.storage, file.key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%s not found", file.key)
+	}
+	return contents, nil
+}
+
+func isText(contents []byte) bool {
+	return utf8.Valid(contents) && bytes.IndexByte(contents, 0) == -1
+}
+
+func splitLines(contents []byte) []string {
+	if len(contents) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+}
+
+// diffOp is a line of a diff: kept (' '), removed ('-') or added ('+')
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// diffLines returns the shortest edit turning a into b, from their longest
+// common subsequence of lines.
+func diffLines(a []string, b []string) []diffOp {
+	common := make([][]int, len(a)+1)
+	for i := range common {
+		common[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				common[i][j] = common[i+1][j+1] + 1
+			} else if common[i+1][j] >= common[i][j+1] {
+				common[i][j] = common[i+1][j]
+			} else {
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	var ops []diffOp
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && common[i+1][j] >= common[i][j+1]):
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	return ops
+}
+
+// writeUnifiedDiff writes the changes from a to b in the unified format of
+// diff -u, with diffContextLines of context around each change.
+func writeUnifiedDiff(w io.Writer, name string, a []string, b []string) {
+	fmt.Fprintf(w, "--- a/%s\n+++ b/%s\n", name, name)
+	if len(a)*len(b) > maxDiffCells {
+		fmt.Fprintln(w, "Too many lines to compare")
+		return
+	}
+
+	ops := diffLines(a, b)
+	// the number of lines of a and b before each op
+	aLines := make([]int, len(ops)+1)
+	bLines := make([]int, len(ops)+1)
+	for k, op := range ops {
+		aLines[k+1], bLines[k+1] = aLines[k], bLines[k]
+		if op.kind != '+' {
+			aLines[k+1]++
+		}
+		if op.kind != '-' {
+			bLines[k+1]++
+		}
+	}
+
+	for k := 0; k < len(ops); {
+		for k < len(ops) && ops[k].kind == ' ' {
+			k++
+		}
+		if k == len(ops) {
+			break
+		}
+
+		start := k - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		last := k
+		for k < len(ops) && k-last <= 2*diffContextLines {
+			if ops[k].kind != ' ' {
+				last = k
+			}
+			k++
+		}
+		end := last + diffContextLines + 1
+		if end > len(ops) {
+			end = len(ops)
+		}
+		k = end
+
+		fmt.Fprintf(w, "@@ -%s +%s @@\n",
+			hunkRange(aLines[start], aLines[end]-aLines[start]),
+			hunkRange(bLines[start], bLines[end]-bLines[start]))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(w, "%c%s\n", op.kind, op.line)
+		}
+	}
+}
+
+func hunkRange(start int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func (d *commitDiff) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d)
+}
+
+func (d *commitDiff) writeTable(w io.Writer) error {
+	fmt.Fprintf(w, "Comparing %s to %s\n", d.From, d.To)
+	if len(d.Changes) == 0 {
+		fmt.Fprintf(w, "No differences in %d files\n", d.Unchanged)
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tPATH\tSIZE\t")
+	for _, change := range d.Changes {
+		var size string
+		switch change.Status {
+		case "added":
+			size = formatBytes(change.NewSize)
+		case "removed":
+			size = formatBytes(change.OldSize)
+		default:
+			size = formatBytes(change.OldSize) + " -> " + formatBytes(change.NewSize)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t\n", change.Status, change.Path, size)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	unknown := 0
+	for _, change := range d.Changes {
+		if change.Status == "unknown" {
+			unknown++
+		}
+	}
+	if unknown > 0 {
+		fmt.Fprintf(w, "%d changed, %d unchanged, %d unknown\n", len(d.Changes)-unknown, d.Unchanged, unknown)
+	} else {
+		fmt.Fprintf(w, "%d changed, %d unchanged\n", len(d.Changes), d.Unchanged)
+	}
+
+	for _, change := range d.Changes {
+		if change.Diff != "" {
+			fmt.Fprintf(w, "\n%s", change.Diff)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+var diffObjects = map[string]string{
+	"model/v1/master/HEAD":                                       "model/v1/master/2019/03/02/12/30_BbB",
+	"model/v1/master/tags/release":                               `{"commit":"model/v1/master/2019/03/01/12/30_AaA"}`,
+	"model/v1/master/2019/03/01/12/30_AaA/same.csv":              "a,b\n",
+	"model/v1/master/2019/03/01/12/30_AaA/metrics.txt":           "auc 0.8\nloss 0.3\n",
+	"model/v1/master/2019/03/01/12/30_AaA/old.bin":               "\x00\x01",
+	"model/v1/master/2019/03/01/12/30_AaA/" + manifestFile:       `{"files":[{"path":"same.csv","size":4,"sha256":"s"},{"path":"metrics.txt","size":17,"sha256":"m1"},{"path":"old.bin","size":2,"sha256":"o"}]}`,
+	"model/v1/master/2019/03/02/12/30_BbB/same.csv":              "a,b\n",
+	"model/v1/master/2019/03/02/12/30_BbB/metrics.txt":           "auc 0.9\nloss 0.3\n",
+	"model/v1/master/2019/03/02/12/30_BbB/new.txt":               "hello\n",
+	"model/v1/master/2019/03/02/12/30_BbB/" + manifestFile:       `{"files":[{"path":"same.csv","size":4,"sha256":"s"},{"path":"metrics.txt","size":17,"sha256":"m2"},{"path":"new.txt","size":6,"sha256":"n"}]}`,
+	"model/v1/experimental/HEAD":                                 "model/v1/experimental/2019/03/03/09/00_CcC",
+	"model/v1/experimental/2019/03/03/09/00_CcC/same.csv":        "a,b\n",
+	"model/v1/experimental/2019/03/03/09/00_CcC/metrics.txt":     "auc 0.95\n",
+	"model/v1/experimental/2019/03/03/09/00_CcC/" + metadataFile: `{}`,
+}
+
+func TestResolveRef(t *testing.T) {
+	storage := memStorage(diffObjects)
+
+	for ref, expected := range map[string]string{
+		"HEAD":                              "model/v1/master/2019/03/02/12/30_BbB",
+		"master":                            "model/v1/master/2019/03/02/12/30_BbB",
+		"experimental":                      "model/v1/experimental/2019/03/03/09/00_CcC",
+		"experimental/HEAD":                 "model/v1/experimental/2019/03/03/09/00_CcC",
+		"tag:release":                       "model/v1/master/2019/03/01/12/30_AaA",
+		"master/tag:release":                "model/v1/master/2019/03/01/12/30_AaA",
+		"2019/03/01":                        "model/v1/master/2019/03/01/12/30_AaA",
+		"2019/03/02/12/30_BbB/":             "model/v1/master/2019/03/02/12/30_BbB",
+		"experimental/2019/03/03/09/00_CcC": "model/v1/experimental/2019/03/03/09/00_CcC",
+	} {
+		commit, err := resolveRef(context.Background(), storage, "model/v1", "master", ref)
+		if err != nil || commit != expected {
+			t.Errorf("%s should resolve to %s, got: %s (%v)", ref, expected, commit, err)
+		}
+	}
+
+	for _, ref := range []string{"2019", "2020", "missing", "tag:missing"} {
+		if _, err := resolveRef(context.Background(), storage, "model/v1", "master", ref); err == nil {
+			t.Errorf("It should return an error resolving %s", ref)
+		}
+	}
+}
+
+func TestDiffCommits(t *testing.T) {
+	storage := memStorage(diffObjects)
+
+	d, err := diffCommits(context.Background(), storage, "model/v1/master/2019/03/01/12/30_AaA", "model/v1/master/2019/03/02/12/30_BbB")
+	if err != nil {
+		t.Fatalf("It should diff the commits, but %v", err)
+	}
+	var changes []string
+	for _, change := range d.Changes {
+		changes = append(changes, change.Status+" "+change.Path)
+	}
+	if strings.Join(changes, ",") != "changed metrics.txt,added new.txt,removed old.bin" || d.Unchanged != 1 {
+		t.Errorf("Unexpected changes: %v, %d unchanged", changes, d.Unchanged)
+	}
+
+	err = d.addContent(context.Background(), 1024)
+	if err != nil {
+		t.Fatalf("It should diff the contents, but %v", err)
+	}
+	expected := "--- a/metrics.txt\n+++ b/metrics.txt\n@@ -1,2 +1,2 @@\n-auc 0.8\n+auc 0.9\n loss 0.3\n"
+	if d.Changes[0].Diff != expected {
+		t.Errorf("Expected the diff of metrics.txt to be:\n%s\ngot:\n%s", expected, d.Changes[0].Diff)
+	}
+	if d.Changes[1].Diff != "--- a/new.txt\n+++ b/new.txt\n@@ -0,0 +1 @@\n+hello\n" {
+		t.Errorf("Unexpected diff of an added file:\n%s", d.Changes[1].Diff)
+	}
+	if d.Changes[2].Diff != "" {
+		t.Errorf("It should not diff binary files, got:\n%s", d.Changes[2].Diff)
+	}
+
+	var out bytes.Buffer
+	d.writeTable(&out)
+	for _, line := range []string{"changed  metrics.txt  17 B -> 17 B", "3 changed, 1 unchanged", "+hello"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in output:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestDiffCommitsWithoutManifest(t *testing.T) {
+	storage := memStorage(diffObjects)
+
+	d, err := diffCommits(context.Background(), storage, "model/v1/master/2019/03/02/12/30_BbB", "model/v1/experimental/2019/03/03/09/00_CcC")
+	if err != nil {
+		t.Fatalf("It should diff the commits, but %v", err)
+	}
+	var changes []string
+	for _, change := range d.Changes {
+		changes = append(changes, change.Status+" "+change.Path)
+	}
+	if strings.Join(changes, ",") != "changed metrics.txt,removed new.txt,unknown same.csv" || d.Unchanged != 0 {
+		t.Errorf("It should not call files of the same size unchanged without hashes for both, got: %v, %d unchanged", changes, d.Unchanged)
+	}
+
+	var out bytes.Buffer
+	d.writeTable(&out)
+	if !strings.Contains(out.String(), "2 changed, 0 unchanged, 1 unknown") {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
+
+func TestWriteUnifiedDiff(t *testing.T) {
+	var a, b []string
+	for i := 0; i < 20; i++ {
+		a = append(a, string(rune('a'+i)))
+	}
+	b = append(b, a...)
+	b[1] = "B"
+	b[15] = "P"
+
+	var out bytes.Buffer
+	writeUnifiedDiff(&out, "f", a, b)
+	expected := `--- a/f
++++ b/f
+@@ -1,5 +1,5 @@
+ a
+-b
++B
+ c
+ d
+ e
+@@ -13,7 +13,7 @@
+ m
+ n
+ o
+-p
++P
+ q
+ r
+ s
+`
+	if out.String() != expected {
+		t.Errorf("Expected:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
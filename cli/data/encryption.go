@@ -0,0 +1,418 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// encryptionScheme is how the files of encrypted commits are encrypted: with
+// AES-256-GCM under a data key of the commit's own, in segments of
+// encryptionSegmentSize so files of any size can be streamed. Each object
+// starts with a random nonce prefix, and each segment is sealed with that
+// prefix and its number as nonce and whether it is the last one as
+// additional data, so segments can't be reordered or dropped unnoticed.
+const encryptionScheme = "aes-256-gcm-64k"
+
+const encryptionSegmentSize = 64 * 1024
+
+const noncePrefixSize = 8
+
+// kmsKeyPrefix marks a key given as a KMS key id, ARN or alias
+const kmsKeyPrefix = "kms://"
+
+var encryptionKeyFlag string
+
+// commitEncryption is recorded in the metadata of encrypted commits, with
+// the data key their files are encrypted with wrapped by the master key.
+type commitEncryption struct {
+	Scheme   string `json:"scheme"`
+	Provider string `json:"provider"`
+	KeyID    string `json:"key_id"`
+	DataKey  []byte `json:"data_key"`
+}
+
+// keyProvider hands out data keys to encrypt commits with, wrapped by a
+// master key it holds, and unwraps them again, the way AWS KMS does.
+type keyProvider interface {
+	// name and keyID are recorded with the commit, to know which master
+	// key to unwrap its data key with
+	name() string
+	keyID() string
+	generateDataKey(ctx context.Context) (plain []byte, wrapped []byte, err error)
+	decrypt(ctx context.Context, wrapped []byte) ([]byte, error)
+}
+
+// encryptionKey returns the master key given with --encryption-key or the
+// 'encryption-key' setting
+func encryptionKey() string {
+	if encryptionKeyFlag != "" {
+		return encryptionKeyFlag
+	}
+	return viper.GetString("encryption-key")
+}
+
+// openKeyProvider returns the key provider for a master key: a KMS key as
+// kms://<key id, ARN or alias>, or else the path of a keyfile.
+func openKeyProvider(key string) (keyProvider, error) {
+	switch {
+	case key == "":
+		return nil, errors.New("no encryption key given, set 'encryption-key' or use --encryption-key")
+	case strings.HasPrefix(key, kmsKeyPrefix):
+		return newKMSKeyProvider(strings.TrimPrefix(key, kmsKeyPrefix)), nil
+	}
+	return readKeyfile(strings.TrimPrefix(key, "file://"))
+}
+
+// keyfileProvider wraps data keys with a 256 bit key kept in a local file
+type keyfileProvider struct {
+	key []byte
+}
+
+// readKeyfile reads a 256 bit key, as raw bytes, hex or base64, such as
+// 'openssl rand -base64 32' writes.
+func readKeyfile(path string) (*keyfileProvider, error) {
+	contents, err := afero.ReadFile(AppFs, path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading keyfile")
+	}
+	if len(contents) == 32 {
+		return &keyfileProvider{key: contents}, nil
+	}
+
+	text := strings.TrimSpace(string(contents))
+	if key, err := hex.DecodeString(text); err == nil && len(key) == 32 {
+		return &keyfileProvider{key: key}, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(text); err == nil && len(key) == 32 {
+		return &keyfileProvider{key: key}, nil
+	}
+	return nil, fmt.Errorf("keyfile %s must hold a 256 bit key, as 32 bytes, hex or base64", path)
+}
+
+func (p *keyfileProvider) name() string {
+	return "keyfile"
+}
+
+// keyID is a fingerprint of the key, to tell keyfiles apart
+func (p *keyfileProvider) keyID() string {
+	sum := sha256.Sum256(p.key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func (p *keyfileProvider) generateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	plain := make([]byte, 32)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, nil, err
+	}
+	aead, err := newAEAD(p.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	return plain, aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (p *keyfileProvider) decrypt(ctx context.Context, wrapped []byte) ([]byte, error) {
+	aead, err := newAEAD(p.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("invalid data key")
+	}
+	plain, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unwrap data key with keyfile %s", p.keyID())
+	}
+	return plain, nil
+}
+
+// kmsKeyProvider has AWS KMS generate and unwrap data keys
+type kmsKeyProvider struct {
+	svc kmsiface.KMSAPI
+	id  string
+}
+
+// kmsClient connects to KMS, and is replaced in tests
+var kmsClient = func() kmsiface.KMSAPI {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+	return kms.New(sess)
+}
+
+func newKMSKeyProvider(id string) *kmsKeyProvider {
+	return &kmsKeyProvider{svc: kmsClient(), id: id}
+}
+
+func (p *kmsKeyProvider) name() string {
+	return "kms"
+}
+
+func (p *kmsKeyProvider) keyID() string {
+	return p.id
+}
+
+func (p *kmsKeyProvider) generateDataKey(ctx context.Context) ([]byte, []byte, error) {
+	out, err := p.svc.GenerateDataKeyWithContext(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   aws.String(p.id),
+		KeySpec: aws.String(kms.DataKeySpecAes256),
+	})
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "generating data key with %s", p.id)
+	}
+	// record the key's ARN rather than an alias that may be moved
+	if out.KeyId != nil {
+		p.id = *out.KeyId
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+func (p *kmsKeyProvider) decrypt(ctx context.Context, wrapped []byte) ([]byte, error) {
+	out, err := p.svc.DecryptWithContext(ctx, &kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unwrapping data key with %s", p.id)
+	}
+	return out.Plaintext, nil
+}
+
+// newCommitEncryption has provider generate a data key for a commit,
+// returning what to record in its metadata and the storage to upload its
+// files through.
+func newCommitEncryption(ctx context.Context, storage Storage, provider keyProvider) (*commitEncryption, Storage, error) {
+	plain, wrapped, err := provider.generateDataKey(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	encrypted, err := newEncryptedStorage(storage, plain)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &commitEncryption{
+		Scheme:   encryptionScheme,
+		Provider: provider.name(),
+		KeyID:    provider.keyID(),
+		DataKey:  wrapped,
+	}, encrypted, nil
+}
+
+// commitStorage returns the storage to read the files of the commit under
+// prefix through, which decrypts them if the commit was encrypted.
+func commitStorage(ctx context.Context, storage Storage, prefix string) (Storage, error) {
+	metadata, err := readMetadata(ctx, storage, prefix)
+	if err != nil || metadata == nil || metadata.Encryption == nil {
+		return storage, err
+	}
+	e := metadata.Encryption
+	if e.Scheme != encryptionScheme {
+		return nil, fmt.Errorf("%s is encrypted with %s, which this version of paddle doesn't support", prefix, e.Scheme)
+	}
+
+	var provider keyProvider
+	if e.Provider == "kms" {
+		// the wrapped key says which KMS key to unwrap it with
+		provider = newKMSKeyProvider(e.KeyID)
+	} else {
+		provider, err = openKeyProvider(encryptionKey())
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s is encrypted with keyfile %s", prefix, e.KeyID)
+		}
+	}
+	key, err := provider.decrypt(ctx, e.DataKey)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s is encrypted with %s %s", prefix, e.Provider, e.KeyID)
+	}
+	return newEncryptedStorage(storage, key)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedStorage encrypts what is put and decrypts what is got through
+// it, leaving everything else to the storage underneath. Ranged gets fall
+// back to getting whole objects.
+type encryptedStorage struct {
+	Storage
+	aead cipher.AEAD
+}
+
+func newEncryptedStorage(storage Storage, key []byte) (*encryptedStorage, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid data key")
+	}
+	return &encryptedStorage{Storage: storage, aead: aead}, nil
+}
+
+func (s *encryptedStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	r := &encryptingReader{
+		aead:   s.aead,
+		src:    bufio.NewReaderSize(body, encryptionSegmentSize+1),
+		prefix: prefix,
+	}
+	// the object starts with the nonce prefix
+	r.pending.Reset(prefix)
+	return s.Storage.Put(ctx, key, r)
+}
+
+func (s *encryptedStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := s.Storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&decryptingReader{
+		aead: s.aead,
+		key:  key,
+		src:  bufio.NewReaderSize(body, encryptionSegmentSize+s.aead.Overhead()+1),
+	}, body}, nil
+}
+
+func segmentNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, 4)
+	binary.BigEndian.PutUint32(nonce, counter)
+	return append(prefix[:noncePrefixSize:noncePrefixSize], nonce...)
+}
+
+func segmentData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// encryptingReader encrypts what it reads from src a segment at a time
+type encryptingReader struct {
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	prefix  []byte
+	counter uint32
+	sealed  []byte
+	pending bytes.Reader
+	done    bool
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	for r.pending.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.seal(); err != nil {
+			return 0, err
+		}
+	}
+	return r.pending.Read(p)
+}
+
+func (r *encryptingReader) seal() error {
+	// looking one byte past the segment tells whether it is the last
+	peeked, err := r.src.Peek(encryptionSegmentSize + 1)
+	last := err == io.EOF
+	if err != nil && !last {
+		return err
+	}
+	n := len(peeked)
+	if !last {
+		n = encryptionSegmentSize
+	}
+
+	r.sealed = r.aead.Seal(r.sealed[:0], segmentNonce(r.prefix, r.counter), peeked[:n], segmentData(last))
+	r.pending.Reset(r.sealed)
+	r.src.Discard(n)
+	r.counter++
+	r.done = last
+	return nil
+}
+
+// decryptingReader decrypts what encryptingReader encrypted
+type decryptingReader struct {
+	aead    cipher.AEAD
+	key     string
+	src     *bufio.Reader
+	prefix  []byte
+	counter uint32
+	opened  []byte
+	pending bytes.Reader
+	done    bool
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for r.pending.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	return r.pending.Read(p)
+}
+
+func (r *decryptingReader) open() error {
+	if r.prefix == nil {
+		r.prefix = make([]byte, noncePrefixSize)
+		if _, err := io.ReadFull(r.src, r.prefix); err != nil {
+			return r.corrupt(err)
+		}
+	}
+
+	size := encryptionSegmentSize + r.aead.Overhead()
+	peeked, err := r.src.Peek(size + 1)
+	last := err == io.EOF
+	if err != nil && !last {
+		return err
+	}
+	n := len(peeked)
+	if !last {
+		n = size
+	}
+
+	r.opened, err = r.aead.Open(r.opened[:0], segmentNonce(r.prefix, r.counter), peeked[:n], segmentData(last))
+	if err != nil {
+		return r.corrupt(err)
+	}
+	r.pending.Reset(r.opened)
+	r.src.Discard(n)
+	r.counter++
+	r.done = last
+	return nil
+}
+
+// corrupt reports an object that doesn't decrypt, which trying again won't
+// fix
+func (r *decryptingReader) corrupt(err error) error {
+	return &permanentError{fmt.Errorf("unable to decrypt %s, it is corrupt or truncated: %v", r.key, err)}
+}
@@ -0,0 +1,239 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	storage := memStorage(map[string]string{})
+	encrypted, _ := newEncryptedStorage(storage, testKey(1))
+
+	for _, size := range []int{0, 1, encryptionSegmentSize - 1, encryptionSegmentSize, encryptionSegmentSize + 1, 3*encryptionSegmentSize + 100} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		err := encrypted.Put(context.Background(), "a", bytes.NewReader(plain))
+		if err != nil {
+			t.Fatalf("It should put %d bytes, but %v", size, err)
+		}
+
+		raw := readString(storage, "a")
+		segments := (size + encryptionSegmentSize - 1) / encryptionSegmentSize
+		if segments == 0 {
+			segments = 1
+		}
+		if len(raw) != noncePrefixSize+size+segments*16 {
+			t.Errorf("It should store %d bytes encrypted, got %d bytes", size, len(raw))
+		}
+		// a few plain bytes could turn up in any random ciphertext
+		if size >= 16 && strings.Contains(raw, string(plain)) {
+			t.Errorf("It should not store %d bytes in the clear", size)
+		}
+
+		body, err := encrypted.Get(context.Background(), "a")
+		if err != nil {
+			t.Fatalf("It should get %d bytes, but %v", size, err)
+		}
+		contents, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil || !bytes.Equal(contents, plain) {
+			t.Errorf("It should decrypt %d bytes, got %d (%v)", size, len(contents), err)
+		}
+	}
+}
+
+func TestEncryptedStorageDetectsTampering(t *testing.T) {
+	storage := memStorage(map[string]string{})
+	encrypted, _ := newEncryptedStorage(storage, testKey(1))
+	encrypted.Put(context.Background(), "a", bytes.NewReader(make([]byte, encryptionSegmentSize+10)))
+	raw := []byte(readString(storage, "a"))
+
+	flipped := append([]byte{}, raw...)
+	flipped[100] ^= 1
+	truncated := raw[:noncePrefixSize+encryptionSegmentSize+16]
+	otherKey, _ := newEncryptedStorage(storage, testKey(2))
+
+	for name, test := range map[string]struct {
+		storage Storage
+		raw     []byte
+	}{
+		"a flipped bit":      {encrypted, flipped},
+		"a missing segment":  {encrypted, truncated},
+		"an empty object":    {encrypted, []byte{}},
+		"the wrong data key": {otherKey, raw},
+	} {
+		putObject(context.Background(), storage, "b", test.raw)
+		body, _ := test.storage.Get(context.Background(), "b")
+		_, err := ioutil.ReadAll(body)
+		body.Close()
+		if err == nil || isRetryable(err) {
+			t.Errorf("It should fail for good with %s, got: %v", name, err)
+		}
+	}
+}
+
+func TestReadKeyfile(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	key := testKey(7)
+	afero.WriteFile(AppFs, "raw", key, 0600)
+	afero.WriteFile(AppFs, "hex", []byte(strings.Repeat("07", 32)+"\n"), 0600)
+	afero.WriteFile(AppFs, "base64", []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+	afero.WriteFile(AppFs, "short", []byte("secret"), 0600)
+
+	for _, path := range []string{"raw", "hex", "file://base64"} {
+		provider, err := openKeyProvider(path)
+		if err != nil || !bytes.Equal(provider.(*keyfileProvider).key, key) {
+			t.Errorf("It should read the key from %s, got: %v", path, err)
+		}
+	}
+	for _, path := range []string{"short", "missing", ""} {
+		if _, err := openKeyProvider(path); err == nil {
+			t.Errorf("It should not accept %q as a keyfile", path)
+		}
+	}
+}
+
+func TestCommitEncrypted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+	defer viper.Set("encryption-key", "")
+
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "paddle.key", testKey(3), 0600)
+	afero.WriteFile(AppFs, "other.key", testKey(4), 0600)
+	afero.WriteFile(AppFs, "src/features.csv", []byte("user,score\n1,0.5\n"), 0644)
+
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{EncryptionKey: "paddle.key"})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+
+	storage, _ := openStorage("bucket")
+	head := readString(storage, "model/v1/master/HEAD")
+	if strings.Contains(readString(storage, head+"/features.csv"), "score") {
+		t.Error("It should encrypt the files")
+	}
+	metadata, _ := readMetadata(context.Background(), storage, head+"/")
+	if metadata.Encryption == nil || metadata.Encryption.Provider != "keyfile" || metadata.Encryption.Scheme != encryptionScheme {
+		t.Fatalf("It should record the encryption in the metadata, got: %+v", metadata.Encryption)
+	}
+
+	get := func(key string) (string, error) {
+		viper.Set("encryption-key", key)
+		destination, _ := ioutil.TempDir(dir, "get")
+		err := Get(context.Background(), NewS3Path("bucket", "model/v1/master/HEAD"), destination, GetOptions{})
+		contents, _ := ioutil.ReadFile(filepath.Join(destination, "features.csv"))
+		return string(contents), err
+	}
+
+	if contents, err := get("paddle.key"); err != nil || contents != "user,score\n1,0.5\n" {
+		t.Errorf("It should decrypt the files, got: %q (%v)", contents, err)
+	}
+	if _, err := get(""); err == nil {
+		t.Error("It should need the keyfile to get the files")
+	}
+	if _, err := get("other.key"); err == nil {
+		t.Error("It should not decrypt with another keyfile")
+	}
+
+	var out bytes.Buffer
+	viper.Set("encryption-key", "paddle.key")
+	err = Cat(context.Background(), NewS3Path("bucket", head), "features.csv", &out)
+	if err != nil || out.String() != "user,score\n1,0.5\n" {
+		t.Errorf("It should cat the decrypted file, got: %q (%v)", out.String(), err)
+	}
+
+	// plain commits are unaffected by the key
+	err = Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{Force: true})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+	if contents, err := get("other.key"); err != nil || contents != "user,score\n1,0.5\n" {
+		t.Errorf("It should get plain commits, got: %q (%v)", contents, err)
+	}
+}
+
+func TestCommitEncryptedAndDeduped(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/a", []byte("a"), 0644)
+
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{EncryptionKey: "paddle.key", Dedup: true})
+	if err == nil {
+		t.Error("It should refuse to both encrypt and dedup")
+	}
+}
+
+// fakeKMS wraps data keys by reversing them
+type fakeKMS struct {
+	kmsiface.KMSAPI
+}
+
+func reversed(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+	return r
+}
+
+func (f *fakeKMS) GenerateDataKeyWithContext(ctx aws.Context, in *kms.GenerateDataKeyInput, opts ...request.Option) (*kms.GenerateDataKeyOutput, error) {
+	key := testKey(5)
+	key[0] = 9
+	return &kms.GenerateDataKeyOutput{
+		KeyId:          aws.String("arn:aws:kms:eu-west-1:123:key/abc"),
+		Plaintext:      key,
+		CiphertextBlob: reversed(key),
+	}, nil
+}
+
+func (f *fakeKMS) DecryptWithContext(ctx aws.Context, in *kms.DecryptInput, opts ...request.Option) (*kms.DecryptOutput, error) {
+	return &kms.DecryptOutput{Plaintext: reversed(in.CiphertextBlob)}, nil
+}
+
+func TestKMSKeyProvider(t *testing.T) {
+	defer func(client func() kmsiface.KMSAPI) { kmsClient = client }(kmsClient)
+	kmsClient = func() kmsiface.KMSAPI { return &fakeKMS{} }
+
+	storage := memStorage(map[string]string{})
+	provider, _ := openKeyProvider("kms://alias/paddle")
+	encryption, encrypted, err := newCommitEncryption(context.Background(), storage, provider)
+	if err != nil {
+		t.Fatalf("It should generate a data key, but %v", err)
+	}
+	if encryption.Provider != "kms" || encryption.KeyID != "arn:aws:kms:eu-west-1:123:key/abc" {
+		t.Errorf("It should record the ARN of the KMS key, got: %+v", encryption)
+	}
+
+	encrypted.Put(context.Background(), "c/a", strings.NewReader("secret"))
+	putObject(context.Background(), storage, "c/"+metadataFile, []byte(`{"encryption":{"scheme":"`+encryptionScheme+`","provider":"kms","key_id":"arn","data_key":"`+base64.StdEncoding.EncodeToString(encryption.DataKey)+`"}}`))
+
+	decrypted, err := commitStorage(context.Background(), storage, "c/")
+	if err != nil {
+		t.Fatalf("It should unwrap the data key with KMS, but %v", err)
+	}
+	contents, _, err := readObjectIfExists(context.Background(), decrypted, "c/a")
+	if err != nil || string(contents) != "secret" {
+		t.Errorf("It should decrypt the file, got: %q (%v)", contents, err)
+	}
+}
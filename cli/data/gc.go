@@ -0,0 +1,646 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	gcBucket         string
+	gcKeepLast       int
+	gcOlderThan      int
+	gcDeleteMerged   bool
+	gcAbandonedAfter int
+	gcDryRun         bool
+	gcYes            bool
+)
+
+// gcDefaultBranch is the branch other branches are merged into, which is
+// never deleted as merged or abandoned.
+const gcDefaultBranch = "master"
+
+var gcCmd = &cobra.Command{
+	Use:   "gc [step[/version[/branch]]]",
+	Short: "Delete old commits and branches from S3",
+	Args:  cobra.MaximumNArgs(1),
+	Long: `Delete commits according to retention policies, for the whole bucket or the
+steps, versions or branches given.
+
+--keep-last N keeps the newest N commits of each branch and --older-than D
+only deletes commits made more than D days ago; given both, commits are
+deleted when they are neither among the newest N nor younger than D days.
+--delete-merged deletes branches whose HEAD has been master's HEAD or holds
+the same files as a commit on master, and --abandoned-after D deletes
+branches without a commit in the last D days. master itself is never deleted.
+
+Whatever the policies, gc never deletes a commit that a HEAD or a tag points
+to, nor one that a kept commit was made from according to its lineage. Files stored
+with --dedup are deleted once no remaining commit refers to them, so avoid
+running gc while such commits are being made.
+
+The commits to delete are listed with their sizes and need confirming,
+unless --yes is given. --dry-run only lists them.
+
+Example:
+
+$ paddle data gc --dry-run --keep-last 10 --older-than 30
+$ paddle data gc --delete-merged --abandoned-after 90 trained-model
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if gcBucket == "" {
+			gcBucket = viper.GetString("bucket")
+		}
+		if gcBucket == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+
+		scope := ""
+		if len(args) == 1 {
+			scope = strings.Trim(args[0], "/")
+		}
+		policy := gcPolicy{
+			KeepLast:       gcKeepLast,
+			OlderThan:      time.Duration(gcOlderThan) * 24 * time.Hour,
+			DeleteMerged:   gcDeleteMerged,
+			AbandonedAfter: time.Duration(gcAbandonedAfter) * 24 * time.Hour,
+			Now:            time.Now(),
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		storage, err := openStorage(gcBucket)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		plan, err := planGC(ctx, storage, gcBucket, scope, policy)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		plan.writeReport(os.Stdout)
+		if plan.empty() || gcDryRun {
+			return
+		}
+		if !gcYes && !confirm(os.Stdin, os.Stdout, "Delete them?") {
+			fmt.Println("Nothing deleted")
+			return
+		}
+
+		if err := plan.execute(ctx, storage); err != nil {
+			exitErrorf("%v", err)
+		}
+		fmt.Println("Done")
+	},
+}
+
+func init() {
+	gcCmd.Flags().StringVar(&gcBucket, "bucket", "", "Bucket to use")
+	gcCmd.Flags().IntVar(&gcKeepLast, "keep-last", 0, "Keep the newest N commits of each branch")
+	gcCmd.Flags().IntVar(&gcOlderThan, "older-than", 0, "Only delete commits older than this many days")
+	gcCmd.Flags().BoolVar(&gcDeleteMerged, "delete-merged", false, "Delete branches merged into master")
+	gcCmd.Flags().IntVar(&gcAbandonedAfter, "abandoned-after", 0, "Delete branches without commits in this many days")
+	gcCmd.Flags().BoolVar(&gcDryRun, "dry-run", false, "List what would be deleted without deleting it")
+	gcCmd.Flags().BoolVarP(&gcYes, "yes", "y", false, "Delete without asking for confirmation")
+}
+
+// gcPolicy says which commits and branches gc deletes. Zero values turn a
+// policy off.
+type gcPolicy struct {
+	KeepLast       int
+	OlderThan      time.Duration
+	DeleteMerged   bool
+	AbandonedAfter time.Duration
+	Now            time.Time
+}
+
+type gcCommit struct {
+	Path     string
+	Branch   *gcBranch
+	Time     time.Time
+	Keys     []string
+	Files    int
+	Size     int64
+	manifest bool
+	lineage  bool
+	// keptBy says why a commit gc could have deleted is kept
+	keptBy string
+}
+
+type gcBranch struct {
+	Path    string
+	Commits []*gcCommit
+	Keys    []string
+	Tags    []string
+	head    bool
+	// pruned says why the whole branch is up for deletion
+	pruned string
+}
+
+// gcPlan is what gc is going to delete
+type gcPlan struct {
+	Commits  []*gcCommit
+	Kept     []*gcCommit
+	Branches []*gcBranch
+	Blobs    []*Object
+}
+
+// gcBlobGrace protects blobs just uploaded by a commit that has not written
+// its manifest yet.
+const gcBlobGrace = 24 * time.Hour
+
+// planGC works out what to delete from bucket under scope according to
+// policy. The whole bucket is read, as HEADs and lineage anywhere in it
+// protect commits. Lineage in other buckets is not looked at.
+func planGC(ctx context.Context, storage Storage, bucket string, scope string, policy gcPolicy) (*gcPlan, error) {
+	if policy.KeepLast == 0 && policy.OlderThan == 0 && !policy.DeleteMerged && policy.AbandonedAfter == 0 {
+		return nil, fmt.Errorf("no retention policy given")
+	}
+
+	branches, commits, blobs, err := scanBucket(ctx, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	heads := make(map[string]string)
+	for _, branch := range branches {
+		if !branch.head {
+			continue
+		}
+		heads[branch.Path], err = headTarget(ctx, storage, branch.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	candidates := make(map[*gcCommit]bool)
+	merged := make(map[string]*mergedCommits)
+	for _, branch := range branches {
+		if scope != "" && branch.Path != scope && !strings.HasPrefix(branch.Path, scope+"/") {
+			continue
+		}
+		branch.pruned, err = pruneReason(ctx, storage, branch, heads, merged, policy)
+		if err != nil {
+			return nil, err
+		}
+		for i, commit := range branch.Commits {
+			if branch.pruned != "" || commit.expired(len(branch.Commits)-i, policy) {
+				candidates[commit] = true
+			}
+		}
+	}
+
+	// Keep what the policies don't delete, along with what that depends on
+	kept := make(map[*gcCommit]bool)
+	var queue []*gcCommit
+	keep := func(commit *gcCommit, reason string) {
+		if commit == nil || kept[commit] {
+			return
+		}
+		kept[commit] = true
+		if candidates[commit] {
+			commit.keptBy = reason
+		}
+		queue = append(queue, commit)
+	}
+	rescued := make(map[*gcBranch]bool)
+	for _, branch := range branches {
+		if branch.pruned == "" {
+			keep(commits[heads[branch.Path]], "HEAD of "+branch.Path)
+		}
+		for _, name := range branch.Tags {
+			tag, err := readTag(ctx, storage, branch.Path, name)
+			if err != nil {
+				return nil, err
+			}
+			if tag != nil {
+				keep(commits[tag.Commit], "tag "+name+" of "+branch.Path)
+			}
+		}
+	}
+	for _, branch := range branches {
+		for _, commit := range branch.Commits {
+			if !candidates[commit] {
+				keep(commit, "")
+			}
+		}
+	}
+	for len(queue) > 0 {
+		commit := queue[0]
+		queue = queue[1:]
+
+		// A branch keeping any of its commits keeps its HEAD too
+		if branch := commit.Branch; branch.pruned != "" && !rescued[branch] {
+			rescued[branch] = true
+			keep(commits[heads[branch.Path]], "HEAD of "+branch.Path)
+		}
+		if !commit.lineage {
+			continue
+		}
+		inputs, err := readLineage(ctx, storage, bucket, commit.Path+"/")
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading lineage of %s", commit.Path)
+		}
+		for _, input := range inputs {
+			if input.Bucket == bucket {
+				keep(commits[input.Commit], "input of "+commit.Path)
+			}
+		}
+	}
+
+	plan := &gcPlan{}
+	for commit := range candidates {
+		if kept[commit] {
+			plan.Kept = append(plan.Kept, commit)
+		} else {
+			plan.Commits = append(plan.Commits, commit)
+		}
+	}
+	for _, branch := range branches {
+		if branch.pruned != "" && !rescued[branch] {
+			plan.Branches = append(plan.Branches, branch)
+		}
+	}
+	sort.Slice(plan.Commits, func(i, j int) bool { return plan.Commits[i].Path < plan.Commits[j].Path })
+	sort.Slice(plan.Kept, func(i, j int) bool { return plan.Kept[i].Path < plan.Kept[j].Path })
+	sort.Slice(plan.Branches, func(i, j int) bool { return plan.Branches[i].Path < plan.Branches[j].Path })
+
+	if len(blobs) > 0 {
+		plan.Blobs, err = unreferencedBlobs(ctx, storage, plan.Commits, kept, blobs, policy.Now)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Packed and deduplicated commits keep their files apart, so are counted
+	// from their manifest. Their size stays what deleting them frees: their
+	// chunks, or nothing but the blobs listed on their own.
+	for _, commit := range plan.Commits {
+		if !commit.manifest || commit.Files > 0 {
+			continue
+		}
+		manifest, err := readManifest(ctx, storage, commit.Path+"/")
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil && manifest.storedApart() {
+			commit.Files = len(manifest.Files)
+		}
+	}
+	return plan, nil
+}
+
+// expired reports whether a commit, the nth newest of its branch, is one
+// the keep-last and older-than policies delete.
+func (c *gcCommit) expired(nth int, policy gcPolicy) bool {
+	if policy.KeepLast == 0 && policy.OlderThan == 0 {
+		return false
+	}
+	if policy.KeepLast > 0 && nth <= policy.KeepLast {
+		return false
+	}
+	return policy.OlderThan == 0 || policy.Now.Sub(c.Time) > policy.OlderThan
+}
+
+// scanBucket lists every branch, commit and blob in the bucket. Branches
+// come sorted, their commits oldest first.
+func scanBucket(ctx context.Context, storage Storage) ([]*gcBranch, map[string]*gcCommit, map[string]*Object, error) {
+	branches := make(map[string]*gcBranch)
+	commits := make(map[string]*gcCommit)
+	blobs := make(map[string]*Object)
+
+	branch := func(path string) *gcBranch {
+		if _, ok := branches[path]; !ok {
+			branches[path] = &gcBranch{Path: path}
+		}
+		return branches[path]
+	}
+
+	err := storage.List(ctx, "", func(objects []*Object) error {
+		for _, obj := range objects {
+			if strings.HasPrefix(obj.Key, objectStorePrefix+"/") {
+				blobs[strings.TrimPrefix(obj.Key, objectStorePrefix+"/")] = obj
+				continue
+			}
+
+			parts := strings.Split(obj.Key, "/")
+			if len(parts) == 4 && strings.HasPrefix(parts[3], "HEAD") {
+				b := branch(strings.Join(parts[:3], "/"))
+				b.Keys = append(b.Keys, obj.Key)
+				b.head = b.head || parts[3] == "HEAD"
+				continue
+			}
+			if len(parts) == 5 && parts[3] == tagsFolder {
+				b := branch(strings.Join(parts[:3], "/"))
+				b.Tags = append(b.Tags, parts[4])
+				continue
+			}
+			if len(parts) < 9 || !commitPattern.MatchString(strings.Join(parts[3:], "/")) {
+				continue
+			}
+
+			path := strings.Join(parts[:8], "/")
+			commit, ok := commits[path]
+			if !ok {
+				created, _ := time.Parse("2006/01/02/15/04", strings.Join(parts[3:8], "/")[:16])
+				commit = &gcCommit{Path: path, Time: created, Branch: branch(strings.Join(parts[:3], "/"))}
+				commit.Branch.Commits = append(commit.Branch.Commits, commit)
+				commits[path] = commit
+			}
+			commit.Keys = append(commit.Keys, obj.Key)
+			commit.Size += obj.Size
+			name := strings.Join(parts[8:], "/")
+			switch {
+			case name == manifestFile:
+				commit.manifest = true
+			case name == lineageFile || name == inputsLogFile:
+				commit.lineage = true
+			}
+			if !isReservedFile(name) {
+				commit.Files++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	sorted := make([]*gcBranch, 0, len(branches))
+	for _, b := range branches {
+		sort.Slice(b.Commits, func(i, j int) bool { return b.Commits[i].Path < b.Commits[j].Path })
+		sorted = append(sorted, b)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+	return sorted, commits, blobs, nil
+}
+
+// mergedCommits are what a branch counts as merged into: the commits master's
+// HEAD has pointed to and the manifests of master's commits.
+type mergedCommits struct {
+	heads     map[string]bool
+	manifests map[string]bool
+}
+
+// pruneReason says why a whole branch is to be deleted, if it is
+func pruneReason(ctx context.Context, storage Storage, branch *gcBranch, heads map[string]string, merged map[string]*mergedCommits, policy gcPolicy) (string, error) {
+	parts := strings.Split(branch.Path, "/")
+	if parts[2] == gcDefaultBranch {
+		return "", nil
+	}
+
+	if policy.DeleteMerged && heads[branch.Path] != "" {
+		master := strings.Join(append(parts[:2:2], gcDefaultBranch), "/")
+		if merged[master] == nil {
+			m, err := readMergedCommits(ctx, storage, master)
+			if err != nil {
+				return "", err
+			}
+			merged[master] = m
+		}
+
+		head := heads[branch.Path]
+		if merged[master].heads[head] {
+			return "merged", nil
+		}
+		manifest, err := readManifest(ctx, storage, head+"/")
+		if err != nil {
+			return "", err
+		}
+		if manifest != nil && merged[master].manifests[manifest.hash()] {
+			return "merged", nil
+		}
+	}
+
+	if policy.AbandonedAfter > 0 {
+		var latest time.Time
+		if n := len(branch.Commits); n > 0 {
+			latest = branch.Commits[n-1].Time
+		}
+		if policy.Now.Sub(latest) > policy.AbandonedAfter {
+			return "abandoned", nil
+		}
+	}
+	return "", nil
+}
+
+func readMergedCommits(ctx context.Context, storage Storage, master string) (*mergedCommits, error) {
+	m := &mergedCommits{heads: make(map[string]bool), manifests: make(map[string]bool)}
+
+	entries, err := readHeadLog(ctx, storage, master)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		m.heads[entry.Target] = true
+	}
+	head, err := headTarget(ctx, storage, master)
+	if err != nil {
+		return nil, err
+	}
+	m.heads[head] = true
+
+	commits, err := listCommits(ctx, storage, master+"/")
+	if err != nil {
+		return nil, err
+	}
+	for _, commit := range commits {
+		manifest, err := readManifest(ctx, storage, master+"/"+commit.Name+"/")
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			m.manifests[manifest.hash()] = true
+		}
+	}
+	return m, nil
+}
+
+// unreferencedBlobs returns the blobs of deleted commits that no kept commit
+// refers to.
+func unreferencedBlobs(ctx context.Context, storage Storage, deleted []*gcCommit, kept map[*gcCommit]bool, blobs map[string]*Object, now time.Time) ([]*Object, error) {
+	hashes := func(commit *gcCommit) ([]string, error) {
+		// Only commits made with --dedup keep their files as blobs
+		if !commit.manifest || commit.Files > 0 {
+			return nil, nil
+		}
+		manifest, err := readManifest(ctx, storage, commit.Path+"/")
+		if err != nil || manifest == nil || manifest.ObjectStore == "" {
+			return nil, err
+		}
+		var result []string
+		for _, entry := range manifest.Files {
+			result = append(result, entry.SHA256)
+		}
+		return result, nil
+	}
+
+	unreferenced := make(map[string]bool)
+	for _, commit := range deleted {
+		list, err := hashes(commit)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range list {
+			unreferenced[hash] = true
+		}
+	}
+	if len(unreferenced) == 0 {
+		return nil, nil
+	}
+	for commit := range kept {
+		list, err := hashes(commit)
+		if err != nil {
+			return nil, err
+		}
+		for _, hash := range list {
+			delete(unreferenced, hash)
+		}
+	}
+
+	var result []*Object
+	for hash := range unreferenced {
+		if blob, ok := blobs[hash]; ok && now.Sub(blob.LastModified) > gcBlobGrace {
+			result = append(result, blob)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Key < result[j].Key })
+	return result, nil
+}
+
+func (p *gcPlan) empty() bool {
+	return len(p.Commits) == 0 && len(p.Branches) == 0 && len(p.Blobs) == 0
+}
+
+func (p *gcPlan) size() int64 {
+	var size int64
+	for _, commit := range p.Commits {
+		size += commit.Size
+	}
+	for _, blob := range p.Blobs {
+		size += blob.Size
+	}
+	return size
+}
+
+func (p *gcPlan) writeReport(w io.Writer) error {
+	if p.empty() {
+		fmt.Fprintln(w, "Nothing to delete")
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if len(p.Commits) > 0 {
+		fmt.Fprintln(tw, "DELETE COMMIT\tFILES\tSIZE\t")
+		for _, commit := range p.Commits {
+			fmt.Fprintf(tw, "%s\t%d\t%s\t\n", commit.Path, commit.Files, formatBytes(commit.Size))
+		}
+		fmt.Fprintln(tw)
+	}
+	if len(p.Branches) > 0 {
+		fmt.Fprintln(tw, "DELETE BRANCH\tREASON\t")
+		for _, branch := range p.Branches {
+			fmt.Fprintf(tw, "%s\t%s\t\n", branch.Path, branch.pruned)
+		}
+		fmt.Fprintln(tw)
+	}
+	if len(p.Kept) > 0 {
+		fmt.Fprintln(tw, "KEEP COMMIT\tREASON\t")
+		for _, commit := range p.Kept {
+			fmt.Fprintf(tw, "%s\t%s\t\n", commit.Path, commit.keptBy)
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	var blobSize int64
+	for _, blob := range p.Blobs {
+		blobSize += blob.Size
+	}
+	if len(p.Blobs) > 0 {
+		fmt.Fprintf(w, "%d deduplicated files (%s) are no longer used\n", len(p.Blobs), formatBytes(blobSize))
+	}
+	fmt.Fprintf(w, "Deleting %d commits, %d branches and %d deduplicated files: %s\n",
+		len(p.Commits), len(p.Branches), len(p.Blobs), formatBytes(p.size()))
+	return nil
+}
+
+// execute deletes what was planned. Manifests go first, so a commit deleted
+// halfway looks like one that was never completed.
+func (p *gcPlan) execute(ctx context.Context, storage Storage) error {
+	remove := func(keys []string) error {
+		transfers := newTransfers(ctx, defaultUploadConcurrency)
+		for _, key := range keys {
+			key := key
+			transfers.Go(func() error {
+				err := transferRetries.do(ctx, "deleting "+key, func() error {
+					return storage.Delete(ctx, key)
+				})
+				if isNotFound(err) {
+					return nil
+				}
+				return err
+			})
+		}
+		return transfers.Wait()
+	}
+
+	var manifests, keys []string
+	for _, commit := range p.Commits {
+		for _, key := range commit.Keys {
+			if strings.HasSuffix(key, "/"+manifestFile) && strings.Count(key, "/") == 8 {
+				manifests = append(manifests, key)
+			} else {
+				keys = append(keys, key)
+			}
+		}
+	}
+	for _, blob := range p.Blobs {
+		keys = append(keys, blob.Key)
+	}
+	var branchKeys []string
+	for _, branch := range p.Branches {
+		branchKeys = append(branchKeys, branch.Keys...)
+	}
+
+	for _, batch := range [][]string{manifests, keys, branchKeys} {
+		if err := remove(batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// confirm asks a yes or no question, taking anything but yes as a no
+func confirm(r io.Reader, w io.Writer, question string) bool {
+	fmt.Fprintf(w, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(r).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
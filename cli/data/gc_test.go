@@ -0,0 +1,174 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	gcModelA    = "model/v1/master/2019/01/01/00/00_AaAaAaAaA0"
+	gcModelB    = "model/v1/master/2019/02/01/00/00_BbBbBbBbB0"
+	gcModelC    = "model/v1/master/2019/03/01/00/00_CcCcCcCcC0"
+	gcFeatures1 = "features/v1/master/2019/01/01/00/00_FfFfFfFfF0"
+	gcFeatures2 = "features/v1/master/2019/02/01/00/00_FfFfFfFfF0"
+	gcFeatures3 = "features/v1/master/2019/03/01/00/00_FfFfFfFfF0"
+	gcMerged    = "model/v1/experiment/2019/01/15/00/00_EeEeEeEeE0"
+	gcStale     = "model/v1/stale/2019/01/10/00/00_SsSsSsSsS0"
+	gcDedupOld  = "model/v2/master/2019/01/01/00/00_DdDdDdDdD0"
+	gcDedupNew  = "model/v2/master/2019/02/01/00/00_DdDdDdDdD1"
+)
+
+const gcManifest = `{"files":[{"path":"a","size":1,"sha256":"aa"}]}`
+
+var gcObjects = map[string]string{
+	"model/v1/master/HEAD":          gcModelB,
+	gcModelA + "/a":                 "a",
+	gcModelA + "/" + lineageFile:    `{"inputs":[{"bucket":"bucket","commit":"` + gcFeatures1 + `"}]}`,
+	gcModelB + "/a":                 "b",
+	gcModelB + "/" + lineageFile:    `{"inputs":[{"bucket":"bucket","commit":"` + gcFeatures2 + `"}]}`,
+	gcModelC + "/a":                 "c",
+	gcModelC + "/" + manifestFile:   gcManifest,
+	"features/v1/master/HEAD":       gcFeatures3,
+	gcFeatures1 + "/f":              "f1",
+	gcFeatures2 + "/f":              "f2",
+	gcFeatures3 + "/f":              "f3",
+	"model/v1/experiment/HEAD":      gcMerged,
+	"model/v1/experiment/HEAD.log":  "",
+	gcMerged + "/a":                 "c",
+	gcMerged + "/" + manifestFile:   gcManifest,
+	"model/v1/stale/HEAD":           gcStale,
+	gcStale + "/a":                  "s",
+	"model/v2/master/HEAD":          gcDedupNew,
+	gcDedupOld + "/" + manifestFile: `{"object_store":".objects/sha256","files":[{"path":"a","sha256":"h1"},{"path":"b","sha256":"h2"}]}`,
+	gcDedupNew + "/" + manifestFile: `{"object_store":".objects/sha256","files":[{"path":"b","sha256":"h2"}]}`,
+	objectStorePrefix + "/h1":       "one",
+	objectStorePrefix + "/h2":       "two",
+}
+
+var gcNow = time.Date(2019, 6, 1, 0, 0, 0, 0, time.UTC)
+
+func commitPaths(commits []*gcCommit) string {
+	var paths []string
+	for _, commit := range commits {
+		paths = append(paths, commit.Path)
+	}
+	return strings.Join(paths, ",")
+}
+
+func TestPlanGCKeepLast(t *testing.T) {
+	plan, err := planGC(context.Background(), memStorage(gcObjects), "bucket", "", gcPolicy{KeepLast: 1, Now: gcNow})
+	if err != nil {
+		t.Fatalf("It should plan, but %v", err)
+	}
+
+	expected := strings.Join([]string{"features/v1/master/2019/01/01/00/00_FfFfFfFfF0", gcModelA, gcDedupOld}, ",")
+	if commitPaths(plan.Commits) != expected {
+		t.Errorf("Unexpected commits to delete: %s", commitPaths(plan.Commits))
+	}
+	if commitPaths(plan.Kept) != "features/v1/master/2019/02/01/00/00_FfFfFfFfF0,"+gcModelB {
+		t.Errorf("It should keep HEAD and the inputs of kept commits, got: %s", commitPaths(plan.Kept))
+	}
+	if plan.Kept[0].keptBy != "input of "+gcModelB || plan.Kept[1].keptBy != "HEAD of model/v1/master" {
+		t.Errorf("Unexpected reasons: %s, %s", plan.Kept[0].keptBy, plan.Kept[1].keptBy)
+	}
+	if plan.Commits[2].Files != 2 {
+		t.Errorf("It should count the files of a deduplicated commit from its manifest, got: %d", plan.Commits[2].Files)
+	}
+	if len(plan.Blobs) != 1 || plan.Blobs[0].Key != objectStorePrefix+"/h1" {
+		t.Errorf("It should only delete blobs no kept commit uses, got: %+v", plan.Blobs)
+	}
+	if len(plan.Branches) != 0 {
+		t.Errorf("It should not delete branches, got: %+v", plan.Branches)
+	}
+}
+
+func TestPlanGCOlderThan(t *testing.T) {
+	policy := gcPolicy{KeepLast: 1, OlderThan: 130 * 24 * time.Hour, Now: gcNow}
+	plan, err := planGC(context.Background(), memStorage(gcObjects), "bucket", "model/v1", policy)
+	if err != nil {
+		t.Fatalf("It should plan, but %v", err)
+	}
+	if commitPaths(plan.Commits) != gcModelA {
+		t.Errorf("Unexpected commits to delete: %s", commitPaths(plan.Commits))
+	}
+}
+
+func TestPlanGCBranches(t *testing.T) {
+	policy := gcPolicy{DeleteMerged: true, AbandonedAfter: 90 * 24 * time.Hour, Now: gcNow}
+	plan, err := planGC(context.Background(), memStorage(gcObjects), "bucket", "", policy)
+	if err != nil {
+		t.Fatalf("It should plan, but %v", err)
+	}
+
+	if len(plan.Branches) != 2 || plan.Branches[0].pruned != "merged" || plan.Branches[1].pruned != "abandoned" {
+		t.Fatalf("Unexpected branches to delete: %+v", plan.Branches)
+	}
+	if commitPaths(plan.Commits) != gcMerged+","+gcStale {
+		t.Errorf("It should delete the commits of deleted branches, got: %s", commitPaths(plan.Commits))
+	}
+
+	var out bytes.Buffer
+	plan.writeReport(&out)
+	if !strings.Contains(out.String(), "Deleting 2 commits, 2 branches and 0 deduplicated files: 49 B") {
+		t.Errorf("Unexpected report:\n%s", out.String())
+	}
+}
+
+func TestPlanGCKeepsTaggedCommits(t *testing.T) {
+	storage := memStorage(gcObjects)
+	createTag(context.Background(), storage, "model/v1/master", "release", gcModelA)
+
+	plan, err := planGC(context.Background(), storage, "bucket", "model/v1/master", gcPolicy{KeepLast: 1, Now: gcNow})
+	if err != nil {
+		t.Fatalf("It should plan, but %v", err)
+	}
+	if len(plan.Commits) != 0 || commitPaths(plan.Kept) != gcModelA+","+gcModelB {
+		t.Errorf("It should keep tagged commits, deleting: %s", commitPaths(plan.Commits))
+	}
+	if plan.Kept[0].keptBy != "tag release of model/v1/master" {
+		t.Errorf("Unexpected reason: %s", plan.Kept[0].keptBy)
+	}
+}
+
+func TestPlanGCWithoutPolicy(t *testing.T) {
+	_, err := planGC(context.Background(), memStorage(gcObjects), "bucket", "", gcPolicy{Now: gcNow})
+	if err == nil {
+		t.Error("It should return an error")
+	}
+}
+
+func TestExecuteGC(t *testing.T) {
+	storage := memStorage(gcObjects)
+	policy := gcPolicy{KeepLast: 1, DeleteMerged: true, Now: gcNow}
+	plan, err := planGC(context.Background(), storage, "bucket", "model", policy)
+	if err != nil {
+		t.Fatalf("It should plan, but %v", err)
+	}
+	if err := plan.execute(context.Background(), storage); err != nil {
+		t.Fatalf("It should delete, but %v", err)
+	}
+
+	for _, key := range []string{gcModelA + "/a", gcMerged + "/" + manifestFile, "model/v1/experiment/HEAD", "model/v1/experiment/HEAD.log", objectStorePrefix + "/h1"} {
+		if found, _ := objectExists(context.Background(), storage, key); found {
+			t.Errorf("It should delete %s", key)
+		}
+	}
+	for _, key := range []string{gcModelB + "/a", gcModelC + "/a", "model/v1/master/HEAD", objectStorePrefix + "/h2"} {
+		if found, _ := objectExists(context.Background(), storage, key); !found {
+			t.Errorf("It should keep %s", key)
+		}
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	var out bytes.Buffer
+	if !confirm(strings.NewReader("y\n"), &out, "Delete?") || out.String() != "Delete? [y/N] " {
+		t.Errorf("It should accept y, asked: %q", out.String())
+	}
+	if confirm(strings.NewReader("\n"), &out, "Delete?") {
+		t.Error("It should default to no")
+	}
+}
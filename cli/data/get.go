@@ -14,38 +14,37 @@
 package data
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
-	getBranch     string
-	getCommitPath string
-	getBucket     string
-	getKeys       []string
-	getSubdir     string
+	getBranch       string
+	getCommitPath   string
+	getBucket       string
+	getKeys         []string
+	getInclude      []string
+	getExclude      []string
+	getSubdir       string
+	getRecordInputs string
+	getAsOf         string
 )
 
-var s3RetriesSleep = 10 * time.Second
+const s3ParallelGets = 100
 
-const (
-	s3ParallelGets = 100
-	s3Retries      = 10
-)
+// partialSuffix is added to files while they are being downloaded
+const partialSuffix = ".partial"
 
 var getCmd = &cobra.Command{
 	Use:   "get [step/version] [destination path]",
@@ -57,6 +56,38 @@ Example:
 
 $ paddle data get -b experimental --bucket roo-pipeline --subdir version1 trained-model/version1 dest/path
 $ paddle data get -b experimental --bucket roo-pipeline --keys file1.csv,file2.csv trained-model/version1 dest/path
+$ paddle data get --include 'features/**/*.parquet' --exclude debug trained-model/version1 dest/path
+$ paddle data get -p tag:release-2019-q1 trained-model/version1 dest/path
+$ paddle data get --as-of 2019-03-03T18:00:00Z trained-model/version1 dest/path
+
+--include and --exclude take glob patterns matched against paths in the
+commit, where ** matches any number of folders and a pattern matching a
+folder matches everything in it.
+
+Files of encrypted commits are decrypted with the data key recorded with the
+commit, unwrapped by KMS or by the keyfile given with --encryption-key or the
+'encryption-key' setting.
+
+Files already in the destination are only downloaded again if they differ
+from the commit, going by its MANIFEST.json or else by size and ETag, so an
+interrupted get can be run again to pick up where it left off. Files are
+downloaded to a .partial name and renamed into place once complete and
+verified; a .partial file left by an interrupted get is resumed from where it
+stopped rather than downloaded again.
+
+--as-of fetches the commit HEAD of the branch pointed to at the given time
+instead of HEAD, going by HEAD.log. Before the branch's HEAD.log begins, it
+fetches the newest completed commit made at or before then, to the minute, as
+commits are named after the UTC minute they were made in. A date alone means
+the start of that day in UTC.
+
+The commit fetched is recorded in an inputs log, which 'paddle data commit'
+stores as the lineage of the commit made from it. The log is inputs.log in
+$OUTPUT_PATH unless --record-inputs or the 'record-inputs' setting says
+otherwise; set either to 'off' to not record anything. Without $OUTPUT_PATH
+nothing is recorded unless a log is given.
+
+$ paddle data get --record-inputs /tmp/inputs.log trained-model/version1 dest/path
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		if getBucket == "" {
@@ -71,67 +102,128 @@ $ paddle data get -b experimental --bucket roo-pipeline --keys file1.csv,file2.c
 			path:   fmt.Sprintf("%s/%s/%s", args[0], getBranch, getCommitPath),
 		}
 
-		copyPathToDestination(source, args[1], getKeys, getSubdir)
+		var asOf time.Time
+		if getAsOf != "" {
+			var err error
+			asOf, err = parseAsOf(getAsOf)
+			if err != nil {
+				exitErrorf("%v", err)
+			}
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		err := Get(ctx, source, args[1], GetOptions{
+			Keys:      getKeys,
+			Include:   getInclude,
+			Exclude:   getExclude,
+			Subdir:    getSubdir,
+			InputsLog: inputsLogPath(getRecordInputs),
+			AsOf:      asOf,
+		})
+		if err != nil {
+			exitErrorf("%v", err)
+		}
 	},
 }
 
 func init() {
 	getCmd.Flags().StringVarP(&getBranch, "branch", "b", "master", "Branch to work on")
 	getCmd.Flags().StringVar(&getBucket, "bucket", "", "Bucket to use")
-	getCmd.Flags().StringVarP(&getCommitPath, "path", "p", "HEAD", "Path to fetch (instead of HEAD)")
+	getCmd.Flags().StringVarP(&getCommitPath, "path", "p", "HEAD", "Commit or tag:<name> to fetch (instead of HEAD)")
 	getCmd.Flags().StringSliceVarP(&getKeys, "keys", "k", []string{}, "A list of keys to download separated by comma")
+	getCmd.Flags().StringSliceVar(&getInclude, "include", []string{}, "Only download files matching these glob patterns")
+	getCmd.Flags().StringSliceVar(&getExclude, "exclude", []string{}, "Don't download files matching these glob patterns")
 	getCmd.Flags().StringVarP(&getSubdir, "subdir", "d", "", "Custom subfolder name for export path")
+	getCmd.Flags().StringVar(&getAsOf, "as-of", "", "Fetch the commit HEAD pointed to at this time instead of HEAD")
+	getCmd.Flags().StringVar(&getRecordInputs, "record-inputs", "", "Inputs log to record the commit in, or 'off' (default $OUTPUT_PATH/inputs.log)")
 }
 
-func copyPathToDestination(source S3Path, destination string, keys []string, subdir string) {
-	session := session.Must(session.NewSessionWithOptions(session.Options{
-		SharedConfigState: session.SharedConfigEnable,
-	}))
+// GetOptions tweaks what Get downloads and where to
+type GetOptions struct {
+	// Keys limits the download to these files of the commit
+	Keys []string
+	// Include and Exclude are glob patterns selecting the files to download
+	Include []string
+	Exclude []string
+	// Subdir is a folder to create in the destination and download into
+	Subdir string
+	// InputsLog is where to record the commit as an input, if anywhere
+	InputsLog string
+	// AsOf picks the commit the branch's HEAD pointed to then instead of
+	// its current HEAD
+	AsOf time.Time
+}
 
-	/*
-	 * HEAD contains the path to latest folder
-	 */
-	if source.Basename() == "HEAD" {
-		latestFolder := readHEAD(session, source)
-		source.path = latestFolder
-	}
-	if !strings.HasSuffix(source.path, "/") {
-		source.path += "/"
-	}
-	if subdir != "" {
-		destination = parseDestination(destination, subdir)
+// Get downloads the commit source refers to, a commit or the HEAD or a tag
+// of a branch, into destination and verifies it against the commit's manifest.
+func Get(ctx context.Context, source S3Path, destination string, opts GetOptions) error {
+	sel, err := newSelection(opts.Keys, opts.Include, opts.Exclude)
+	if err != nil {
+		return err
 	}
 
-	fmt.Println("Copying " + source.path + " to " + destination)
-	copy(session, source, destination, keys)
-	f, err := os.OpenFile("/data/output/inputs.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	storage, err := openStorage(source.bucket)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-	f.WriteString(source.path + "\n")
-}
 
-func readHEAD(session *session.Session, source S3Path) string {
-	tempFile, err := ioutil.TempFile("", "HEAD")
+	var commit string
+	if opts.AsOf.IsZero() {
+		commit, err = resolveCommit(ctx, storage, source)
+	} else if source.Basename() == "HEAD" {
+		commit, err = commitAsOf(ctx, storage, source.Dirname(), opts.AsOf)
+	} else {
+		err = fmt.Errorf("can't fetch %s as of a time, only HEAD", source.Basename())
+	}
 	if err != nil {
-		exitErrorf("Unable to create temp file: %v", err)
+		return err
+	}
+	source.path = commit + "/"
+	if opts.Subdir != "" {
+		destination = parseDestination(destination, opts.Subdir)
 	}
 
-	defer os.Remove(tempFile.Name())
-
-	svc := s3.New(session)
-
-	err = copyS3ObjectToFile(svc, source, source.path, tempFile)
+	manifest, err := readManifest(ctx, storage, source.path)
 	if err != nil {
-		exitErrorf("Error copying HEAD: %v", err)
+		return errors.Wrap(err, "reading manifest")
+	}
+	dataStorage, err := commitStorage(ctx, storage, source.path)
+	if err != nil {
+		return err
 	}
 
-	contents, err := ioutil.ReadFile(tempFile.Name())
+	fmt.Fprintln(os.Stderr, "Copying "+source.path+" to "+destination)
+	stats := newTransferStats("get")
+	stats.start()
+	defer stats.halt()
+	if manifest != nil && manifest.packed() {
+		err = copyPacksToLocalFiles(ctx, dataStorage, manifest, source, destination, sel, stats)
+	} else if manifest != nil && manifest.ObjectStore != "" {
+		err = copyBlobsToLocalFiles(ctx, dataStorage, manifest, destination, sel, stats)
+	} else {
+		err = copy(ctx, dataStorage, manifest, source, destination, sel, stats)
+	}
 	if err != nil {
-		exitErrorf("Error reading HEAD file: %v", err)
+		return err
+	}
+	stats.finish()
+
+	if manifest == nil {
+		fmt.Fprintf(os.Stderr, "No %s in %s, skipping verification\n", manifestFile, source.path)
+	} else {
+		err = manifest.verify(destination, sel)
+		if err != nil {
+			return errors.Wrapf(err, "verifying %s", source.path)
+		}
+		fmt.Fprintf(os.Stderr, "Verified %s against %s\n", destination, manifestFile)
 	}
 
-	return string(contents)
+	if opts.InputsLog == "" {
+		return nil
+	}
+	return recordInput(opts.InputsLog, newLineageInput(source.bucket, source.path, manifest))
 }
 
 func parseDestination(destination string, subdir string) string {
@@ -143,66 +235,65 @@ func parseDestination(destination string, subdir string) string {
 	return destination
 }
 
-func copy(session *session.Session, source S3Path, destination string, keys []string) {
-	query := &s3.ListObjectsV2Input{
-		Bucket: aws.String(source.bucket),
-		Prefix: aws.String(source.path),
-	}
-	svc := s3.New(session)
-
-	for {
-		response, err := svc.ListObjectsV2(query)
-		if err != nil {
-			fmt.Println(err.Error())
-			return
-		}
-
-		copyToLocalFiles(svc, response.Contents, source, destination, keys)
-
-		// Check if more results
-		query.ContinuationToken = response.NextContinuationToken
-
-		if !(*response.IsTruncated) {
-			break
+func copy(ctx context.Context, storage Storage, manifest *Manifest, source S3Path, destination string, sel selection, stats *transferStats) error {
+	entries := make(map[string]ManifestEntry)
+	if manifest != nil {
+		for _, entry := range manifest.Files {
+			entries[source.path+entry.Path] = entry
 		}
 	}
-}
 
-func copyToLocalFiles(s3Client *s3.S3, objects []*s3.Object, source S3Path, destination string, keys []string) {
-	var (
-		wg  = new(sync.WaitGroup)
-		sem = make(chan struct{}, s3ParallelGets)
-	)
+	return storage.List(ctx, source.path, func(objects []*Object) error {
+		return copyToLocalFiles(ctx, storage, objects, entries, source, destination, sel, stats)
+	})
+}
 
-	downloadList, err := filterObjects(source, objects, keys)
+func copyToLocalFiles(ctx context.Context, storage Storage, objects []*Object, entries map[string]ManifestEntry, source S3Path, destination string, sel selection, stats *transferStats) error {
+	downloadList, err := filterObjects(source, objects, sel)
 	if err != nil {
-		exitErrorf("Error downloading keys: %v", err)
+		return errors.Wrap(err, "downloading keys")
 	}
-
-	wg.Add(len(downloadList))
-
-	for _, key := range downloadList {
-		go process(s3Client, source, destination, *key.Key, sem, wg)
+	for _, obj := range downloadList {
+		stats.expect(1, obj.Size)
 	}
 
-	wg.Wait()
+	downloads := newTransfers(ctx, s3ParallelGets)
+	for _, obj := range downloadList {
+		obj := obj
+		entry, found := entries[obj.Key]
+		downloads.Go(func() error {
+			if found {
+				return process(ctx, storage, source, destination, obj, &entry, stats)
+			}
+			return process(ctx, storage, source, destination, obj, nil, stats)
+		})
+	}
+	return downloads.Wait()
 }
 
-func filterObjects(source S3Path, objects []*s3.Object, keys []string) ([]*s3.Object, error) {
+func filterObjects(source S3Path, objects []*Object, sel selection) ([]*Object, error) {
 	var (
-		downloadList []*s3.Object
-		objsByKey    = make(map[string]*s3.Object)
+		downloadList []*Object
+		objsByKey    = make(map[string]*Object)
 		keysNotFound []string
 	)
-	if len(keys) == 0 {
-		return objects, nil
+	if len(sel.keys) == 0 {
+		for _, obj := range objects {
+			name := strings.TrimPrefix(obj.Key, source.path)
+			if !isReservedFile(name) && sel.matches(name) {
+				downloadList = append(downloadList, obj)
+			}
+		}
+		return downloadList, nil
 	}
 	for _, obj := range objects {
-		objsByKey[*obj.Key] = obj
+		objsByKey[obj.Key] = obj
 	}
-	for _, key := range keys {
+	for _, key := range sel.keys {
 		if obj, contains := objsByKey[source.path+key]; contains {
-			downloadList = append(downloadList, obj)
+			if sel.matches(key) {
+				downloadList = append(downloadList, obj)
+			}
 			continue
 		}
 		keysNotFound = append(keysNotFound, key)
@@ -213,65 +304,292 @@ func filterObjects(source S3Path, objects []*s3.Object, keys []string) ([]*s3.Ob
 	return downloadList, nil
 }
 
-func process(s3Client *s3.S3, src S3Path, basePath string, filePath string, sem chan struct{}, wg *sync.WaitGroup) {
-	defer wg.Done()
+// process downloads an object, unless the local file already matches it
+// according to its manifest entry (if any) or its size and ETag.
+func process(ctx context.Context, storage Storage, src S3Path, basePath string, obj *Object, entry *ManifestEntry, stats *transferStats) error {
+	if strings.HasSuffix(obj.Key, "/") {
+		fmt.Fprintln(os.Stderr, "Got a directory")
+		return nil
+	}
+
+	destination := basePath + "/" + strings.TrimPrefix(obj.Key, src.Dirname()+"/")
+	var upToDate bool
+	if entry != nil {
+		upToDate = localFileMatches(destination, *entry)
+	} else {
+		upToDate = localFileMatchesObject(destination, obj)
+	}
+	if upToDate {
+		stats.unchanged(obj.Size)
+		return nil
+	}
+	check := fileCheck{Size: obj.Size, ETag: obj.ETag}
+	if entry != nil {
+		check = fileCheck{Size: entry.Size, SHA256: entry.SHA256}
+	}
+	progress := stats.track()
+	if err := downloadFile(ctx, storage, obj.Key, destination, check, progress); err != nil {
+		return err
+	}
+	progress.done(1, obj.Size)
+	return nil
+}
+
+// copyBlobsToLocalFiles rebuilds a content-addressed commit from its
+// manifest. Files that are already in place are left alone, and each blob is
+// downloaded at most once even when several paths share it, the other paths
+// being copied from the first.
+func copyBlobsToLocalFiles(ctx context.Context, storage Storage, manifest *Manifest, destination string, sel selection, stats *transferStats) error {
+	var (
+		hashes  []string
+		targets = make(map[string][]string)
+		local   = make(map[string]string)
+		sizes   = make(map[string]int64)
+	)
+
+	entries, err := manifest.filter(sel)
+	if err != nil {
+		return errors.Wrap(err, "downloading keys")
+	}
 
-	// block if N goroutines are already active (buffer full).
-	sem <- struct{}{}
+	for _, entry := range entries {
+		target := destination + "/" + entry.Path
+		if _, seen := targets[entry.SHA256]; !seen {
+			hashes = append(hashes, entry.SHA256)
+			targets[entry.SHA256] = []string{}
+		}
+		if localFileMatches(target, entry) {
+			stats.expect(1, entry.Size)
+			stats.unchanged(entry.Size)
+			local[entry.SHA256] = target
+			continue
+		}
+		targets[entry.SHA256] = append(targets[entry.SHA256], target)
+		sizes[entry.SHA256] = entry.Size
+	}
+	for _, hash := range hashes {
+		if len(targets[hash]) > 0 && local[hash] == "" {
+			stats.expect(1, sizes[hash])
+		}
+	}
 
-	defer func() {
-		// frees up buffer slot
-		<-sem
-	}()
+	downloads := newTransfers(ctx, s3ParallelGets)
+	for _, hash := range hashes {
+		if len(targets[hash]) == 0 {
+			continue
+		}
+		hash, key, size, source, paths := hash, manifest.blobKey(hash), sizes[hash], local[hash], targets[hash]
+		downloads.Go(func() error {
+			return processBlob(ctx, storage, key, fileCheck{Size: size, SHA256: hash}, source, paths, stats)
+		})
+	}
+	return downloads.Wait()
+}
 
-	if strings.HasSuffix(filePath, "/") {
-		fmt.Println("Got a directory")
-		return
+// processBlob fills the target paths with the contents of a blob, copying
+// from a local file that already has them when possible.
+func processBlob(ctx context.Context, storage Storage, key string, check fileCheck, local string, targets []string, stats *transferStats) error {
+	if local == "" {
+		progress := stats.track()
+		err := downloadFile(ctx, storage, key, targets[0], check, progress)
+		if err != nil {
+			return err
+		}
+		progress.done(1, check.Size)
+		local, targets = targets[0], targets[1:]
 	}
 
-	destination := basePath + "/" + strings.TrimPrefix(filePath, src.Dirname()+"/")
-	file, err := createFile(destination)
+	for _, target := range targets {
+		if err := copyLocalFile(local, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileCheck is what is known of an object's contents before downloading it:
+// its size, if not -1, and its SHA-256 from the manifest or else its ETag.
+type fileCheck struct {
+	Size   int64
+	SHA256 string
+	ETag   string
+}
+
+// resumable reports whether a download can carry on from a partial file,
+// which takes knowing how large the object is and how to verify the result.
+func (c fileCheck) resumable() bool {
+	return c.Size >= 0 && (c.SHA256 != "" || (c.ETag != "" && !strings.Contains(c.ETag, "-")))
+}
+
+func (c fileCheck) matches(path string) bool {
+	if c.SHA256 != "" {
+		return localFileMatches(path, ManifestEntry{Size: c.Size, SHA256: c.SHA256})
+	}
+	return localFileMatchesObject(path, &Object{Size: c.Size, ETag: c.ETag})
+}
+
+// downloadFile fetches an object into a local file. The object is written
+// to a .partial file first and only renamed into place once complete, so an
+// interrupted get never leaves behind a file that looks up to date. What was
+// downloaded before a get failed is kept, and the next get only fetches the
+// rest, verifying the whole file before renaming it. Its bytes are counted
+// by progress, if not nil, as they arrive.
+func downloadFile(ctx context.Context, storage Storage, key string, destination string, check fileCheck, progress *fileProgress) error {
+	partial := destination + partialSuffix
+	resumed, err := downloadPartial(ctx, storage, key, partial, check, progress)
+	if err == nil && resumed && !check.matches(partial) {
+		fmt.Fprintf(os.Stderr, "%s does not match %s once resumed, downloading it again\n", partial, key)
+		os.Remove(partial)
+		_, err = downloadPartial(ctx, storage, key, partial, check, progress)
+	}
+	if err == nil {
+		err = os.Rename(partial, destination)
+	}
+	if err != nil {
+		if info, statErr := os.Stat(partial); !check.resumable() || statErr != nil || info.Size() == 0 {
+			os.Remove(partial)
+		}
+		return err
+	}
+	return nil
+}
+
+// downloadPartial fetches an object into a partial file, reporting whether
+// it carried on from what an earlier get left in it.
+func downloadPartial(ctx context.Context, storage Storage, key string, partial string, check fileCheck, progress *fileProgress) (bool, error) {
+	var (
+		file    *os.File
+		err     error
+		resumed bool
+	)
+	if check.resumable() {
+		file, err = openPartialFile(partial)
+		if err == nil {
+			if info, statErr := file.Stat(); statErr == nil && info.Size() > 0 && info.Size() <= check.Size {
+				resumed = true
+			}
+		}
+	} else {
+		file, err = createFile(partial)
+	}
 	if err != nil {
-		exitErrorf("%v", err)
+		return false, err
 	}
 
+	size := int64(-1)
+	if check.resumable() {
+		size = check.Size
+	}
+	err = resumeObjectToFile(ctx, storage, key, file, size, progress)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return resumed, err
+}
+
+// localFileMatchesObject compares a local file with an object by size and,
+// since S3 ETags are MD5 sums for objects not uploaded in parts, by ETag.
+// Objects without a plain MD5 ETag can't be compared and never match.
+func localFileMatchesObject(path string, obj *Object) bool {
+	if obj.ETag == "" || strings.Contains(obj.ETag, "-") {
+		return false
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Size() != obj.Size {
+		return false
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
 	defer file.Close()
 
-	err = copyS3ObjectToFile(s3Client, src, filePath, file)
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return false
+	}
+	return hex.EncodeToString(hash.Sum(nil)) == obj.ETag
+}
+
+func localFileMatches(path string, entry ManifestEntry) bool {
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() || info.Size() != entry.Size {
+		return false
+	}
+
+	file, err := os.Open(path)
 	if err != nil {
-		exitErrorf("%v", err)
+		return false
 	}
+	defer file.Close()
+
+	_, sum, err := hashReader(file)
+	return err == nil && sum == entry.SHA256
 }
 
-type S3Getter interface {
-	GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error)
+func copyLocalFile(source string, destination string) error {
+	in, err := os.Open(source)
+	if err != nil {
+		return errors.Wrapf(err, "opening %s", source)
+	}
+	defer in.Close()
+
+	partial := destination + partialSuffix
+	out, err := createFile(partial)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, in)
+	closeErr := out.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partial, destination)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return errors.Wrapf(err, "copying %s to %s", source, destination)
+	}
+	return nil
 }
 
-func copyS3ObjectToFile(s3Client S3Getter, src S3Path, filePath string, file *os.File) error {
-	var err error
+func copyObjectToFile(ctx context.Context, storage Storage, key string, file *os.File) error {
+	return resumeObjectToFile(ctx, storage, key, file, -1, nil)
+}
 
-	retries := s3Retries
-	for retries > 0 {
-		err = tryGetObject(s3Client, aws.String(src.bucket), &filePath, file)
-		if err == nil {
-			// we're done
+// resumeObjectToFile fetches an object of the given size into file, carrying
+// on from what the file already holds, including after a failed attempt.
+// Objects of unknown size, -1, are fetched from the start every time, and
+// progress only counts what the file holds.
+func resumeObjectToFile(ctx context.Context, storage Storage, key string, file *os.File, size int64, progress *fileProgress) error {
+	return transferRetries.do(ctx, "fetching "+key, func() error {
+		offset, err := file.Seek(0, io.SeekEnd)
+		if err == nil && (size < 0 || offset > size) {
+			offset, err = 0, resetFileForWriting(file)
+		}
+		if err != nil {
+			return &permanentError{errors.Wrapf(err, "unable to reset temp file %s", file.Name())}
+		}
+		progress.rewind(offset)
+		if offset == 0 {
+			return tryGetObject(ctx, storage, key, file, progress)
+		}
+		if offset == size {
 			return nil
 		}
 
-		resetErr := resetFileForWriting(file)
-		if resetErr != nil {
-			fmt.Printf("Unable to download object from S3 (%s) and unable reset temp file to try again (%s)",
-				err,
-				resetErr)
-			return errors.Wrapf(resetErr, "unable to reset temp file %s", file.Name())
-		}
-		retries--
-		if retries > 0 {
-			fmt.Printf("Error fetching from S3: %s, (%s); will retry in %v...	\n", filePath, err.Error(), s3RetriesSleep)
-			time.Sleep(s3RetriesSleep)
+		body, err := getRange(ctx, storage, key, offset, size-offset)
+		if err != nil {
+			return err
 		}
-	}
-	return err
+		defer body.Close()
+		return storeObjectToFile(progress.reader(body), file)
+	})
 }
 
 func resetFileForWriting(file *os.File) error {
@@ -280,31 +598,38 @@ func resetFileForWriting(file *os.File) error {
 	return err
 }
 
-func tryGetObject(s3Client S3Getter, bucket *string, key *string, file *os.File) error {
-	out, err := s3Client.GetObject(&s3.GetObjectInput{
-		Bucket: bucket,
-		Key:    key,
-	})
-
+func tryGetObject(ctx context.Context, storage Storage, key string, file *os.File, progress *fileProgress) error {
+	body, err := storage.Get(ctx, key)
 	if err != nil {
 		return err
 	}
 
-	defer out.Body.Close()
+	defer body.Close()
 
-	return storeS3ObjectToFile(out, file)
+	return storeObjectToFile(progress.reader(body), file)
 }
 
-func storeS3ObjectToFile(obj *s3.GetObjectOutput, file *os.File) error {
-	bytes, err := io.Copy(file, obj.Body)
-	if err != nil {
+func storeObjectToFile(body io.Reader, file *os.File) error {
+	if _, err := io.Copy(file, body); err != nil {
 		return errors.Wrapf(err, "copying file %s", file.Name())
 	}
-
-	fmt.Printf("%s -> %d bytes\n", file.Name(), bytes)
 	return nil
 }
 
+// openPartialFile opens a partial file to add to, creating it if need be
+func openPartialFile(partial string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(partial), 0777)
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating directory %s", filepath.Dir(partial))
+	}
+
+	file, err := os.OpenFile(partial, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", partial)
+	}
+	return file, nil
+}
+
 func createFile(destination string) (*os.File, error) {
 	err := os.MkdirAll(filepath.Dir(destination), 0777)
 	if err != nil {
@@ -1,13 +1,14 @@
 package data
 
 import (
+	"context"
 	"errors"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
-	"time"
 )
 
 func TestFilterObjects(t *testing.T) {
@@ -15,14 +16,14 @@ func TestFilterObjects(t *testing.T) {
 		key1   = "path/file1.csv"
 		key2   = "path/file2.csv"
 		key3   = "path/folder/file3.csv"
-		obj1   = &s3.Object{Key: &key1}
-		obj2   = &s3.Object{Key: &key2}
-		obj3   = &s3.Object{Key: &key3}
+		obj1   = &Object{Key: key1}
+		obj2   = &Object{Key: key2}
+		obj3   = &Object{Key: key3}
 		keys   = []string{"file1.csv", "file2.csv", "folder/file3.csv"}
 		s3Path = S3Path{bucket: "bucket", path: "path/"}
 	)
 
-	result, err := filterObjects(s3Path, []*s3.Object{obj1, obj2, obj3}, keys)
+	result, err := filterObjects(s3Path, []*Object{obj1, obj2, obj3}, selection{keys: keys})
 	if err != nil {
 		t.Errorf("It should filter objects properly, but %v", err)
 	}
@@ -35,11 +36,11 @@ func TestFilterObjects(t *testing.T) {
 func TestFilterObjectsWithNoKeys(t *testing.T) {
 	var (
 		key    = "path/file.csv"
-		obj    = &s3.Object{Key: &key}
+		obj    = &Object{Key: key}
 		s3Path = S3Path{bucket: "bucket", path: "path/"}
 	)
 
-	result, err := filterObjects(s3Path, []*s3.Object{obj}, []string{})
+	result, err := filterObjects(s3Path, []*Object{obj}, selection{keys: []string{}})
 	if err != nil {
 		t.Errorf("It should filter objects properly, but %v", err)
 	}
@@ -50,15 +51,34 @@ func TestFilterObjectsWithNoKeys(t *testing.T) {
 	}
 }
 
+func TestFilterObjectsSkipsManifest(t *testing.T) {
+	var (
+		key      = "path/file.csv"
+		manifest = "path/MANIFEST.json"
+		nested   = "path/folder/MANIFEST.json"
+		s3Path   = S3Path{bucket: "bucket", path: "path/"}
+		objects  = []*Object{{Key: key}, {Key: manifest}, {Key: nested}}
+	)
+
+	result, err := filterObjects(s3Path, objects, selection{keys: []string{}})
+	if err != nil {
+		t.Errorf("It should filter objects properly, but %v", err)
+	}
+
+	if len(result) != 2 || result[0].Key != key || result[1].Key != nested {
+		t.Errorf("It should only skip the commit manifest, but got: %v", result)
+	}
+}
+
 func TestFilterObjectsUsingNonExistentKeys(t *testing.T) {
 	var (
 		key    = "path/f1.csv"
-		obj    = &s3.Object{Key: &key}
+		obj    = &Object{Key: key}
 		s3Path = S3Path{bucket: "bucket", path: "path/"}
 		keys   = []string{"f2.csv", "f3.csv"}
 	)
 
-	result, err := filterObjects(s3Path, []*s3.Object{obj}, keys)
+	result, err := filterObjects(s3Path, []*Object{obj}, selection{keys: keys})
 	if result != nil {
 		t.Error("It should not return a list of S3 objects")
 	}
@@ -68,25 +88,21 @@ func TestFilterObjectsUsingNonExistentKeys(t *testing.T) {
 	}
 }
 
-type s3GetterFromString struct {
+type storageFromString struct {
+	Storage
 	s string
 }
 
-func (s3FromString s3GetterFromString) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	out := s3.GetObjectOutput{
-		Body: ioutil.NopCloser(strings.NewReader(s3FromString.s)),
-	}
-	return &out, nil
+func (storage storageFromString) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(strings.NewReader(storage.s)), nil
 }
 
-func Test_copyS3ObjectToFile_worksFirstTime(t *testing.T) {
-	var s3Client S3Getter = s3GetterFromString{"foobar"}
+func Test_copyObjectToFile_worksFirstTime(t *testing.T) {
+	var storage Storage = storageFromString{s: "foobar"}
 
-	s3Path := S3Path{bucket: "bucket", path: "path/"}
-	filePath := "foo/bar"
 	tempFile, _ := ioutil.TempFile("", "testDownload")
 
-	err := copyS3ObjectToFile(s3Client, s3Path, filePath, tempFile)
+	err := copyObjectToFile(context.Background(), storage, "path/foo/bar", tempFile)
 	if err != nil {
 		t.Errorf("Should have downloaded file successfully but didn't: %v", err)
 	}
@@ -101,35 +117,32 @@ func Test_copyS3ObjectToFile_worksFirstTime(t *testing.T) {
 	}
 }
 
-type s3FailingGetter struct {
+type failingStorage struct {
+	Storage
 }
 
-func (s3FailingGetter *s3FailingGetter) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+func (storage *failingStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
 	return nil, errors.New("can't connect to S3")
 }
 
-func Test_copyS3ObjectToFile_failsToGetObjectFromS3(t *testing.T) {
-	var s3Client S3Getter = &s3FailingGetter{}
-	s3RetriesSleep = 1 * time.Second
+func Test_copyObjectToFile_failsToGetObject(t *testing.T) {
+	var storage Storage = &failingStorage{}
+	retrySleep = noSleep
 
-	s3Path := S3Path{bucket: "bucket", path: "path/"}
-	filePath := "foo/bar"
 	tempFile, _ := ioutil.TempFile("", "testDownload")
 
-	err := copyS3ObjectToFile(s3Client, s3Path, filePath, tempFile)
+	err := copyObjectToFile(context.Background(), storage, "path/foo/bar", tempFile)
 	if err == nil {
 		t.Errorf("Shouldn't have been able to download file successfully but did")
 	}
 }
 
-type s3FailingReader struct {
+type failingReaderStorage struct {
+	Storage
 }
 
-func (s3FailingReader *s3FailingReader) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	out := s3.GetObjectOutput{
-		Body: ioutil.NopCloser(&failingReader{}),
-	}
-	return &out, nil
+func (storage *failingReaderStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(&failingReader{}), nil
 }
 
 type failingReader struct {
@@ -139,29 +152,25 @@ func (r *failingReader) Read(p []byte) (int, error) {
 	return 0, errors.New("failing reader")
 }
 
-func Test_copyS3ObjectToFile_failsToReadFromS3(t *testing.T) {
-	var s3Client S3Getter = &s3FailingReader{}
-	s3RetriesSleep = 1 * time.Second
+func Test_copyObjectToFile_failsToRead(t *testing.T) {
+	var storage Storage = &failingReaderStorage{}
+	retrySleep = noSleep
 
-	s3Path := S3Path{bucket: "bucket", path: "path/"}
-	filePath := "foo/bar"
 	tempFile, _ := ioutil.TempFile("", "testDownload")
 
-	err := copyS3ObjectToFile(s3Client, s3Path, filePath, tempFile)
+	err := copyObjectToFile(context.Background(), storage, "path/foo/bar", tempFile)
 	if err == nil {
 		t.Errorf("Shouldn't have been able to download file successfully but did")
 	}
 }
 
-type s3GetterFailOnClose struct {
+type storageFailOnClose struct {
+	Storage
 	s string
 }
 
-func (s3GetterFailOnClose *s3GetterFailOnClose) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	out := s3.GetObjectOutput{
-		Body: failOnClose{strings.NewReader(s3GetterFailOnClose.s)},
-	}
-	return &out, nil
+func (storage *storageFailOnClose) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return failOnClose{strings.NewReader(storage.s)}, nil
 }
 
 type failOnClose struct {
@@ -172,50 +181,39 @@ func (failOnClose) Close() error {
 	return errors.New("failed while closing")
 }
 
-func Test_copyS3ObjectToFile_failsWhenClosingStream(t *testing.T) {
-	var s3Client S3Getter = &s3FailingReader{}
-	s3RetriesSleep = 1 * time.Second
+func Test_copyObjectToFile_failsWhenClosingStream(t *testing.T) {
+	var storage Storage = &failingReaderStorage{}
+	retrySleep = noSleep
 
-	s3Path := S3Path{bucket: "bucket", path: "path/"}
-	filePath := "foo/bar"
 	tempFile, _ := ioutil.TempFile("", "testDownload")
 
-	err := copyS3ObjectToFile(s3Client, s3Path, filePath, tempFile)
+	err := copyObjectToFile(context.Background(), storage, "path/foo/bar", tempFile)
 	if err == nil {
 		t.Errorf("Shouldn't have been able to download file successfully but did")
 	}
 }
 
-type s3GetterFailsFirstFewAttempts struct {
+type storageFailsFirstFewAttempts struct {
+	Storage
 	unsuccessfulReads int
 	s                 string
 }
 
-func (s3GetterFailsFirstFewAttempts *s3GetterFailsFirstFewAttempts) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
-	var out s3.GetObjectOutput
-	if s3GetterFailsFirstFewAttempts.unsuccessfulReads == 0 {
-		out = s3.GetObjectOutput{
-			Body: ioutil.NopCloser(strings.NewReader(s3GetterFailsFirstFewAttempts.s)),
-		}
-	} else {
-		s3GetterFailsFirstFewAttempts.unsuccessfulReads--
-		out = s3.GetObjectOutput{
-			Body: ioutil.NopCloser(&failingReader{}),
-		}
+func (storage *storageFailsFirstFewAttempts) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if storage.unsuccessfulReads == 0 {
+		return ioutil.NopCloser(strings.NewReader(storage.s)), nil
 	}
-
-	return &out, nil
+	storage.unsuccessfulReads--
+	return ioutil.NopCloser(&failingReader{}), nil
 }
 
-func Test_copyS3ObjectToFile_failsFirstFewReadAttemptsButRetries(t *testing.T) {
-	var s3Client S3Getter = &s3GetterFailsFirstFewAttempts{5, "foobar"}
-	s3RetriesSleep = 1 * time.Second
+func Test_copyObjectToFile_failsFirstFewReadAttemptsButRetries(t *testing.T) {
+	var storage Storage = &storageFailsFirstFewAttempts{unsuccessfulReads: 5, s: "foobar"}
+	retrySleep = noSleep
 
-	s3Path := S3Path{bucket: "bucket", path: "path/"}
-	filePath := "foo/bar"
 	tempFile, _ := ioutil.TempFile("", "testDownload")
 
-	err := copyS3ObjectToFile(s3Client, s3Path, filePath, tempFile)
+	err := copyObjectToFile(context.Background(), storage, "path/foo/bar", tempFile)
 	if err != nil {
 		t.Errorf("Should have downloaded file successfully but didn't: %v", err)
 	}
@@ -229,3 +227,163 @@ func Test_copyS3ObjectToFile_failsFirstFewReadAttemptsButRetries(t *testing.T) {
 		t.Errorf("File contents were incorrect.  Expected '%s' but got '%s'", "foobar", string(bytes))
 	}
 }
+
+type countingStorage struct {
+	Storage
+	err   error
+	calls int
+}
+
+func (storage *countingStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	storage.calls++
+	return nil, storage.err
+}
+
+func Test_copyObjectToFile_failsImmediatelyWhenObjectIsMissing(t *testing.T) {
+	storage := &countingStorage{err: &notFoundError{"path/foo/bar"}}
+	retrySleep = noSleep
+
+	tempFile, _ := ioutil.TempFile("", "testDownload")
+
+	err := copyObjectToFile(context.Background(), storage, "path/foo/bar", tempFile)
+	if !isNotFound(err) {
+		t.Errorf("It should report the object is missing, got: %v", err)
+	}
+	if storage.calls != 1 {
+		t.Errorf("It should not retry, got: %d attempts", storage.calls)
+	}
+}
+
+func TestLocalFileMatchesObject(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	ioutil.WriteFile(path, []byte("foobar"), 0644)
+
+	// md5 of "foobar"
+	etag := "3858f62230ac3c915f300c664312c63f"
+
+	if !localFileMatchesObject(path, &Object{Size: 6, ETag: etag}) {
+		t.Error("It should match a file with the same size and MD5")
+	}
+	if localFileMatchesObject(path, &Object{Size: 7, ETag: etag}) {
+		t.Error("It should not match a file of a different size")
+	}
+	if localFileMatchesObject(path, &Object{Size: 6, ETag: "3858f62230ac3c915f300c664312c63f-2"}) {
+		t.Error("It should not match objects uploaded in parts")
+	}
+	if localFileMatchesObject(filepath.Join(dir, "missing"), &Object{Size: 6, ETag: etag}) {
+		t.Error("It should not match a missing file")
+	}
+}
+
+func TestProcessSkipsFilesUpToDate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	source := S3Path{bucket: "bucket", path: "model/v1/master/commit/"}
+	entry := ManifestEntry{
+		Path:   "file",
+		Size:   6,
+		SHA256: "c3ab8ff13720e8ad9047dd39466b3c8974e592c2fa383d4a3960714caef0c4f2",
+	}
+	storage := &countingStorage{err: errors.New("should not be called")}
+
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("foobar"), 0644)
+	err := process(context.Background(), storage, source, dir, &Object{Key: "model/v1/master/commit/file"}, &entry, newTransferStats("get"))
+	if err != nil || storage.calls != 0 {
+		t.Errorf("It should skip a file matching the manifest, got: %d calls (%v)", storage.calls, err)
+	}
+}
+
+func TestDownloadFileIsAtomic(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	retrySleep = noSleep
+
+	err := downloadFile(context.Background(), &failingReaderStorage{}, "key", path, fileCheck{Size: -1}, nil)
+	if err == nil {
+		t.Error("It should return an error")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("It should not create the file when the download fails")
+	}
+	if _, err := os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+		t.Error("It should remove the partial file")
+	}
+
+	err = downloadFile(context.Background(), storageFromString{s: "foobar"}, "key", path, fileCheck{Size: -1}, nil)
+	contents, _ := ioutil.ReadFile(path)
+	if err != nil || string(contents) != "foobar" {
+		t.Errorf("It should download the file, got: %s (%v)", contents, err)
+	}
+	if _, err := os.Stat(path + partialSuffix); !os.IsNotExist(err) {
+		t.Error("It should rename the partial file")
+	}
+}
+
+// interruptedStorage drops the connection after the first bytes of a get,
+// and records where each get or ranged get started.
+type interruptedStorage struct {
+	Storage
+	after   int64
+	offsets []int64
+}
+
+func (s *interruptedStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.offsets = append(s.offsets, 0)
+	body, err := s.Storage.Get(ctx, key)
+	if err != nil || s.after == 0 {
+		return body, err
+	}
+	return ioutil.NopCloser(io.MultiReader(io.LimitReader(body, s.after), &droppedReader{})), nil
+}
+
+func (s *interruptedStorage) getRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	s.offsets = append(s.offsets, offset)
+	return getRange(ctx, s.Storage, key, offset, length)
+}
+
+type droppedReader struct{}
+
+func (r *droppedReader) Read(p []byte) (int, error) {
+	return 0, &permanentError{errors.New("connection reset")}
+}
+
+func TestDownloadFileResumes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	contents := strings.Repeat("0123456789", 1000)
+	size, sum, _ := hashReader(strings.NewReader(contents))
+	check := fileCheck{Size: size, SHA256: sum}
+	storage := &interruptedStorage{Storage: memStorage(map[string]string{"key": contents}), after: 4000}
+
+	err := downloadFile(context.Background(), storage, "key", path, check, nil)
+	if err == nil {
+		t.Fatal("It should fail when the connection drops")
+	}
+	if info, err := os.Stat(path + partialSuffix); err != nil || info.Size() != 4000 {
+		t.Fatalf("It should keep what was downloaded so far, got: %v", err)
+	}
+
+	storage.after, storage.offsets = 0, nil
+	err = downloadFile(context.Background(), storage, "key", path, check, nil)
+	downloaded, _ := ioutil.ReadFile(path)
+	if err != nil || string(downloaded) != contents {
+		t.Fatalf("It should complete the download, got %d bytes (%v)", len(downloaded), err)
+	}
+	if len(storage.offsets) != 1 || storage.offsets[0] != 4000 {
+		t.Errorf("It should only fetch the rest of the file, got gets from: %v", storage.offsets)
+	}
+
+	// a partial file that doesn't match is downloaded again in full
+	ioutil.WriteFile(path+partialSuffix, []byte("garbage"), 0644)
+	storage.offsets = nil
+	err = downloadFile(context.Background(), storage, "key", path, check, nil)
+	downloaded, _ = ioutil.ReadFile(path)
+	if err != nil || string(downloaded) != contents || len(storage.offsets) != 2 || storage.offsets[1] != 0 {
+		t.Errorf("It should start over when the resumed file doesn't verify, got gets from %v (%v)", storage.offsets, err)
+	}
+}
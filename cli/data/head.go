@@ -0,0 +1,235 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/deliveroo/paddle/rand"
+	"github.com/pkg/errors"
+)
+
+// A lock older than headLockTimeout is assumed to belong to a crashed commit
+const headLockTimeout = 10 * time.Minute
+
+// headLockSettle is how long to wait before checking that a lock we wrote
+// was not overwritten by a concurrent commit.
+var headLockSettle = 1 * time.Second
+
+// headLogEntry is a line of HEAD.log, the history of a branch's HEAD
+type headLogEntry struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Previous  string    `json:"previous"`
+	Target    string    `json:"new"`
+	Committer string    `json:"committer"`
+}
+
+type headLock struct {
+	Owner   string    `json:"owner"`
+	Host    string    `json:"host"`
+	Created time.Time `json:"created"`
+}
+
+// qualifyHead turns a commit path relative to a branch (as shown by
+// 'paddle data ls') into the full path stored in HEAD.
+func qualifyHead(branchPath string, commit string) string {
+	commit = strings.Trim(commit, "/")
+	if commit == "" || strings.HasPrefix(commit, branchPath+"/") {
+		return commit
+	}
+	return branchPath + "/" + commit
+}
+
+// updateHead points the HEAD of a branch to target, provided it still points
+// to expected. The check and the update happen while holding a lock on the
+// branch so two commits can't both succeed against the same HEAD. With force
+// HEAD is overwritten whatever it points to, taking the lock even if someone
+// else holds it, so that HEAD.log still records every update.
+func updateHead(ctx context.Context, storage Storage, branchPath string, target string, expected string, force bool, action string) error {
+	unlock, err := lockHead(ctx, storage, branchPath, force)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := headTarget(ctx, storage, branchPath)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s/HEAD", branchPath)
+	}
+	if !force && current != expected {
+		return fmt.Errorf("HEAD of %s moved: expected %s, found %s (use --force to overwrite it)",
+			branchPath, describeHead(expected), describeHead(current))
+	}
+
+	err = putObject(ctx, storage, branchPath+"/HEAD", []byte(target))
+	if err != nil {
+		return err
+	}
+
+	err = appendHeadLog(ctx, storage, branchPath, headLogEntry{
+		Time:      time.Now().UTC(),
+		Action:    action,
+		Previous:  current,
+		Target:    target,
+		Committer: committer(),
+	})
+	if err != nil {
+		return &headLogError{branchPath: branchPath, target: target, err: err}
+	}
+	return nil
+}
+
+// headLogError is returned by updateHead when HEAD was updated but the
+// update could not be recorded in HEAD.log, so there is nothing to retry.
+type headLogError struct {
+	branchPath string
+	target     string
+	err        error
+}
+
+func (e *headLogError) Error() string {
+	return fmt.Sprintf("HEAD of %s points to %s, but recording it in HEAD.log failed: %v", e.branchPath, e.target, e.err)
+}
+
+func describeHead(head string) string {
+	if head == "" {
+		return "no HEAD"
+	}
+	return head
+}
+
+// lockHead takes the lock on a branch's HEAD, returning a function that
+// releases it. S3 has no conditional writes, so the lock is claimed by
+// writing it and then checking, after a short delay, that no other commit
+// overwrote it in the meantime. With force a lock held by someone else is
+// taken over.
+func lockHead(ctx context.Context, storage Storage, branchPath string, force bool) (func(), error) {
+	key := branchPath + "/HEAD.lock"
+
+	existing, err := readHeadLock(ctx, storage, key)
+	if err != nil {
+		return nil, err
+	}
+	if !force && existing != nil && time.Since(existing.Created) < headLockTimeout {
+		return nil, fmt.Errorf("%s is locked by %s since %s (use --force to ignore the lock)",
+			branchPath, existing.Host, existing.Created.Format(time.RFC3339))
+	}
+
+	host, _ := os.Hostname()
+	lock := headLock{
+		Owner:   rand.String(20),
+		Host:    host,
+		Created: time.Now().UTC(),
+	}
+	data, err := json.Marshal(lock)
+	if err != nil {
+		return nil, err
+	}
+	if err := putObject(ctx, storage, key, data); err != nil {
+		return nil, err
+	}
+	unlock := func() {
+		// Release the lock even when the update was cancelled, rather than
+		// leaving the branch locked until it goes stale
+		err := releaseHeadLock(context.Background(), storage, key, lock.Owner)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to release %s: %v\n", key, err)
+		}
+	}
+
+	if err := sleep(ctx, headLockSettle); err != nil {
+		unlock()
+		return nil, err
+	}
+
+	claimed, err := readHeadLock(ctx, storage, key)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	if claimed == nil || claimed.Owner != lock.Owner {
+		return nil, fmt.Errorf("%s is being updated by another commit", branchPath)
+	}
+	return unlock, nil
+}
+
+// releaseHeadLock deletes a lock, unless it went stale while we held it and
+// another commit took it over, in which case it is theirs to release.
+func releaseHeadLock(ctx context.Context, storage Storage, key string, owner string) error {
+	current, err := readHeadLock(ctx, storage, key)
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Owner != owner {
+		return nil
+	}
+	return storage.Delete(ctx, key)
+}
+
+func readHeadLog(ctx context.Context, storage Storage, branchPath string) ([]headLogEntry, error) {
+	key := branchPath + "/HEAD.log"
+	contents, _, err := readObjectIfExists(ctx, storage, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", key)
+	}
+
+	var entries []headLogEntry
+	for _, line := range strings.Split(string(contents), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		entry := headLogEntry{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s", key)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// appendHeadLog adds an entry to HEAD.log. S3 objects can't be appended to,
+// so the whole log is rewritten.
+func appendHeadLog(ctx context.Context, storage Storage, branchPath string, entry headLogEntry) error {
+	key := branchPath + "/HEAD.log"
+	contents, _, err := readObjectIfExists(ctx, storage, key)
+	if err != nil {
+		return errors.Wrapf(err, "reading %s", key)
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	contents = append(contents, line...)
+	contents = append(contents, '\n')
+
+	return putObject(ctx, storage, key, contents)
+}
+
+func committer() string {
+	host, _ := os.Hostname()
+	if user := os.Getenv("USER"); user != "" {
+		return user + "@" + host
+	}
+	return host
+}
+
+func readHeadLock(ctx context.Context, storage Storage, key string) (*headLock, error) {
+	contents, found, err := readObjectIfExists(ctx, storage, key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "reading %s", key)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	lock := &headLock{}
+	if err := json.Unmarshal(contents, lock); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s", key)
+	}
+	return lock, nil
+}
@@ -0,0 +1,171 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// Tests don't race each other for HEAD, so there's no need to wait for
+	// other commits to overwrite a lock
+	headLockSettle = 0
+	os.Exit(m.Run())
+}
+
+func TestQualifyHead(t *testing.T) {
+	branch := "model/v1/master"
+	cases := map[string]string{
+		"":                            "",
+		"2019/03/01/12/30_AbC123XyZ0": "model/v1/master/2019/03/01/12/30_AbC123XyZ0",
+		"model/v1/master/2019/03/01/12/30_AbC123XyZ0/": "model/v1/master/2019/03/01/12/30_AbC123XyZ0",
+	}
+
+	for commit, expectation := range cases {
+		if head := qualifyHead(branch, commit); head != expectation {
+			t.Errorf("HEAD was incorrect, got: %s, want: %s.", head, expectation)
+		}
+	}
+}
+
+func TestUpdateHead(t *testing.T) {
+	bucket := memStorage(map[string]string{
+		"model/v1/master/HEAD": "model/v1/master/old",
+	})
+
+	err := updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/new", "model/v1/master/old", false, "commit")
+	if err != nil {
+		t.Fatalf("It should update HEAD, but %v", err)
+	}
+
+	if readString(bucket, "model/v1/master/HEAD") != "model/v1/master/new" {
+		t.Errorf("HEAD was not updated, got: %s", readString(bucket, "model/v1/master/HEAD"))
+	}
+	if locked, _ := objectExists(context.Background(), bucket, "model/v1/master/HEAD.lock"); locked {
+		t.Error("The lock should be released")
+	}
+}
+
+func TestUpdateHeadWhenHeadMoved(t *testing.T) {
+	bucket := memStorage(map[string]string{
+		"model/v1/master/HEAD": "model/v1/master/other",
+	})
+
+	err := updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/new", "model/v1/master/old", false, "commit")
+	if err == nil || !strings.Contains(err.Error(), "HEAD of model/v1/master moved: expected model/v1/master/old, found model/v1/master/other") {
+		t.Errorf("It should fail because HEAD moved, got: %v", err)
+	}
+
+	if readString(bucket, "model/v1/master/HEAD") != "model/v1/master/other" {
+		t.Errorf("HEAD should not change, got: %s", readString(bucket, "model/v1/master/HEAD"))
+	}
+
+	err = updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/new", "model/v1/master/old", true, "commit")
+	if err != nil || readString(bucket, "model/v1/master/HEAD") != "model/v1/master/new" {
+		t.Errorf("It should overwrite HEAD when forced, got: %v", err)
+	}
+}
+
+func TestUpdateHeadWhenLocked(t *testing.T) {
+	lock, _ := json.Marshal(headLock{Owner: "other", Host: "pod", Created: time.Now().UTC()})
+	bucket := memStorage(map[string]string{
+		"model/v1/master/HEAD.lock": string(lock),
+	})
+
+	err := updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/new", "", false, "commit")
+	if err == nil || !strings.Contains(err.Error(), "model/v1/master is locked by pod") {
+		t.Errorf("It should fail because the branch is locked, got: %v", err)
+	}
+
+	stale, _ := json.Marshal(headLock{Owner: "other", Host: "pod", Created: time.Now().Add(-time.Hour)})
+	putObject(context.Background(), bucket, "model/v1/master/HEAD.lock", stale)
+
+	err = updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/new", "", false, "commit")
+	if err != nil {
+		t.Errorf("It should take over a stale lock, but %v", err)
+	}
+}
+
+func TestForcedUpdateHeadWhenLocked(t *testing.T) {
+	lock, _ := json.Marshal(headLock{Owner: "other", Host: "pod", Created: time.Now().UTC()})
+	bucket := memStorage(map[string]string{
+		"model/v1/master/HEAD.lock": string(lock),
+	})
+
+	err := updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/new", "", true, "commit")
+	if err != nil {
+		t.Fatalf("It should take over the lock when forced, but %v", err)
+	}
+	if locked, _ := objectExists(context.Background(), bucket, "model/v1/master/HEAD.lock"); locked {
+		t.Error("The lock should be released")
+	}
+	entries, err := readHeadLog(context.Background(), bucket, "model/v1/master")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("It should record the forced update in HEAD.log, got: %v, %v", entries, err)
+	}
+}
+
+func TestLockHeadCancelled(t *testing.T) {
+	defer func(settle time.Duration) { headLockSettle = settle }(headLockSettle)
+	headLockSettle = time.Hour
+	bucket := memStorage(map[string]string{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := lockHead(ctx, bucket, "model/v1/master", false)
+	if err != context.DeadlineExceeded {
+		t.Errorf("It should stop waiting when cancelled, got: %v", err)
+	}
+	if locked, _ := objectExists(context.Background(), bucket, "model/v1/master/HEAD.lock"); locked {
+		t.Error("It should release the lock it wrote")
+	}
+}
+
+func TestReleaseHeadLockTakenOver(t *testing.T) {
+	lock, _ := json.Marshal(headLock{Owner: "other", Host: "pod", Created: time.Now().UTC()})
+	bucket := memStorage(map[string]string{
+		"model/v1/master/HEAD.lock": string(lock),
+	})
+
+	err := releaseHeadLock(context.Background(), bucket, "model/v1/master/HEAD.lock", "ours")
+	if err != nil {
+		t.Fatalf("It should not fail, but %v", err)
+	}
+	if locked, _ := objectExists(context.Background(), bucket, "model/v1/master/HEAD.lock"); !locked {
+		t.Error("It should not release a lock another commit took over")
+	}
+
+	err = releaseHeadLock(context.Background(), bucket, "model/v1/master/HEAD.lock", "other")
+	if locked, _ := objectExists(context.Background(), bucket, "model/v1/master/HEAD.lock"); err != nil || locked {
+		t.Errorf("It should release its own lock, got: %v", err)
+	}
+}
+
+// failingLogStorage can't write HEAD.log
+type failingLogStorage struct {
+	Storage
+}
+
+func (s failingLogStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	if strings.HasSuffix(key, "/HEAD.log") {
+		return &permanentError{errors.New("access denied")}
+	}
+	return s.Storage.Put(ctx, key, body)
+}
+
+func TestUpdateHeadWhenLogFails(t *testing.T) {
+	bucket := failingLogStorage{memStorage(map[string]string{})}
+
+	err := updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/new", "", false, "commit")
+	if _, logFailed := err.(*headLogError); !logFailed {
+		t.Fatalf("It should report that only HEAD.log failed, got: %v", err)
+	}
+	if readString(bucket, "model/v1/master/HEAD") != "model/v1/master/new" {
+		t.Error("It should still have updated HEAD")
+	}
+}
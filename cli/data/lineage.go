@@ -0,0 +1,588 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	lineageBranch     string
+	lineageBucket     string
+	lineageCommitPath string
+	lineageDirection  string
+	lineageOutput     string
+)
+
+var lineageCmd = &cobra.Command{
+	Use:   "lineage [step/version]",
+	Short: "Show the commits a commit was made from and those made from it",
+	Args:  cobra.ExactArgs(1),
+	Long: `Walk the lineage of a commit: upstream, the commits fetched by the steps that
+produced it, and downstream, the commits produced from it.
+
+'paddle data get' records every commit it fetches in $OUTPUT_PATH/inputs.log,
+which 'paddle data commit' stores as the LINEAGE.json of the new commit,
+clearing the log for the next one. The inputs log can be moved or turned off
+with --record-inputs or the 'record-inputs' setting, for both commands, see
+'paddle data get --help'.
+Downstream commits are only looked for in the same bucket.
+
+Example:
+
+$ paddle data lineage trained-model/version1
+$ paddle data lineage -b experimental --direction upstream trained-model/version1
+$ paddle data lineage -o dot trained-model/version1 | dot -Tpng > lineage.png
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if lineageBucket == "" {
+			lineageBucket = viper.GetString("bucket")
+		}
+		if lineageBucket == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+		if lineageOutput != "tree" && lineageOutput != "dot" {
+			exitErrorf("Unknown output format %s, expected tree or dot", lineageOutput)
+		}
+		if lineageDirection != "upstream" && lineageDirection != "downstream" && lineageDirection != "both" {
+			exitErrorf("Unknown direction %s, expected upstream, downstream or both", lineageDirection)
+		}
+
+		source := S3Path{
+			bucket: lineageBucket,
+			path:   fmt.Sprintf("%s/%s/%s", args[0], lineageBranch, lineageCommitPath),
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		up, down, err := walkLineage(ctx, newLineageWalker(openStorage), source, lineageDirection)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		if lineageOutput == "dot" {
+			writeDot(os.Stdout, up, down)
+			return
+		}
+		if up != nil {
+			fmt.Println("Upstream:")
+			up.writeTree(os.Stdout, source.bucket, "", true, true)
+		}
+		if down != nil {
+			if up != nil {
+				fmt.Println()
+			}
+			fmt.Println("Downstream:")
+			down.writeTree(os.Stdout, source.bucket, "", true, true)
+		}
+	},
+}
+
+func init() {
+	lineageCmd.Flags().StringVarP(&lineageBranch, "branch", "b", "master", "Branch to work on")
+	lineageCmd.Flags().StringVar(&lineageBucket, "bucket", "", "Bucket to use")
+	lineageCmd.Flags().StringVarP(&lineageCommitPath, "path", "p", "HEAD", "Commit or tag:<name> to start from (instead of HEAD)")
+	lineageCmd.Flags().StringVar(&lineageDirection, "direction", "both", "Direction to walk in (upstream, downstream or both)")
+	lineageCmd.Flags().StringVarP(&lineageOutput, "output", "o", "tree", "Output format (tree or Graphviz dot)")
+}
+
+const (
+	lineageFile = "LINEAGE.json"
+	// inputsLogFile is where gets record what they fetched, in the folder a
+	// step commits from, to be turned into the commit's lineage.
+	inputsLogFile = "inputs.log"
+)
+
+// inputsLogOff turns recording inputs off when given as the inputs log
+const inputsLogOff = "off"
+
+// inputsLogPath returns the inputs log for gets to append to: the one given
+// with --record-inputs, else the record-inputs setting, else inputs.log in
+// $OUTPUT_PATH. It is empty when recording is turned off or there is no
+// $OUTPUT_PATH to record to, as when running outside a pipeline.
+func inputsLogPath(flag string) string {
+	path := flag
+	if path == "" {
+		path = viper.GetString("record-inputs")
+	}
+	if path == "" && os.Getenv("OUTPUT_PATH") != "" {
+		path = filepath.Join(os.Getenv("OUTPUT_PATH"), inputsLogFile)
+	}
+	if path == inputsLogOff {
+		return ""
+	}
+	return path
+}
+
+// lineageInput is a commit that was fetched to produce another one
+type lineageInput struct {
+	Bucket  string `json:"bucket"`
+	Step    string `json:"step"`
+	Version string `json:"version"`
+	Branch  string `json:"branch"`
+	Commit  string `json:"commit"`
+	// Manifest is the SHA-256 of the input's manifest, if it had one
+	Manifest string `json:"manifest,omitempty"`
+}
+
+// lineage is stored with a commit, listing the inputs it was made from
+type lineage struct {
+	Inputs []lineageInput `json:"inputs"`
+}
+
+// newLineageInput describes the commit at path, given as
+// step/version/branch/commit with or without a trailing slash.
+func newLineageInput(bucket string, path string, manifest *Manifest) lineageInput {
+	input := lineageInput{Bucket: bucket, Commit: strings.TrimSuffix(path, "/")}
+	parts := strings.SplitN(input.Commit, "/", 4)
+	if len(parts) == 4 {
+		input.Step, input.Version, input.Branch = parts[0], parts[1], parts[2]
+	}
+	if manifest != nil {
+		input.Manifest = manifest.hash()
+	}
+	return input
+}
+
+// hash identifies the contents of a manifest. Manifests are stored as
+// encoded here, so it is also the SHA-256 of the MANIFEST.json of a commit.
+func (m *Manifest) hash() string {
+	data, _ := json.Marshal(m)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// recordInput appends an input to the inputs log at logPath. The log is
+// locked while writing, as several gets may be recording into it at once.
+func recordInput(logPath string, input lineageInput) error {
+	data, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(logPath), 0777); err != nil {
+		return errors.Wrap(err, "unable to create inputs log folder")
+	}
+	f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "unable to open inputs log")
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return errors.Wrapf(err, "unable to lock %s", logPath)
+	}
+	defer unlockFile(f)
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// readInputsLog reads the inputs recorded in a local inputs log, if there
+// is one, and how many bytes of the log they take up.
+func readInputsLog(logPath string, bucket string) ([]lineageInput, int64, error) {
+	f, err := os.Open(logPath)
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return nil, 0, errors.Wrapf(err, "unable to lock %s", logPath)
+	}
+	defer unlockFile(f)
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(f); err != nil {
+		return nil, 0, err
+	}
+	inputs, err := parseInputsLog(buf.Bytes(), bucket)
+	return inputs, int64(buf.Len()), err
+}
+
+// clearInputsLog removes the first n bytes of an inputs log, the inputs a
+// commit stored as its lineage, keeping any recorded since it read them.
+func clearInputsLog(logPath string, n int64) error {
+	f, err := os.OpenFile(logPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return errors.Wrapf(err, "unable to lock %s", logPath)
+	}
+	defer unlockFile(f)
+
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(f); err != nil {
+		return err
+	}
+	rest := buf.Bytes()
+	if n < int64(len(rest)) {
+		rest = rest[n:]
+	} else {
+		rest = nil
+	}
+	if _, err := f.WriteAt(rest, 0); err != nil {
+		return err
+	}
+	return f.Truncate(int64(len(rest)))
+}
+
+// samePath reports whether two local paths name the same file
+func samePath(a string, b string) bool {
+	absA, errA := filepath.Abs(a)
+	absB, errB := filepath.Abs(b)
+	if errA != nil || errB != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	return absA == absB
+}
+
+// parseInputsLog parses an inputs log, one input per line and without
+// duplicates. Logs written by older versions of paddle hold only the path
+// of each input, taken to be in bucket.
+func parseInputsLog(data []byte, bucket string) ([]lineageInput, error) {
+	inputs := []lineageInput{}
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var input lineageInput
+		if strings.HasPrefix(line, "{") {
+			if err := json.Unmarshal([]byte(line), &input); err != nil {
+				return nil, errors.Wrapf(err, "parsing input %s", line)
+			}
+		} else {
+			input = newLineageInput(bucket, line, nil)
+		}
+		if id := input.Bucket + ":" + input.Commit; !seen[id] {
+			seen[id] = true
+			inputs = append(inputs, input)
+		}
+	}
+	return inputs, scanner.Err()
+}
+
+// readLineage returns the inputs of the commit at prefix in bucket, falling
+// back to the inputs.log older commits stored as a plain file. Commits
+// without inputs return nil.
+func readLineage(ctx context.Context, storage Storage, bucket string, prefix string) ([]lineageInput, error) {
+	contents, found, err := readObjectIfExists(ctx, storage, prefix+lineageFile)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		record := &lineage{}
+		if err := json.Unmarshal(contents, record); err != nil {
+			return nil, errors.Wrapf(err, "parsing %s%s", prefix, lineageFile)
+		}
+		return record.Inputs, nil
+	}
+
+	contents, found, err = readObjectIfExists(ctx, storage, prefix+inputsLogFile)
+	if err != nil || !found {
+		return nil, err
+	}
+	return parseInputsLog(contents, bucket)
+}
+
+// walkLineage resolves the commit source refers to and walks its lineage in
+// the given direction. The tree for a direction not walked is nil.
+func walkLineage(ctx context.Context, walker *lineageWalker, source S3Path, direction string) (*lineageNode, *lineageNode, error) {
+	storage, err := walker.storage(source.bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+	commit, err := resolveCommit(ctx, storage, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	ref := commitRef{Bucket: source.bucket, Commit: commit}
+
+	var up, down *lineageNode
+	if direction != "downstream" {
+		up, err = walker.upstream(ctx, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if direction != "upstream" {
+		down, err = walker.downstream(ctx, ref)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return up, down, nil
+}
+
+// commitRef identifies a commit in any bucket
+type commitRef struct {
+	Bucket string
+	Commit string
+}
+
+func (r commitRef) String() string {
+	return r.Bucket + ":" + r.Commit
+}
+
+// lineageNode is a commit in a lineage tree. Commits reached a second time
+// are marked as repeated rather than walked again.
+type lineageNode struct {
+	Ref      commitRef
+	Repeated bool
+	Children []*lineageNode
+}
+
+// lineageWalker follows lineage across buckets, opening each bucket's storage
+// once.
+type lineageWalker struct {
+	open     func(bucket string) (Storage, error)
+	storages map[string]Storage
+	// consumers maps commits to those made from them, per bucket
+	consumers map[string]map[string][]string
+}
+
+func newLineageWalker(open func(bucket string) (Storage, error)) *lineageWalker {
+	return &lineageWalker{
+		open:      open,
+		storages:  make(map[string]Storage),
+		consumers: make(map[string]map[string][]string),
+	}
+}
+
+func (w *lineageWalker) storage(bucket string) (Storage, error) {
+	if storage, ok := w.storages[bucket]; ok {
+		return storage, nil
+	}
+	storage, err := w.open(bucket)
+	if err != nil {
+		return nil, err
+	}
+	w.storages[bucket] = storage
+	return storage, nil
+}
+
+// upstream returns the tree of commits ref was made from
+func (w *lineageWalker) upstream(ctx context.Context, ref commitRef) (*lineageNode, error) {
+	return w.walk(ref, make(map[commitRef]bool), func(ref commitRef) ([]commitRef, error) {
+		storage, err := w.storage(ref.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		inputs, err := readLineage(ctx, storage, ref.Bucket, ref.Commit+"/")
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading lineage of %s", ref)
+		}
+		refs := make([]commitRef, 0, len(inputs))
+		for _, input := range inputs {
+			refs = append(refs, commitRef{Bucket: input.Bucket, Commit: input.Commit})
+		}
+		return refs, nil
+	})
+}
+
+// downstream returns the tree of commits made from ref. Only commits in the
+// same bucket as the ones they were made from are found.
+func (w *lineageWalker) downstream(ctx context.Context, ref commitRef) (*lineageNode, error) {
+	return w.walk(ref, make(map[commitRef]bool), func(ref commitRef) ([]commitRef, error) {
+		consumers, err := w.consumersIn(ctx, ref.Bucket)
+		if err != nil {
+			return nil, err
+		}
+		refs := []commitRef{}
+		for _, commit := range consumers[ref.Commit] {
+			refs = append(refs, commitRef{Bucket: ref.Bucket, Commit: commit})
+		}
+		return refs, nil
+	})
+}
+
+func (w *lineageWalker) walk(ref commitRef, seen map[commitRef]bool, next func(commitRef) ([]commitRef, error)) (*lineageNode, error) {
+	node := &lineageNode{Ref: ref}
+	if seen[ref] {
+		node.Repeated = true
+		return node, nil
+	}
+	seen[ref] = true
+
+	refs, err := next(ref)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range refs {
+		childNode, err := w.walk(child, seen, next)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, childNode)
+	}
+	return node, nil
+}
+
+// consumersIn reads the lineage of every commit in a bucket, indexing
+// commits by the inputs they were made from.
+func (w *lineageWalker) consumersIn(ctx context.Context, bucket string) (map[string][]string, error) {
+	if consumers, ok := w.consumers[bucket]; ok {
+		return consumers, nil
+	}
+	storage, err := w.storage(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	commits, err := commitRoots(ctx, storage, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	consumers := make(map[string][]string)
+	for _, commit := range commits {
+		inputs, err := readLineage(ctx, storage, bucket, commit+"/")
+		if err != nil {
+			return nil, errors.Wrapf(err, "reading lineage of %s", commit)
+		}
+		for _, input := range inputs {
+			if input.Bucket == bucket {
+				consumers[input.Commit] = append(consumers[input.Commit], commit)
+			}
+		}
+	}
+	for _, commits := range consumers {
+		sort.Strings(commits)
+	}
+	w.consumers[bucket] = consumers
+	return consumers, nil
+}
+
+// commitRoots returns the paths of the commits under prefix, depth folders
+// down from the root of the bucket. Only folders are listed, down to the
+// commits, so the files of commits are never walked.
+func commitRoots(ctx context.Context, storage Storage, prefix string, depth int) ([]string, error) {
+	names, err := storage.ListPrefixes(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	var commits []string
+	for _, name := range names {
+		// skip internal prefixes such as the object store
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		path := prefix + name
+		if depth == 7 {
+			parts := strings.SplitN(path, "/", 4)
+			if commitPattern.MatchString(parts[3] + "/") {
+				commits = append(commits, path)
+			}
+			continue
+		}
+		found, err := commitRoots(ctx, storage, path+"/", depth+1)
+		if err != nil {
+			return nil, err
+		}
+		commits = append(commits, found...)
+	}
+	return commits, nil
+}
+
+// writeTree prints a lineage tree, labelling commits in other buckets than
+// bucket with theirs.
+func (n *lineageNode) writeTree(w io.Writer, bucket string, indent string, last bool, root bool) {
+	label := n.Ref.Commit
+	if n.Ref.Bucket != bucket {
+		label = n.Ref.String()
+	}
+	if n.Repeated {
+		label += " (see above)"
+	}
+
+	childIndent := indent
+	if root {
+		fmt.Fprintln(w, label)
+	} else if last {
+		fmt.Fprintf(w, "%s└── %s\n", indent, label)
+		childIndent += "    "
+	} else {
+		fmt.Fprintf(w, "%s├── %s\n", indent, label)
+		childIndent += "│   "
+	}
+	for i, child := range n.Children {
+		child.writeTree(w, bucket, childIndent, i == len(n.Children)-1, false)
+	}
+}
+
+// edges lists the edges of a lineage tree as input, output pairs
+func (n *lineageNode) edges(upstream bool, fn func(from commitRef, to commitRef)) {
+	for _, child := range n.Children {
+		if upstream {
+			fn(child.Ref, n.Ref)
+		} else {
+			fn(n.Ref, child.Ref)
+		}
+		child.edges(upstream, fn)
+	}
+}
+
+// writeDot prints the upstream and downstream lineage trees of a commit as a
+// Graphviz graph, with edges going from inputs to the commits made from them.
+func writeDot(w io.Writer, up *lineageNode, down *lineageNode) {
+	fmt.Fprintln(w, "digraph lineage {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box];")
+
+	seen := make(map[string]bool)
+	edge := func(from commitRef, to commitRef) {
+		line := fmt.Sprintf("  %q -> %q;", from.String(), to.String())
+		if !seen[line] {
+			seen[line] = true
+			fmt.Fprintln(w, line)
+		}
+	}
+	if up != nil {
+		fmt.Fprintf(w, "  %q [style=bold];\n", up.Ref.String())
+		up.edges(true, edge)
+	}
+	if down != nil {
+		if up == nil {
+			fmt.Fprintf(w, "  %q [style=bold];\n", down.Ref.String())
+		}
+		down.edges(false, edge)
+	}
+	fmt.Fprintln(w, "}")
+}
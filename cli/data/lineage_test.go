@@ -0,0 +1,277 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func TestParseInputsLog(t *testing.T) {
+	log := `{"bucket":"other","step":"raw","version":"v1","branch":"master","commit":"raw/v1/master/2019/03/01/12/30_AbC123XyZ0"}
+features/v1/master/2019/03/01/12/30_AbC123XyZ0/
+features/v1/master/2019/03/01/12/30_AbC123XyZ0/
+`
+	inputs, err := parseInputsLog([]byte(log), "bucket")
+	if err != nil {
+		t.Fatalf("It should parse the log, but %v", err)
+	}
+	if len(inputs) != 2 {
+		t.Fatalf("It should skip repeated inputs, got: %+v", inputs)
+	}
+	if inputs[0].Bucket != "other" || inputs[0].Step != "raw" {
+		t.Errorf("Unexpected input: %+v", inputs[0])
+	}
+	legacy := inputs[1]
+	if legacy.Bucket != "bucket" || legacy.Step != "features" || legacy.Branch != "master" || legacy.Commit != "features/v1/master/2019/03/01/12/30_AbC123XyZ0" {
+		t.Errorf("It should read inputs logged by older versions, got: %+v", legacy)
+	}
+}
+
+func TestCommitRecordsLineage(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+filepath.Join(dir, "storage"))
+	defer viper.Set("storage", "")
+	AppFs = afero.NewOsFs()
+	defer func() { AppFs = afero.NewMemMapFs() }()
+	defer os.Setenv("OUTPUT_PATH", os.Getenv("OUTPUT_PATH"))
+
+	src := filepath.Join(dir, "src")
+	output := filepath.Join(dir, "output")
+	os.Setenv("OUTPUT_PATH", output)
+	os.MkdirAll(src, 0755)
+	os.MkdirAll(output, 0755)
+	ioutil.WriteFile(filepath.Join(src, "a"), []byte("file a"), 0644)
+	ioutil.WriteFile(filepath.Join(output, "b"), []byte("file b"), 0644)
+
+	err := Commit(context.Background(), src, NewS3Path("bucket", "features/v1/master"), CommitOptions{})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+
+	opts := GetOptions{InputsLog: inputsLogPath("")}
+	err = Get(context.Background(), NewS3Path("bucket", "features/v1/master/HEAD"), filepath.Join(dir, "input"), opts)
+	if err != nil {
+		t.Fatalf("It should get, but %v", err)
+	}
+
+	err = Commit(context.Background(), output, NewS3Path("bucket", "model/v1/master"), CommitOptions{})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+
+	storage, _ := openStorage("bucket")
+	features := readString(storage, "features/v1/master/HEAD")
+	model := readString(storage, "model/v1/master/HEAD")
+
+	inputs, err := readLineage(context.Background(), storage, "bucket", model+"/")
+	if err != nil || len(inputs) != 1 {
+		t.Fatalf("It should store the lineage of the commit, got: %+v, %v", inputs, err)
+	}
+	if inputs[0].Commit != features || inputs[0].Step != "features" {
+		t.Errorf("Unexpected input: %+v", inputs[0])
+	}
+	sum := sha256.Sum256([]byte(readString(storage, features+"/"+manifestFile)))
+	if inputs[0].Manifest != hex.EncodeToString(sum[:]) {
+		t.Errorf("It should record the SHA-256 of the input's manifest, got: %s", inputs[0].Manifest)
+	}
+	if found, _ := objectExists(context.Background(), storage, model+"/"+inputsLogFile); found {
+		t.Error("It should not store the inputs log as a file")
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(output, inputsLogFile)); len(contents) != 0 {
+		t.Errorf("It should clear the inputs log once committed, got: %s", contents)
+	}
+
+	// a folder other than $OUTPUT_PATH takes its lineage from the same log
+	err = Get(context.Background(), NewS3Path("bucket", "model/v1/master/HEAD"), filepath.Join(dir, "input"), opts)
+	if err != nil {
+		t.Fatalf("It should get, but %v", err)
+	}
+	err = Commit(context.Background(), src, NewS3Path("bucket", "features/v1/master"), CommitOptions{})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+	inputs, err = readLineage(context.Background(), storage, "bucket", readString(storage, "features/v1/master/HEAD")+"/")
+	if err != nil || len(inputs) != 1 || inputs[0].Commit != model {
+		t.Errorf("It should only store the inputs logged since the last commit, got: %+v, %v", inputs, err)
+	}
+}
+
+func TestClearInputsLog(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+
+	logPath := filepath.Join(dir, inputsLogFile)
+	recordInput(logPath, newLineageInput("bucket", "raw/v1/master/2019/03/01/12/30_AbC123XyZ0", nil))
+	_, logged, err := readInputsLog(logPath, "bucket")
+	if err != nil || logged == 0 {
+		t.Fatalf("It should read the inputs log, got %d bytes: %v", logged, err)
+	}
+	recordInput(logPath, newLineageInput("bucket", "raw/v1/master/2019/03/02/12/30_AbC123XyZ0", nil))
+
+	if err := clearInputsLog(logPath, logged); err != nil {
+		t.Fatalf("It should clear the inputs log, but %v", err)
+	}
+	inputs, _, err := readInputsLog(logPath, "bucket")
+	if err != nil || len(inputs) != 1 || inputs[0].Commit != "raw/v1/master/2019/03/02/12/30_AbC123XyZ0" {
+		t.Errorf("It should keep the inputs recorded since it was read, got: %+v (%v)", inputs, err)
+	}
+}
+
+// lineageBuckets holds the objects of each bucket lineage tests read
+var lineageBuckets = map[string]map[string]string{"bucket": {
+	"raw/v1/master/2019/03/01/12/30_AbC123XyZ0/a":                   "a",
+	"features/v1/master/2019/03/01/12/30_AbC123XyZ0/a":              "a",
+	"features/v1/master/2019/03/01/12/30_AbC123XyZ0/" + lineageFile: `{"inputs":[{"bucket":"bucket","commit":"raw/v1/master/2019/03/01/12/30_AbC123XyZ0"}]}`,
+	"labels/v1/master/2019/03/01/12/30_AbC123XyZ0/" + inputsLogFile: "raw/v1/master/2019/03/01/12/30_AbC123XyZ0/\n",
+	"model/v1/master/HEAD": "model/v1/master/2019/03/01/12/30_AbC123XyZ0",
+	"model/v1/master/2019/03/01/12/30_AbC123XyZ0/" + lineageFile: `{"inputs":[
+		{"bucket":"bucket","commit":"features/v1/master/2019/03/01/12/30_AbC123XyZ0"},
+		{"bucket":"bucket","commit":"labels/v1/master/2019/03/01/12/30_AbC123XyZ0"},
+		{"bucket":"other","commit":"external/v1/master/2019/03/01/12/30_AbC123XyZ0"}]}`,
+}}
+
+func TestLineageUpstream(t *testing.T) {
+	open := func(bucket string) (Storage, error) {
+		return memStorage(lineageBuckets[bucket]), nil
+	}
+	up, down, err := walkLineage(context.Background(), newLineageWalker(open), NewS3Path("bucket", "model/v1/master/HEAD"), "upstream")
+	if err != nil {
+		t.Fatalf("It should walk the lineage, but %v", err)
+	}
+	if down != nil {
+		t.Error("It should only walk upstream")
+	}
+
+	var out bytes.Buffer
+	up.writeTree(&out, "bucket", "", true, true)
+	expected := `model/v1/master/2019/03/01/12/30_AbC123XyZ0
+├── features/v1/master/2019/03/01/12/30_AbC123XyZ0
+│   └── raw/v1/master/2019/03/01/12/30_AbC123XyZ0
+├── labels/v1/master/2019/03/01/12/30_AbC123XyZ0
+│   └── raw/v1/master/2019/03/01/12/30_AbC123XyZ0 (see above)
+└── other:external/v1/master/2019/03/01/12/30_AbC123XyZ0
+`
+	if out.String() != expected {
+		t.Errorf("Unexpected tree:\n%s", out.String())
+	}
+}
+
+// unlistedStorage fails listings of whole folders, so tests can check that
+// only the folders down to commits are walked
+type unlistedStorage struct {
+	Storage
+}
+
+func (s unlistedStorage) List(ctx context.Context, prefix string, fn func([]*Object) error) error {
+	return fmt.Errorf("listing %q", prefix)
+}
+
+func TestLineageDownstream(t *testing.T) {
+	open := func(bucket string) (Storage, error) {
+		return unlistedStorage{memStorage(lineageBuckets[bucket])}, nil
+	}
+	_, down, err := walkLineage(context.Background(), newLineageWalker(open), NewS3Path("bucket", "raw/v1/master/2019/03/01/12/30_AbC123XyZ0"), "downstream")
+	if err != nil {
+		t.Fatalf("It should walk the lineage, but %v", err)
+	}
+
+	var out bytes.Buffer
+	writeDot(&out, nil, down)
+	for _, edge := range []string{
+		`"bucket:raw/v1/master/2019/03/01/12/30_AbC123XyZ0" -> "bucket:features/v1/master/2019/03/01/12/30_AbC123XyZ0";`,
+		`"bucket:raw/v1/master/2019/03/01/12/30_AbC123XyZ0" -> "bucket:labels/v1/master/2019/03/01/12/30_AbC123XyZ0";`,
+		`"bucket:features/v1/master/2019/03/01/12/30_AbC123XyZ0" -> "bucket:model/v1/master/2019/03/01/12/30_AbC123XyZ0";`,
+		`"bucket:labels/v1/master/2019/03/01/12/30_AbC123XyZ0" -> "bucket:model/v1/master/2019/03/01/12/30_AbC123XyZ0";`,
+	} {
+		if strings.Count(out.String(), edge) != 1 {
+			t.Errorf("Expected %s once in:\n%s", edge, out.String())
+		}
+	}
+}
+
+func TestInputsLogPath(t *testing.T) {
+	defer os.Setenv("OUTPUT_PATH", os.Getenv("OUTPUT_PATH"))
+	defer viper.Set("record-inputs", "")
+
+	os.Unsetenv("OUTPUT_PATH")
+	if path := inputsLogPath(""); path != "" {
+		t.Errorf("It should not record inputs outside a pipeline, got: %s", path)
+	}
+
+	os.Setenv("OUTPUT_PATH", "/data/output")
+	if path := inputsLogPath(""); path != "/data/output/inputs.log" {
+		t.Errorf("It should record inputs in $OUTPUT_PATH, got: %s", path)
+	}
+
+	viper.Set("record-inputs", "/tmp/inputs.log")
+	if path := inputsLogPath(""); path != "/tmp/inputs.log" {
+		t.Errorf("It should use the record-inputs setting, got: %s", path)
+	}
+	if path := inputsLogPath("other.log"); path != "other.log" {
+		t.Errorf("It should prefer the flag, got: %s", path)
+	}
+	if path := inputsLogPath("off"); path != "" {
+		t.Errorf("It should turn recording off, got: %s", path)
+	}
+}
+
+func TestRecordInputConcurrently(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	AppFs = afero.NewOsFs()
+	defer func() { AppFs = afero.NewMemMapFs() }()
+
+	logPath := filepath.Join(dir, "logs", inputsLogFile)
+	transfers := newTransfers(context.Background(), 10)
+	for i := 0; i < 50; i++ {
+		commit := fmt.Sprintf("raw/v1/master/2019/03/01/12/%02d_AbC123XyZ0", i)
+		transfers.Go(func() error {
+			return recordInput(logPath, newLineageInput("bucket", commit, nil))
+		})
+	}
+	if err := transfers.Wait(); err != nil {
+		t.Fatalf("It should record the inputs, but %v", err)
+	}
+
+	inputs, _, err := readInputsLog(logPath, "bucket")
+	if err != nil || len(inputs) != 50 {
+		t.Errorf("It should record every input intact, got %d: %v", len(inputs), err)
+	}
+}
+
+func TestCommitWithInputsLogOff(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/a", []byte("file a"), 0644)
+	afero.WriteFile(AppFs, "src/"+inputsLogFile, []byte("raw/v1/master/2019/03/01/12/30_AbC123XyZ0\n"), 0644)
+
+	opts := CommitOptions{InputsLog: inputsLogOff}
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), opts)
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+
+	storage, _ := openStorage("bucket")
+	head := readString(storage, "model/v1/master/HEAD")
+	if found, _ := objectExists(context.Background(), storage, head+"/"+lineageFile); found {
+		t.Error("It should not record lineage")
+	}
+	if readString(storage, head+"/"+inputsLogFile) == "" {
+		t.Error("It should commit the inputs log as any other file")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package data
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on an open file, waiting for it if needed
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
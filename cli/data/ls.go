@@ -0,0 +1,324 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	lsBucket string
+	lsOutput string
+	lsLong   bool
+)
+
+// commitPattern matches the commit folders created by generateRootKey
+var commitPattern = regexp.MustCompile(`^(\d{4}/\d{2}/\d{2}/\d{2}/\d{2}_[a-zA-Z0-9]+)/`)
+
+var lsCmd = &cobra.Command{
+	Use:   "ls [step[/version[/branch]]]",
+	Short: "List steps, versions, branches and commits in S3",
+	Args:  cobra.MaximumNArgs(1),
+	Long: `List what is stored in S3.
+
+Without arguments lists the steps in the bucket. Given a step lists its
+versions, given a step/version lists its branches, and given a
+step/version/branch lists its commits, marking the one HEAD points to. With
+--long the committer and tags of each commit are listed too.
+
+Example:
+
+$ paddle data ls
+$ paddle data ls trained-model/version1
+$ paddle data ls -o json trained-model/version1/master
+$ paddle data ls -l trained-model/version1/master
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if lsBucket == "" {
+			lsBucket = viper.GetString("bucket")
+		}
+		if lsBucket == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+		if lsOutput != "table" && lsOutput != "json" {
+			exitErrorf("Unknown output format %s, expected table or json", lsOutput)
+		}
+
+		path := ""
+		if len(args) == 1 {
+			path = strings.Trim(args[0], "/")
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		storage, err := openStorage(lsBucket)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		result, err := list(ctx, storage, lsBucket, path)
+		if err != nil {
+			exitErrorf("Unable to list %s: %v", path, err)
+		}
+		if lsLong {
+			if err := result.addMetadata(ctx, storage); err != nil {
+				exitErrorf("Unable to read metadata: %v", err)
+			}
+		}
+
+		if lsOutput == "json" {
+			err = result.writeJSON(os.Stdout)
+		} else {
+			err = result.writeTable(os.Stdout)
+		}
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+	},
+}
+
+func init() {
+	lsCmd.Flags().StringVar(&lsBucket, "bucket", "", "Bucket to use")
+	lsCmd.Flags().StringVarP(&lsOutput, "output", "o", "table", "Output format (table or json)")
+	lsCmd.Flags().BoolVarP(&lsLong, "long", "l", false, "Include the committer and tags of commits")
+}
+
+type listing struct {
+	Bucket  string      `json:"bucket"`
+	Path    string      `json:"path"`
+	Kind    string      `json:"kind"`
+	Head    string      `json:"head,omitempty"`
+	Entries []listEntry `json:"entries"`
+
+	// long is set once the metadata of the commits has been read
+	long bool
+}
+
+type listEntry struct {
+	Name         string          `json:"name"`
+	Files        int             `json:"files,omitempty"`
+	Size         int64           `json:"size,omitempty"`
+	LastModified *time.Time      `json:"last_modified,omitempty"`
+	Head         bool            `json:"head,omitempty"`
+	Metadata     *commitMetadata `json:"metadata,omitempty"`
+}
+
+var listKinds = []string{"step", "version", "branch", "commit"}
+
+func list(ctx context.Context, storage Storage, bucket string, path string) (*listing, error) {
+	depth := 0
+	if path != "" {
+		depth = len(strings.Split(path, "/"))
+	}
+	if depth >= len(listKinds) {
+		return nil, fmt.Errorf("expected at most step/version/branch, got %s", path)
+	}
+
+	result := &listing{
+		Bucket:  bucket,
+		Path:    path,
+		Kind:    listKinds[depth],
+		Entries: []listEntry{},
+	}
+
+	prefix := ""
+	if path != "" {
+		prefix = path + "/"
+	}
+
+	if result.Kind != "commit" {
+		names, err := storage.ListPrefixes(ctx, prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			// skip internal prefixes such as the object store
+			if strings.HasPrefix(name, ".") {
+				continue
+			}
+			result.Entries = append(result.Entries, listEntry{Name: name})
+		}
+		return result, nil
+	}
+
+	commits, err := listCommits(ctx, storage, prefix)
+	if err != nil {
+		return nil, err
+	}
+	head, err := headTarget(ctx, storage, path)
+	if err != nil {
+		return nil, err
+	}
+	if head != "" {
+		result.Head = strings.TrimPrefix(head, prefix)
+	}
+	for _, commit := range commits {
+		commit.Head = commit.Name == result.Head
+		result.Entries = append(result.Entries, commit)
+	}
+	return result, nil
+}
+
+// listCommits groups the objects under a branch prefix by commit folder
+func listCommits(ctx context.Context, storage Storage, prefix string) ([]listEntry, error) {
+	commits := make(map[string]*listEntry)
+	manifests := make(map[string]bool)
+
+	err := storage.List(ctx, prefix, func(objects []*Object) error {
+		for _, obj := range objects {
+			matches := commitPattern.FindStringSubmatch(strings.TrimPrefix(obj.Key, prefix))
+			if matches == nil {
+				continue
+			}
+			commit, ok := commits[matches[1]]
+			if !ok {
+				commit = &listEntry{Name: matches[1]}
+				commits[matches[1]] = commit
+			}
+			name := strings.TrimPrefix(obj.Key, prefix+matches[0])
+			if name == manifestFile {
+				manifests[matches[1]] = true
+			}
+			if !isReservedFile(name) {
+				commit.Files++
+				commit.Size += obj.Size
+			}
+			if commit.LastModified == nil || obj.LastModified.After(*commit.LastModified) {
+				modified := obj.LastModified
+				commit.LastModified = &modified
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Packed and deduplicated commits keep their files apart, so are counted
+	// from their manifest
+	for name, commit := range commits {
+		if commit.Files > 0 || !manifests[name] {
+			continue
+		}
+		manifest, err := readManifest(ctx, storage, prefix+name+"/")
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil && manifest.storedApart() {
+			commit.Files, commit.Size = manifest.totals()
+		}
+	}
+
+	entries := make([]listEntry, 0, len(commits))
+	for _, commit := range commits {
+		entries = append(entries, *commit)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// addMetadata reads the metadata of every commit in a commit listing
+func (l *listing) addMetadata(ctx context.Context, storage Storage) error {
+	if l.Kind != "commit" {
+		return nil
+	}
+	for i, entry := range l.Entries {
+		metadata, err := readMetadata(ctx, storage, l.Path+"/"+entry.Name+"/")
+		if err != nil {
+			return err
+		}
+		l.Entries[i].Metadata = metadata
+	}
+	l.long = true
+	return nil
+}
+
+// headTarget returns the commit path HEAD points to on a branch, or an empty
+// string if the branch has no HEAD.
+func headTarget(ctx context.Context, storage Storage, branchPath string) (string, error) {
+	contents, _, err := readObjectIfExists(ctx, storage, branchPath+"/HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(contents)), nil
+}
+
+func (l *listing) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(l)
+}
+
+func (l *listing) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	if l.Kind != "commit" {
+		fmt.Fprintln(tw, strings.ToUpper(l.Kind))
+		for _, entry := range l.Entries {
+			fmt.Fprintln(tw, entry.Name)
+		}
+		return tw.Flush()
+	}
+
+	if l.long {
+		fmt.Fprintln(tw, "COMMIT\tFILES\tSIZE\tLAST MODIFIED\tCOMMITTER\tTAGS\t")
+	} else {
+		fmt.Fprintln(tw, "COMMIT\tFILES\tSIZE\tLAST MODIFIED\t")
+	}
+	for _, entry := range l.Entries {
+		modified := ""
+		if entry.LastModified != nil {
+			modified = entry.LastModified.UTC().Format(time.RFC3339)
+		}
+		head := ""
+		if entry.Head {
+			head = "<- HEAD"
+		}
+		if l.long {
+			committer, tags := "", ""
+			if entry.Metadata != nil {
+				committer, tags = entry.Metadata.Committer, formatTags(entry.Metadata.Tags)
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\t%s\n", entry.Name, entry.Files, entry.Size, modified, committer, tags, head)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\n", entry.Name, entry.Files, entry.Size, modified, head)
+	}
+	if l.Head != "" && !headListed(l) {
+		fmt.Fprintf(tw, "HEAD points to %s, which is not a commit on this branch\n", l.Head)
+	}
+	return tw.Flush()
+}
+
+func headListed(l *listing) bool {
+	for _, entry := range l.Entries {
+		if entry.Head {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+var lsBucketObjects = memStorage(map[string]string{
+	"model/v1/master/HEAD":                              "model/v1/master/2019/03/01/12/30_AbC123XyZ0",
+	"model/v1/master/2019/03/01/12/30_AbC123XyZ0/a":     "aaa",
+	"model/v1/master/2019/03/01/12/30_AbC123XyZ0/b/c":   "cc",
+	"model/v1/master/2019/02/01/09/00_ZyX321cBa0/a":     "a",
+	"model/v1/experiment/2019/02/01/09/00_QwE321cBa0/a": "a",
+	"model/v2/master/HEAD":                              "model/v2/master/2019/03/02/12/30_AbC123XyZ0",
+	"features/v1/master/HEAD":                           "features/v1/master/2019/03/02/12/30_AbC123XyZ0",
+})
+
+func TestListSteps(t *testing.T) {
+	result, err := list(context.Background(), lsBucketObjects, "bucket", "")
+	if err != nil {
+		t.Fatalf("It should list steps, but %v", err)
+	}
+
+	if result.Kind != "step" || len(result.Entries) != 2 || result.Entries[0].Name != "features" || result.Entries[1].Name != "model" {
+		t.Errorf("Unexpected steps listing: %+v", result)
+	}
+}
+
+func TestListBranches(t *testing.T) {
+	result, err := list(context.Background(), lsBucketObjects, "bucket", "model/v1")
+	if err != nil {
+		t.Fatalf("It should list branches, but %v", err)
+	}
+
+	if result.Kind != "branch" || len(result.Entries) != 2 || result.Entries[0].Name != "experiment" || result.Entries[1].Name != "master" {
+		t.Errorf("Unexpected branches listing: %+v", result)
+	}
+}
+
+func TestListCommits(t *testing.T) {
+	result, err := list(context.Background(), lsBucketObjects, "bucket", "model/v1/master")
+	if err != nil {
+		t.Fatalf("It should list commits, but %v", err)
+	}
+
+	if result.Head != "2019/03/01/12/30_AbC123XyZ0" {
+		t.Errorf("HEAD was incorrect, got: %s", result.Head)
+	}
+
+	if len(result.Entries) != 2 {
+		t.Fatalf("Expected two commits, got: %+v", result.Entries)
+	}
+
+	latest := result.Entries[1]
+	if latest.Name != "2019/03/01/12/30_AbC123XyZ0" || latest.Files != 2 || latest.Size != 5 || !latest.Head {
+		t.Errorf("Unexpected commit entry: %+v", latest)
+	}
+	if result.Entries[0].Head {
+		t.Errorf("Only the latest commit should be HEAD")
+	}
+
+	var out bytes.Buffer
+	result.writeTable(&out)
+	if !strings.Contains(out.String(), "2019/03/01/12/30_AbC123XyZ0  2      5     2019-03-01T12:30:00Z  <- HEAD") {
+		t.Errorf("Unexpected table output:\n%s", out.String())
+	}
+}
+
+func TestListCommitsWithoutHEAD(t *testing.T) {
+	result, err := list(context.Background(), lsBucketObjects, "bucket", "model/v1/experiment")
+	if err != nil {
+		t.Fatalf("It should list commits, but %v", err)
+	}
+
+	if result.Head != "" || len(result.Entries) != 1 || result.Entries[0].Head {
+		t.Errorf("Unexpected commits listing: %+v", result)
+	}
+}
+
+func TestListTooDeep(t *testing.T) {
+	_, err := list(context.Background(), lsBucketObjects, "bucket", "model/v1/master/2019")
+	if err == nil {
+		t.Error("It should return an error")
+	}
+}
+
+func TestListCommitsLong(t *testing.T) {
+	storage := memStorage(map[string]string{
+		"model/v1/master/HEAD":                                        "model/v1/master/2019/03/01/12/30_AbC123XyZ0",
+		"model/v1/master/2019/03/01/12/30_AbC123XyZ0/a":               "aaa",
+		"model/v1/master/2019/03/01/12/30_AbC123XyZ0/" + metadataFile: `{"committer":"jane@host","tags":{"b":"2","a":"1"}}`,
+		"model/v1/master/2019/02/01/09/00_ZyX321cBa0/a":               "a",
+	})
+
+	result, err := list(context.Background(), storage, "bucket", "model/v1/master")
+	if err != nil {
+		t.Fatalf("It should list commits, but %v", err)
+	}
+	if err := result.addMetadata(context.Background(), storage); err != nil {
+		t.Fatalf("It should read the metadata, but %v", err)
+	}
+
+	if result.Entries[1].Files != 1 || result.Entries[1].Metadata == nil || result.Entries[0].Metadata != nil {
+		t.Errorf("Unexpected commit entries: %+v", result.Entries)
+	}
+
+	var out bytes.Buffer
+	result.writeTable(&out)
+	if !strings.Contains(out.String(), "jane@host  a=1,b=2  <- HEAD") {
+		t.Errorf("Unexpected table output:\n%s", out.String())
+	}
+}
+
+func TestListPackedCommits(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	defer viper.Set("storage", "")
+
+	storage, head := commitPacked(t, dir)
+	result, err := list(context.Background(), storage, "bucket", "model/v1/master")
+	if err != nil {
+		t.Fatalf("It should list commits, but %v", err)
+	}
+
+	if len(result.Entries) != 1 || result.Entries[0].Name != strings.TrimPrefix(head, "model/v1/master/") {
+		t.Fatalf("Expected the packed commit, got: %+v", result.Entries)
+	}
+	if entry := result.Entries[0]; entry.Files != 30 || entry.Size != 4000 {
+		t.Errorf("It should count the files of a packed commit from its manifest, got: %d files, %d bytes", entry.Files, entry.Size)
+	}
+}
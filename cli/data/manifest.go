@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	manifestFile = "MANIFEST.json"
+	// objectStorePrefix is where content-addressed commits store their files,
+	// shared by every step in the bucket so identical files are stored once.
+	objectStorePrefix = ".objects/sha256"
+)
+
+// Manifest lists the files belonging to a commit. When ObjectStore is set the
+// files are not stored under the commit itself but as blobs named by their
+// hash under that prefix. Files of packed commits are in the chunks their
+// entries point to.
+type Manifest struct {
+	ObjectStore string          `json:"object_store,omitempty"`
+	Files       []ManifestEntry `json:"files"`
+}
+
+type ManifestEntry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// Pack is the chunk of a packed commit the file is in, and Offset and
+	// Length where its gzip member is in the chunk
+	Pack   string `json:"pack,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+// isReservedFile reports whether a path relative to a commit is one paddle
+// keeps for itself rather than part of the committed data.
+func isReservedFile(path string) bool {
+	return path == manifestFile || path == metadataFile || path == lineageFile ||
+		strings.HasPrefix(path, packsFolder+"/")
+}
+
+// storedApart reports whether the files of a commit are kept somewhere other
+// than one object each under the commit, that is in chunks or blobs, so only
+// the manifest tells how many there are.
+func (m *Manifest) storedApart() bool {
+	return m.packed() || m.ObjectStore != ""
+}
+
+// totals returns how many files the manifest lists and their total size
+func (m *Manifest) totals() (int, int64) {
+	var size int64
+	for _, entry := range m.Files {
+		size += entry.Size
+	}
+	return len(m.Files), size
+}
+
+func (m *Manifest) blobKey(hash string) string {
+	return m.ObjectStore + "/" + hash
+}
+
+// buildManifest hashes the given files, recording their paths relative to
+// the source path.
+func buildManifest(path string, files []string) (*Manifest, error) {
+	manifest := &Manifest{Files: []ManifestEntry{}}
+	for _, file := range files {
+		size, sum, err := hashFile(file)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Files = append(manifest.Files, ManifestEntry{
+			Path:   strings.TrimPrefix(file, path+"/"),
+			Size:   size,
+			SHA256: sum,
+		})
+	}
+	return manifest, nil
+}
+
+func hashFile(filePath string) (int64, string, error) {
+	file, err := AppFs.Open(filePath)
+	if err != nil {
+		return 0, "", errors.Wrapf(err, "opening %s", filePath)
+	}
+	defer file.Close()
+
+	return hashReader(file)
+}
+
+func hashReader(r io.Reader) (int64, string, error) {
+	hash := sha256.New()
+	size, err := io.Copy(hash, r)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// readManifest fetches the manifest of the commit at prefix, returning nil
+// if the commit has none.
+func readManifest(ctx context.Context, storage Storage, prefix string) (*Manifest, error) {
+	contents, found, err := readObjectIfExists(ctx, storage, prefix+manifestFile)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	manifest := &Manifest{}
+	if err := json.Unmarshal(contents, manifest); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s%s", prefix, manifestFile)
+	}
+	return manifest, nil
+}
+
+func (m *Manifest) filter(sel selection) ([]ManifestEntry, error) {
+	var (
+		entries      []ManifestEntry
+		entryByPath  = make(map[string]ManifestEntry)
+		keysNotFound []string
+	)
+	if len(sel.keys) == 0 {
+		for _, entry := range m.Files {
+			if sel.matches(entry.Path) {
+				entries = append(entries, entry)
+			}
+		}
+		return entries, nil
+	}
+
+	for _, entry := range m.Files {
+		entryByPath[entry.Path] = entry
+	}
+	for _, key := range sel.keys {
+		if entry, contains := entryByPath[key]; contains {
+			if sel.matches(entry.Path) {
+				entries = append(entries, entry)
+			}
+			continue
+		}
+		keysNotFound = append(keysNotFound, key)
+	}
+	if len(keysNotFound) > 0 {
+		return nil, errors.New("couldn't find " + strings.Join(keysNotFound, ","))
+	}
+	return entries, nil
+}
+
+// verify checks the files downloaded to destination against the manifest,
+// failing if any of them is missing or does not have the recorded contents.
+func (m *Manifest) verify(destination string, sel selection) error {
+	entries, err := m.filter(sel)
+	if err != nil {
+		return err
+	}
+
+	var missing, corrupt []string
+	for _, entry := range entries {
+		target := destination + "/" + entry.Path
+		if _, err := os.Stat(target); err != nil {
+			missing = append(missing, entry.Path)
+			continue
+		}
+		if !localFileMatches(target, entry) {
+			corrupt = append(corrupt, entry.Path)
+		}
+	}
+
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "missing "+strings.Join(missing, ","))
+	}
+	if len(corrupt) > 0 {
+		problems = append(problems, "corrupt "+strings.Join(corrupt, ","))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("files don't match %s: %s", manifestFile, strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package data
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+const fooSHA256 = "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+func TestBuildManifest(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	AppFs.MkdirAll("src/a", 0755)
+	afero.WriteFile(AppFs, "src/a/b", []byte("foo"), 0644)
+	afero.WriteFile(AppFs, "src/c", []byte("foo"), 0644)
+
+	manifest, err := buildManifest("src", filesToKeys("src"))
+	if err != nil {
+		t.Fatalf("It should build the manifest, but %v", err)
+	}
+
+	if len(manifest.Files) != 2 {
+		t.Fatalf("Expected two files, got: %+v", manifest.Files)
+	}
+
+	for i, path := range []string{"a/b", "c"} {
+		entry := manifest.Files[i]
+		if entry.Path != path || entry.Size != 3 || entry.SHA256 != fooSHA256 {
+			t.Errorf("Unexpected manifest entry: %+v", entry)
+		}
+	}
+}
+
+func TestManifestFilter(t *testing.T) {
+	manifest := &Manifest{Files: []ManifestEntry{
+		{Path: "file1.csv"},
+		{Path: "folder/file2.csv"},
+	}}
+
+	entries, err := manifest.filter(selection{keys: []string{"folder/file2.csv"}})
+	if err != nil {
+		t.Errorf("It should filter entries properly, but %v", err)
+	}
+	if len(entries) != 1 || entries[0].Path != "folder/file2.csv" {
+		t.Errorf("Unexpected entries: %+v", entries)
+	}
+
+	entries, err = manifest.filter(selection{keys: []string{}})
+	if err != nil || len(entries) != 2 {
+		t.Errorf("It should return all entries, but got: %+v (%v)", entries, err)
+	}
+
+	entries, err = manifest.filter(selection{keys: []string{"file1.csv", "missing.csv"}})
+	if entries != nil || err == nil {
+		t.Error("It should return an error for missing keys")
+	}
+}
+
+func TestLocalFileMatches(t *testing.T) {
+	file, _ := ioutil.TempFile("", "testManifest")
+	defer os.Remove(file.Name())
+	file.WriteString("foo")
+	file.Close()
+
+	if !localFileMatches(file.Name(), ManifestEntry{Size: 3, SHA256: fooSHA256}) {
+		t.Error("File with the same contents should match")
+	}
+
+	if localFileMatches(file.Name(), ManifestEntry{Size: 3, SHA256: "0000"}) {
+		t.Error("File with different contents should not match")
+	}
+
+	if localFileMatches(file.Name()+".missing", ManifestEntry{Size: 3, SHA256: fooSHA256}) {
+		t.Error("Missing file should not match")
+	}
+}
+
+func TestManifestVerify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "testVerify")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/good", []byte("foo"), 0644)
+	ioutil.WriteFile(dir+"/bad", []byte("bar"), 0644)
+
+	manifest := &Manifest{Files: []ManifestEntry{
+		{Path: "good", Size: 3, SHA256: fooSHA256},
+		{Path: "bad", Size: 3, SHA256: fooSHA256},
+		{Path: "gone", Size: 3, SHA256: fooSHA256},
+	}}
+
+	if err := manifest.verify(dir, selection{keys: []string{"good"}}); err != nil {
+		t.Errorf("It should verify the downloaded key, but %v", err)
+	}
+
+	err := manifest.verify(dir, selection{keys: []string{}})
+	if err == nil {
+		t.Fatal("It should return an error")
+	}
+	expectation := "files don't match MANIFEST.json: missing gone; corrupt bad"
+	if err.Error() != expectation {
+		t.Errorf("Error was incorrect, got: %s, want: %s.", err.Error(), expectation)
+	}
+}
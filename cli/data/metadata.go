@@ -0,0 +1,114 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deliveroo/paddle/git"
+	"github.com/pkg/errors"
+)
+
+const metadataFile = "METADATA.json"
+
+// commitMetadata records who and what made a commit. Inside a pipeline most
+// of it comes from the PADDLE_* variables the pod template sets.
+type commitMetadata struct {
+	Pipeline    string            `json:"pipeline,omitempty"`
+	Step        string            `json:"step"`
+	Version     string            `json:"version"`
+	Branch      string            `json:"branch"`
+	Image       string            `json:"image,omitempty"`
+	ImageDigest string            `json:"image_digest,omitempty"`
+	GitSHA      string            `json:"git_sha,omitempty"`
+	RunID       string            `json:"run_id,omitempty"`
+	Host        string            `json:"host"`
+	Committer   string            `json:"committer"`
+	Started     time.Time         `json:"started"`
+	Finished    time.Time         `json:"finished"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Encryption  *commitEncryption `json:"encryption,omitempty"`
+	// CopiedFrom is the commit a commit made by 'paddle data cp' is a copy of
+	CopiedFrom string `json:"copied_from,omitempty"`
+}
+
+// newCommitMetadata describes a commit of the files under path to
+// destination, started at the given time.
+func newCommitMetadata(path string, destination S3Path, started time.Time, tags map[string]string) *commitMetadata {
+	host, _ := os.Hostname()
+	metadata := &commitMetadata{
+		Pipeline:    os.Getenv("PADDLE_PIPELINE"),
+		Image:       os.Getenv("PADDLE_IMAGE"),
+		ImageDigest: os.Getenv("PADDLE_IMAGE_DIGEST"),
+		GitSHA:      os.Getenv("PADDLE_GIT_SHA"),
+		RunID:       os.Getenv("PADDLE_RUN_ID"),
+		Host:        host,
+		Committer:   committer(),
+		Started:     started.UTC(),
+		Tags:        tags,
+	}
+
+	parts := strings.Split(destination.path, "/")
+	if len(parts) == 3 {
+		metadata.Step, metadata.Version, metadata.Branch = parts[0], parts[1], parts[2]
+	}
+
+	// The step started before the commit did when run by a pipeline
+	if value := os.Getenv("PADDLE_STARTED"); value != "" {
+		if stepStarted, err := time.Parse(time.RFC3339, value); err == nil {
+			metadata.Started = stepStarted.UTC()
+		}
+	}
+	if metadata.ImageDigest == "" {
+		if i := strings.Index(metadata.Image, "@"); i >= 0 {
+			metadata.ImageDigest = metadata.Image[i+1:]
+		}
+	}
+	// Pipelines pass the git commit in, as what they commit isn't a checkout
+	if metadata.GitSHA == "" && metadata.Pipeline == "" {
+		metadata.GitSHA = git.HeadSHA(path)
+	}
+	return metadata
+}
+
+// parseTags turns key=value pairs into a map
+func parseTags(pairs []string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid tag %s, expected key=value", pair)
+		}
+		tags[parts[0]] = parts[1]
+	}
+	return tags, nil
+}
+
+// readMetadata returns the metadata of the commit at prefix, or nil for
+// commits made before metadata was recorded.
+func readMetadata(ctx context.Context, storage Storage, prefix string) (*commitMetadata, error) {
+	contents, found, err := readObjectIfExists(ctx, storage, prefix+metadataFile)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	metadata := &commitMetadata{}
+	if err := json.Unmarshal(contents, metadata); err != nil {
+		return nil, errors.Wrapf(err, "parsing %s%s", prefix, metadataFile)
+	}
+	return metadata, nil
+}
+
+// formatTags returns tags as key=value pairs sorted by key
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for key, value := range tags {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
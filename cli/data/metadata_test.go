@@ -0,0 +1,56 @@
+package data
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestParseTags(t *testing.T) {
+	tags, err := parseTags([]string{"dataset=2019-03", "note=a=b"})
+	if err != nil {
+		t.Fatalf("It should parse the tags, but %v", err)
+	}
+	if len(tags) != 2 || tags["dataset"] != "2019-03" || tags["note"] != "a=b" {
+		t.Errorf("Unexpected tags: %v", tags)
+	}
+	if formatTags(tags) != "dataset=2019-03,note=a=b" {
+		t.Errorf("Unexpected formatted tags: %s", formatTags(tags))
+	}
+}
+
+func TestParseInvalidTags(t *testing.T) {
+	for _, pair := range []string{"dataset", "=value"} {
+		if _, err := parseTags([]string{pair}); err == nil {
+			t.Errorf("It should reject %s", pair)
+		}
+	}
+}
+
+func TestNewCommitMetadata(t *testing.T) {
+	os.Setenv("PADDLE_PIPELINE", "training")
+	os.Setenv("PADDLE_IMAGE", "paddlecontainer@sha256:abc")
+	os.Setenv("PADDLE_GIT_SHA", "0123abc")
+	os.Setenv("PADDLE_STARTED", "2019-03-01T12:00:00Z")
+	defer func() {
+		for _, name := range []string{"PADDLE_PIPELINE", "PADDLE_IMAGE", "PADDLE_GIT_SHA", "PADDLE_STARTED"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	started := time.Date(2019, 3, 1, 12, 30, 0, 0, time.UTC)
+	metadata := newCommitMetadata("src", NewS3Path("bucket", "model/v1/master"), started, nil)
+
+	if metadata.Pipeline != "training" || metadata.GitSHA != "0123abc" {
+		t.Errorf("It should read the pipeline and git SHA from the environment: %+v", metadata)
+	}
+	if metadata.ImageDigest != "sha256:abc" {
+		t.Errorf("It should take the image digest from the image reference, got: %s", metadata.ImageDigest)
+	}
+	if metadata.Step != "model" || metadata.Version != "v1" || metadata.Branch != "master" {
+		t.Errorf("Unexpected step, version or branch: %+v", metadata)
+	}
+	if !metadata.Started.Equal(time.Date(2019, 3, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("It should use the step's start time, got: %v", metadata.Started)
+	}
+}
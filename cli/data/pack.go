@@ -0,0 +1,361 @@
+package data
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+)
+
+// packsFolder holds the chunks of a packed commit. A chunk is a tar archive
+// in which every file, along with its tar header, is compressed as a gzip
+// member of its own. Concatenated gzip members make a valid gzip stream, so a
+// chunk can be unpacked whole like any .tar.gz, while a single file can be
+// read with a ranged get of its member alone.
+const packsFolder = "PACKS"
+
+const defaultPackSizeMB = 64
+
+// countingWriter keeps track of how much was written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// packFiles writes the files of a manifest into chunks of about size bytes
+// in dir, recording in each entry where the file went, and calls done with
+// each chunk as soon as it is complete.
+func packFiles(manifest *Manifest, files []string, dir string, size int64, done func(pack string, file string) error) error {
+	var (
+		chunk  afero.File
+		out    *countingWriter
+		name   string
+		packed int
+	)
+
+	finish := func() error {
+		// a last member with the end of the tar archive
+		err := writeGzipMember(out, func(tw *tar.Writer) error {
+			return tw.Close()
+		})
+		closeErr := chunk.Close()
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return errors.Wrapf(err, "writing %s", name)
+		}
+		chunk = nil
+		packed++
+		return done(name, filepath.Join(dir, filepath.Base(name)))
+	}
+
+	for i := range manifest.Files {
+		entry := &manifest.Files[i]
+		if chunk == nil {
+			var err error
+			name = fmt.Sprintf("%s/%05d.tar.gz", packsFolder, packed)
+			chunk, err = AppFs.Create(filepath.Join(dir, filepath.Base(name)))
+			if err != nil {
+				return errors.Wrapf(err, "creating %s", name)
+			}
+			out = &countingWriter{w: chunk}
+		}
+
+		offset := out.n
+		err := writeGzipMember(out, func(tw *tar.Writer) error {
+			return packFile(tw, files[i], entry)
+		})
+		if err != nil {
+			chunk.Close()
+			return errors.Wrapf(err, "packing %s", files[i])
+		}
+		entry.Pack, entry.Offset, entry.Length = name, offset, out.n-offset
+
+		if out.n >= size {
+			if err := finish(); err != nil {
+				return err
+			}
+		}
+	}
+	if chunk != nil {
+		return finish()
+	}
+	return nil
+}
+
+// writeGzipMember compresses what fn writes to a tar archive as a gzip
+// member of its own
+func writeGzipMember(w io.Writer, fn func(tw *tar.Writer) error) error {
+	member := gzip.NewWriter(w)
+	tw := tar.NewWriter(member)
+	if err := fn(tw); err != nil {
+		return err
+	}
+	return member.Close()
+}
+
+func packFile(tw *tar.Writer, file string, entry *ManifestEntry) error {
+	in, err := AppFs.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	modified := time.Now()
+	if info, err := in.Stat(); err == nil {
+		modified = info.ModTime()
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     entry.Path,
+		Size:     entry.Size,
+		Mode:     0644,
+		ModTime:  modified,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, in, entry.Size); err != nil {
+		return errors.Wrap(err, "file changed while committing")
+	}
+	// pads the file to a whole tar block, without ending the archive
+	return tw.Flush()
+}
+
+// uploadPacks packs the files into chunks under the commit, uploading up to
+// concurrency chunks at a time while the next ones are being packed.
+func uploadPacks(ctx context.Context, storage Storage, rootKey string, manifest *Manifest, files []string, concurrency int, size int64, stats *transferStats) error {
+	dir, err := afero.TempDir(AppFs, "", "paddle-pack")
+	if err != nil {
+		return errors.Wrap(err, "unable to create temp directory")
+	}
+	defer AppFs.RemoveAll(dir)
+
+	chunks, next := 0, 0
+	uploads := newTransfers(ctx, concurrency)
+	err = packFiles(manifest, files, dir, size, func(pack string, file string) error {
+		chunks++
+		key := rootKey + "/" + pack
+
+		// the files packed since the last chunk are the ones in this one
+		var files, sizes int64
+		for ; next < len(manifest.Files) && manifest.Files[next].Pack == pack; next++ {
+			files, sizes = files+1, sizes+manifest.Files[next].Size
+		}
+
+		uploads.Go(func() error {
+			defer AppFs.Remove(file)
+
+			progress := stats.track()
+			if err := uploadFile(ctx, storage, key, file, progress); err != nil {
+				return err
+			}
+			progress.done(files, sizes)
+			return nil
+		})
+		return nil
+	})
+	if waitErr := uploads.Wait(); err == nil {
+		err = waitErr
+	}
+	if err != nil {
+		return err
+	}
+	// stdout is left to the transfer summary, for whatever parses it
+	fmt.Fprintf(os.Stderr, "Packed %d files into %d chunks\n", len(manifest.Files), chunks)
+	return nil
+}
+
+// packed reports whether the files of a commit are in chunks
+func (m *Manifest) packed() bool {
+	return len(m.Files) > 0 && m.Files[0].Pack != ""
+}
+
+// openPackedFile returns the contents of a file of a packed commit under
+// prefix, fetching only its gzip member of the chunk.
+func openPackedFile(ctx context.Context, storage Storage, prefix string, entry ManifestEntry) (io.ReadCloser, error) {
+	key := prefix + entry.Pack
+	var body io.ReadCloser
+	err := transferRetries.do(ctx, "fetching "+entry.Path+" from "+key, func() error {
+		var err error
+		body, err = getRange(ctx, storage, key, entry.Offset, entry.Length)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := readGzipMember(body)
+	if err != nil {
+		body.Close()
+		return nil, errors.Wrapf(err, "reading %s from %s", entry.Path, key)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{contents, body}, nil
+}
+
+// readGzipMember returns the contents of the file in a chunk's gzip member
+func readGzipMember(r io.Reader) (io.Reader, error) {
+	member, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	member.Multistream(false)
+
+	archive := tar.NewReader(member)
+	if _, err := archive.Next(); err != nil {
+		return nil, err
+	}
+	return archive, nil
+}
+
+// copyPacksToLocalFiles rebuilds a packed commit from its manifest. Chunks
+// most of which are wanted are downloaded and unpacked whole, while files
+// picked out of the rest, e.g. with --keys, are fetched with ranged gets.
+func copyPacksToLocalFiles(ctx context.Context, storage Storage, manifest *Manifest, source S3Path, destination string, sel selection, stats *transferStats) error {
+	entries, err := manifest.filter(sel)
+	if err != nil {
+		return errors.Wrap(err, "downloading keys")
+	}
+
+	sizes := make(map[string]int64)
+	for _, entry := range manifest.Files {
+		sizes[entry.Pack] += entry.Length
+	}
+
+	var packs []string
+	wanted := make(map[string][]ManifestEntry)
+	for _, entry := range entries {
+		target := destination + "/" + entry.Path
+		stats.expect(1, entry.Size)
+		if localFileMatches(target, entry) {
+			stats.unchanged(entry.Size)
+			continue
+		}
+		if _, seen := wanted[entry.Pack]; !seen {
+			packs = append(packs, entry.Pack)
+		}
+		wanted[entry.Pack] = append(wanted[entry.Pack], entry)
+	}
+
+	downloads := newTransfers(ctx, s3ParallelGets)
+	for _, pack := range packs {
+		var needed int64
+		for _, entry := range wanted[pack] {
+			needed += entry.Length
+		}
+
+		if needed*2 >= sizes[pack] {
+			key, entries := source.path+pack, wanted[pack]
+			downloads.Go(func() error {
+				return unpackChunk(ctx, storage, key, destination, entries, stats)
+			})
+			continue
+		}
+		for _, entry := range wanted[pack] {
+			entry := entry
+			downloads.Go(func() error {
+				body, err := openPackedFile(ctx, storage, source.path, entry)
+				if err != nil {
+					return err
+				}
+				defer body.Close()
+				progress := stats.track()
+				if err := storeFile(progress.reader(body), destination+"/"+entry.Path); err != nil {
+					return err
+				}
+				progress.done(1, entry.Size)
+				return nil
+			})
+		}
+	}
+	return downloads.Wait()
+}
+
+// unpackChunk downloads a chunk and writes out the wanted files in it
+func unpackChunk(ctx context.Context, storage Storage, key string, destination string, entries []ManifestEntry, stats *transferStats) error {
+	wanted := make(map[string]bool)
+	for _, entry := range entries {
+		wanted[entry.Path] = true
+	}
+
+	progress := stats.track()
+	err := transferRetries.do(ctx, "fetching "+key, func() error {
+		// a retry unpacks the whole chunk again
+		progress.rewind(0)
+		body, err := storage.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		stream, err := gzip.NewReader(body)
+		if err != nil {
+			return errors.Wrapf(err, "reading %s", key)
+		}
+		archive := tar.NewReader(stream)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return errors.Wrapf(err, "reading %s", key)
+			}
+			if wanted[header.Name] {
+				if err := storeFile(progress.reader(archive), destination+"/"+header.Name); err != nil {
+					return err
+				}
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, entry := range entries {
+		size += entry.Size
+	}
+	progress.done(int64(len(entries)), size)
+	return nil
+}
+
+// storeFile writes r to a local file, through a .partial file like
+// downloadFile.
+func storeFile(r io.Reader, destination string) error {
+	partial := destination + partialSuffix
+	file, err := createFile(partial)
+	if err != nil {
+		return err
+	}
+
+	err = storeObjectToFile(r, file)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(partial, destination)
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package data
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func commitPacked(t *testing.T, dir string) (Storage, string) {
+	viper.Set("storage", "file://"+dir)
+
+	AppFs = afero.NewMemMapFs()
+	for i := 0; i < 30; i++ {
+		afero.WriteFile(AppFs, fmt.Sprintf("src/part-%02d.csv", i), []byte(strings.Repeat(fmt.Sprintf("row %d\n", i), 20)), 0644)
+	}
+
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{Pack: true, PackSize: 256})
+	if err != nil {
+		t.Fatalf("It should commit, but %v", err)
+	}
+
+	storage, _ := openStorage("bucket")
+	return storage, readString(storage, "model/v1/master/HEAD")
+}
+
+func TestCommitPacked(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	defer viper.Set("storage", "")
+
+	storage, head := commitPacked(t, dir)
+
+	manifest, err := readManifest(context.Background(), storage, head+"/")
+	if err != nil || manifest == nil || !manifest.packed() {
+		t.Fatalf("It should record where the files were packed, got: %+v (%v)", manifest, err)
+	}
+	if found, _ := objectExists(context.Background(), storage, head+"/part-00.csv"); found {
+		t.Error("It should not store the files one object each")
+	}
+	chunks, _ := storage.ListPrefixes(context.Background(), head+"/")
+	if len(chunks) != 1 || chunks[0] != packsFolder {
+		t.Errorf("It should store chunks under %s, got: %v", packsFolder, chunks)
+	}
+
+	// every chunk is a plain .tar.gz
+	packs := make(map[string]bool)
+	for _, entry := range manifest.Files {
+		packs[entry.Pack] = true
+	}
+	if len(packs) < 2 {
+		t.Errorf("It should split the files into chunks, got: %v", packs)
+	}
+	var names []string
+	for pack := range packs {
+		body, err := storage.Get(context.Background(), head+"/"+pack)
+		if err != nil {
+			t.Fatalf("It should store %s, but %v", pack, err)
+		}
+		stream, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatalf("%s should be gzipped, but %v", pack, err)
+		}
+		archive := tar.NewReader(stream)
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s should be a tar archive, but %v", pack, err)
+			}
+			names = append(names, header.Name)
+		}
+		body.Close()
+	}
+	if len(names) != 30 {
+		t.Errorf("Expected the chunks to hold 30 files, got: %v", names)
+	}
+}
+
+func TestGetPacked(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	defer viper.Set("storage", "")
+
+	_, head := commitPacked(t, dir)
+
+	destination := filepath.Join(dir, "all")
+	err := Get(context.Background(), NewS3Path("bucket", "model/v1/master/HEAD"), destination, GetOptions{})
+	if err != nil {
+		t.Fatalf("It should get the packed commit, but %v", err)
+	}
+	files, _ := ioutil.ReadDir(destination)
+	if len(files) != 30 {
+		t.Errorf("It should unpack every file, got %d", len(files))
+	}
+
+	destination = filepath.Join(dir, "some")
+	err = Get(context.Background(), NewS3Path("bucket", "model/v1/master/HEAD"), destination, GetOptions{Keys: []string{"part-17.csv"}})
+	if err != nil {
+		t.Fatalf("It should get a single file, but %v", err)
+	}
+	files, _ = ioutil.ReadDir(destination)
+	contents, _ := ioutil.ReadFile(filepath.Join(destination, "part-17.csv"))
+	if len(files) != 1 || string(contents) != strings.Repeat("row 17\n", 20) {
+		t.Errorf("It should fetch only part-17.csv, got %d files and: %q", len(files), contents)
+	}
+
+	var out bytes.Buffer
+	err = Cat(context.Background(), NewS3Path("bucket", head), "part-03.csv", &out)
+	if err != nil || out.String() != strings.Repeat("row 3\n", 20) {
+		t.Errorf("It should cat a packed file, got: %q (%v)", out.String(), err)
+	}
+}
+
+func TestCommitPackedAndDeduped(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/a", []byte("a"), 0644)
+
+	err := Commit(context.Background(), "src", NewS3Path("bucket", "model/v1/master"), CommitOptions{Pack: true, Dedup: true})
+	if err == nil {
+		t.Error("It should refuse to both pack and dedup")
+	}
+}
+
+func TestGetRange(t *testing.T) {
+	storage := memStorage(map[string]string{"a": "0123456789"})
+
+	for _, s := range []Storage{storage, struct{ Storage }{storage}} {
+		body, err := getRange(context.Background(), s, "a", 3, 4)
+		if err != nil {
+			t.Fatalf("It should get the range, but %v", err)
+		}
+		contents, _ := ioutil.ReadAll(body)
+		body.Close()
+		if string(contents) != "3456" {
+			t.Errorf("Expected 3456, got: %s", contents)
+		}
+	}
+}
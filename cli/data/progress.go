@@ -0,0 +1,309 @@
+package data
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How transfers report their progress, set with --progress: a bar redrawn in
+// place, a line every --progress-interval for logs that aren't a terminal,
+// such as a pod's, or nothing until the summary. Progress goes to stderr,
+// leaving stdout to the summary, and auto picks the bar when stderr is a
+// terminal and lines otherwise.
+const (
+	progressAuto  = "auto"
+	progressBar   = "bar"
+	progressLines = "lines"
+	progressOff   = "off"
+)
+
+const (
+	defaultProgressInterval = 10 * time.Second
+	progressBarInterval     = 200 * time.Millisecond
+	progressBarWidth        = 30
+)
+
+var (
+	progressMode     = progressAuto
+	progressInterval = defaultProgressInterval
+)
+
+// checkProgressMode validates --progress
+func checkProgressMode() error {
+	switch progressMode {
+	case progressAuto, progressBar, progressLines, progressOff:
+		return nil
+	}
+	return fmt.Errorf("unknown progress mode %s, expected auto, bar, lines or off", progressMode)
+}
+
+// transferVerbs describe what each operation does to the files it counts
+var transferVerbs = map[string]string{
+	"get":    "Downloaded",
+	"commit": "Uploaded",
+	"cp":     "Copied",
+}
+
+// transferStats adds up the files a get, commit or cp transferred, or found
+// unchanged, reporting progress to status while it runs and a summary to out
+// at the end.
+type transferStats struct {
+	operation string
+	started   time.Time
+	out       io.Writer
+	status    io.Writer
+
+	// expectedFiles and expectedBytes are what is known so far of the work
+	// to do, which may grow as more files are found
+	expectedFiles int64
+	expectedBytes int64
+	files         int64
+	bytes         int64
+	skipped       int64
+	skippedBytes  int64
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// transferSummary is printed as JSON once a transfer completes
+type transferSummary struct {
+	Operation      string  `json:"operation"`
+	Files          int64   `json:"files"`
+	Bytes          int64   `json:"bytes"`
+	Skipped        int64   `json:"skipped"`
+	SkippedBytes   int64   `json:"skipped_bytes"`
+	Seconds        float64 `json:"seconds"`
+	BytesPerSecond int64   `json:"bytes_per_second"`
+}
+
+func newTransferStats(operation string) *transferStats {
+	return &transferStats{
+		operation: operation,
+		started:   time.Now(),
+		out:       os.Stdout,
+		status:    os.Stderr,
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+// expect adds files to the work to do
+func (s *transferStats) expect(files int64, size int64) {
+	atomic.AddInt64(&s.expectedFiles, files)
+	atomic.AddInt64(&s.expectedBytes, size)
+}
+
+// transferred counts a file transferred
+func (s *transferStats) transferred(size int64) {
+	atomic.AddInt64(&s.files, 1)
+	atomic.AddInt64(&s.bytes, size)
+}
+
+// unchanged counts a file that didn't need transferring
+func (s *transferStats) unchanged(size int64) {
+	atomic.AddInt64(&s.skipped, 1)
+	atomic.AddInt64(&s.skippedBytes, size)
+}
+
+// fileProgress counts the bytes of a file as they stream, so progress moves
+// along during large files rather than once each completes.
+type fileProgress struct {
+	stats   *transferStats
+	counted int64
+}
+
+// track starts counting the bytes of a file
+func (s *transferStats) track() *fileProgress {
+	return &fileProgress{stats: s}
+}
+
+func (p *fileProgress) add(n int64) {
+	atomic.AddInt64(&p.counted, n)
+	atomic.AddInt64(&p.stats.bytes, n)
+}
+
+// reader counts what is read through r. A nil fileProgress counts nothing.
+func (p *fileProgress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, progress: p}
+}
+
+// rewind takes back what was counted past the first n bytes, when a failed
+// attempt is retried from n, 0 unless it carries on from what was kept.
+func (p *fileProgress) rewind(n int64) {
+	if p != nil {
+		p.add(n - atomic.LoadInt64(&p.counted))
+	}
+}
+
+// done counts files as transferred, size bytes all told whatever streamed
+// on the way, e.g. the compressed chunk they were packed in.
+func (p *fileProgress) done(files int64, size int64) {
+	atomic.AddInt64(&p.stats.files, files)
+	p.add(size - atomic.LoadInt64(&p.counted))
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress *fileProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.progress.add(int64(n))
+	return n, err
+}
+
+// summary returns the totals so far
+func (s *transferStats) summary() transferSummary {
+	elapsed := time.Since(s.started)
+	bytes := atomic.LoadInt64(&s.bytes)
+	return transferSummary{
+		Operation:      s.operation,
+		Files:          atomic.LoadInt64(&s.files),
+		Bytes:          bytes,
+		Skipped:        atomic.LoadInt64(&s.skipped),
+		SkippedBytes:   atomic.LoadInt64(&s.skippedBytes),
+		Seconds:        elapsed.Seconds(),
+		BytesPerSecond: int64(float64(bytes) / elapsed.Seconds()),
+	}
+}
+
+func (s *transferStats) String() string {
+	sum := s.summary()
+	summary := fmt.Sprintf("%s %d files (%s) in %v, %s/s",
+		transferVerbs[s.operation], sum.Files, formatBytes(sum.Bytes),
+		time.Since(s.started).Round(time.Millisecond), formatBytes(sum.BytesPerSecond))
+	if sum.Skipped > 0 {
+		summary += fmt.Sprintf(", skipped %d unchanged files", sum.Skipped)
+	}
+	return summary
+}
+
+// progress describes how far along the transfer is, with an estimate of the
+// time left once there is something to go by.
+func (s *transferStats) progress() string {
+	sum := s.summary()
+	expectedFiles := atomic.LoadInt64(&s.expectedFiles)
+	expectedBytes := atomic.LoadInt64(&s.expectedBytes)
+
+	line := fmt.Sprintf("%s %d/%d files, %s/%s, %s/s",
+		transferVerbs[s.operation], sum.Files+sum.Skipped, expectedFiles,
+		formatBytes(sum.Bytes+sum.SkippedBytes), formatBytes(expectedBytes),
+		formatBytes(sum.BytesPerSecond))
+	if remaining := expectedBytes - sum.Bytes - sum.SkippedBytes; remaining > 0 && sum.BytesPerSecond > 0 {
+		eta := time.Duration(float64(remaining) / float64(sum.BytesPerSecond) * float64(time.Second))
+		line += fmt.Sprintf(", ETA %v", eta.Round(time.Second))
+	}
+	return line
+}
+
+// bar draws the share of the bytes to transfer done so far
+func (s *transferStats) bar() string {
+	done := atomic.LoadInt64(&s.bytes) + atomic.LoadInt64(&s.skippedBytes)
+	total := atomic.LoadInt64(&s.expectedBytes)
+	if total == 0 {
+		done, total = atomic.LoadInt64(&s.files)+atomic.LoadInt64(&s.skipped), atomic.LoadInt64(&s.expectedFiles)
+	}
+
+	filled := 0
+	if total > 0 {
+		filled = int(done * progressBarWidth / total)
+	}
+	if filled > progressBarWidth {
+		filled = progressBarWidth
+	}
+	return "[" + strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled) + "] " + s.progress()
+}
+
+// start reports progress in the background until finish or halt is called
+func (s *transferStats) start() {
+	mode := progressMode
+	if mode == progressAuto {
+		mode = progressLines
+		if isTerminal(s.status) {
+			mode = progressBar
+		}
+	}
+	if mode == progressOff {
+		close(s.stopped)
+		return
+	}
+
+	interval := progressInterval
+	if mode == progressBar {
+		interval = progressBarInterval
+	}
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		width := 0
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.stop:
+				if mode == progressBar && width > 0 {
+					fmt.Fprintf(s.status, "\r%-*s\n", width, s.bar())
+				}
+				return
+			}
+
+			if mode == progressLines {
+				fmt.Fprintln(s.status, s.progress())
+				continue
+			}
+			// pads over whatever is left of a longer line drawn before
+			line := s.bar()
+			fmt.Fprintf(s.status, "\r%-*s", width, line)
+			if len(line) > width {
+				width = len(line)
+			}
+		}
+	}()
+}
+
+// halt stops reporting progress, e.g. once the transfer failed
+func (s *transferStats) halt() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.stopped
+}
+
+// finish stops reporting progress and prints the summary, in words and as a
+// line of JSON for whatever reads the logs.
+func (s *transferStats) finish() {
+	s.halt()
+	fmt.Fprintln(s.out, s)
+
+	data, err := json.Marshal(s.summary())
+	if err == nil {
+		fmt.Fprintln(s.out, string(data))
+	}
+}
+
+// isTerminal reports whether w is a terminal rather than a file or pipe
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
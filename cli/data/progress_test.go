@@ -0,0 +1,164 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestTransferProgress(t *testing.T) {
+	stats := newTransferStats("get")
+	stats.started = time.Now().Add(-2 * time.Second)
+	stats.expect(4, 10*1024*1024)
+	stats.transferred(3 * 1024 * 1024)
+	stats.transferred(1024 * 1024)
+	stats.unchanged(2 * 1024 * 1024)
+
+	progress := stats.progress()
+	if !strings.HasPrefix(progress, "Downloaded 3/4 files, 6.0 MB/10.0 MB, 2.0 MB/s, ETA 2s") {
+		t.Errorf("Progress was incorrect, got: %s", progress)
+	}
+	if bar := stats.bar(); !strings.HasPrefix(bar, "["+strings.Repeat("=", 18)+strings.Repeat(" ", 12)+"] Downloaded") {
+		t.Errorf("It should fill the bar with the share of bytes done, got: %s", bar)
+	}
+}
+
+func TestFileProgress(t *testing.T) {
+	stats := newTransferStats("get")
+	progress := stats.track()
+
+	ioutil.ReadAll(io.LimitReader(progress.reader(strings.NewReader("0123456789")), 6))
+	if sum := stats.summary(); sum.Bytes != 6 || sum.Files != 0 {
+		t.Errorf("It should count bytes as they are read, got: %+v", sum)
+	}
+	progress.rewind(2)
+	if sum := stats.summary(); sum.Bytes != 2 {
+		t.Errorf("It should take back what a retry transfers again, got: %d bytes", sum.Bytes)
+	}
+	progress.done(1, 10)
+	if sum := stats.summary(); sum.Bytes != 10 || sum.Files != 1 {
+		t.Errorf("It should count the whole file once done, got: %+v", sum)
+	}
+
+	var none *fileProgress
+	if r := strings.NewReader("0123"); none.reader(r) != r {
+		t.Error("It should not count anything without a fileProgress")
+	}
+}
+
+// flakyPutStorage fails the first puts part way through the body
+type flakyPutStorage struct {
+	Storage
+	failures int
+}
+
+func (s *flakyPutStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	if s.failures > 0 {
+		s.failures--
+		body.Read(make([]byte, 3))
+		return errors.New("connection reset")
+	}
+	return s.Storage.Put(ctx, key, body)
+}
+
+func TestUploadFileProgress(t *testing.T) {
+	retrySleep = noSleep
+	AppFs = afero.NewMemMapFs()
+	afero.WriteFile(AppFs, "src/a", []byte("0123456789"), 0644)
+
+	stats := newTransferStats("commit")
+	progress := stats.track()
+	storage := &flakyPutStorage{Storage: memStorage(map[string]string{}), failures: 2}
+	if err := uploadFile(context.Background(), storage, "model/a", "src/a", progress); err != nil {
+		t.Fatalf("It should upload once the puts stop failing, but %v", err)
+	}
+	if sum := stats.summary(); sum.Bytes != 10 || sum.Files != 0 {
+		t.Errorf("It should count the bytes uploaded once despite retries, got: %+v", sum)
+	}
+	progress.done(1, 10)
+	if sum := stats.summary(); sum.Bytes != 10 || sum.Files != 1 {
+		t.Errorf("It should count the file once done, got: %+v", sum)
+	}
+}
+
+func TestTransferProgressLines(t *testing.T) {
+	defer func(mode string, interval time.Duration) {
+		progressMode, progressInterval = mode, interval
+	}(progressMode, progressInterval)
+	progressMode, progressInterval = progressLines, 10*time.Millisecond
+
+	var out, status bytes.Buffer
+	stats := newTransferStats("commit")
+	stats.out, stats.status = &out, &status
+	stats.expect(2, 2048)
+	stats.start()
+	stats.transferred(1024)
+	time.Sleep(50 * time.Millisecond)
+	stats.transferred(1024)
+	stats.finish()
+
+	if !strings.HasPrefix(status.String(), "Uploaded 1/2 files") {
+		t.Errorf("It should report progress periodically, got: %q", status.String())
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 || !strings.HasPrefix(lines[0], "Uploaded 2 files (2.0 KB)") {
+		t.Fatalf("It should print only the summary to out, got: %q", out.String())
+	}
+
+	var summary transferSummary
+	err := json.Unmarshal([]byte(lines[len(lines)-1]), &summary)
+	if err != nil || summary.Operation != "commit" || summary.Files != 2 || summary.Bytes != 2048 {
+		t.Errorf("It should end with a JSON summary, got: %+v (%v)", summary, err)
+	}
+}
+
+func TestTransferProgressOff(t *testing.T) {
+	defer func(mode string) { progressMode = mode }(progressMode)
+	progressMode = progressOff
+
+	var out, status bytes.Buffer
+	stats := newTransferStats("cp")
+	stats.out, stats.status = &out, &status
+	stats.start()
+	stats.halt()
+	stats.halt()
+	if out.Len() != 0 || status.Len() != 0 {
+		t.Errorf("It should not report anything when halted, got: %q", out.String())
+	}
+}
+
+func TestTransferProgressAuto(t *testing.T) {
+	defer func(mode string, interval time.Duration) {
+		progressMode, progressInterval = mode, interval
+	}(progressMode, progressInterval)
+	progressMode, progressInterval = progressAuto, 10*time.Millisecond
+
+	var status bytes.Buffer
+	stats := newTransferStats("get")
+	stats.out, stats.status = ioutil.Discard, &status
+	stats.start()
+	time.Sleep(30 * time.Millisecond)
+	stats.halt()
+	if strings.Contains(status.String(), "[") || !strings.HasPrefix(status.String(), "Downloaded 0/0 files") {
+		t.Errorf("It should report lines when status isn't a terminal, got: %q", status.String())
+	}
+}
+
+func TestCheckProgressMode(t *testing.T) {
+	defer func(mode string) { progressMode = mode }(progressMode)
+
+	for mode, valid := range map[string]bool{"auto": true, "bar": true, "lines": true, "off": true, "verbose": false} {
+		progressMode = mode
+		if err := checkProgressMode(); (err == nil) != valid {
+			t.Errorf("Expected %s to be valid: %v, got: %v", mode, valid, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// tagPrefix marks a commit given by the name of a tag, as in tag:release-1
+const tagPrefix = "tag:"
+
+// tagsFolder holds the tags of a branch, next to its HEAD
+const tagsFolder = "tags"
+
+// tagRecord is what a tag stores: the commit it names and who named it
+type tagRecord struct {
+	Commit    string    `json:"commit"`
+	Created   time.Time `json:"created"`
+	Committer string    `json:"committer"`
+}
+
+// resolveCommit returns the path of the commit source refers to, which ends
+// in a commit, HEAD or tag:<name> of a branch.
+func resolveCommit(ctx context.Context, storage Storage, source S3Path) (string, error) {
+	name := source.Basename()
+	switch {
+	case name == "HEAD":
+		head, err := headTarget(ctx, storage, source.Dirname())
+		if err != nil {
+			return "", errors.Wrapf(err, "reading %s", source.path)
+		}
+		if head == "" {
+			return "", fmt.Errorf("%s not found", source.path)
+		}
+		return head, nil
+	case strings.HasPrefix(name, tagPrefix):
+		tag, err := readTag(ctx, storage, source.Dirname(), strings.TrimPrefix(name, tagPrefix))
+		if err != nil {
+			return "", err
+		}
+		if tag == nil {
+			return "", fmt.Errorf("tag %s not found on %s", strings.TrimPrefix(name, tagPrefix), source.Dirname())
+		}
+		return tag.Commit, nil
+	}
+	return strings.TrimSuffix(source.path, "/"), nil
+}
+
+func tagKey(branchPath string, name string) string {
+	return branchPath + "/" + tagsFolder + "/" + name
+}
+
+// readTag returns a tag of a branch, or nil if there is no such tag
+func readTag(ctx context.Context, storage Storage, branchPath string, name string) (*tagRecord, error) {
+	contents, found, err := readObjectIfExists(ctx, storage, tagKey(branchPath, name))
+	if err != nil || !found {
+		return nil, err
+	}
+
+	tag := &tagRecord{}
+	if err := json.Unmarshal(contents, tag); err != nil {
+		return nil, errors.Wrapf(err, "parsing tag %s", name)
+	}
+	return tag, nil
+}
+
+// commitFolderPatterns match the folders of each level of a commit's path
+// below its branch, as created by generateRootKey.
+var commitFolderPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^\d{4}$`),
+	regexp.MustCompile(`^\d{2}$`),
+	regexp.MustCompile(`^\d{2}$`),
+	regexp.MustCompile(`^\d{2}$`),
+	regexp.MustCompile(`^\d{2}_[a-zA-Z0-9]+$`),
+}
+
+// parseAsOf parses the time given to --as-of: RFC 3339, or a UTC date and
+// time to the minute, or just a date, meaning the start of that day in UTC.
+func parseAsOf(value string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s, expected e.g. 2019-03-03T12:00:00Z or 2019-03-03", value)
+}
+
+// commitAsOf returns the commit HEAD of a branch pointed to at asOf. Where
+// HEAD.log covers that time it is replayed, so rollbacks and promotions are
+// taken into account. Otherwise it returns the newest completed commit made
+// at or before asOf, going by the UTC minute commits are named after.
+func commitAsOf(ctx context.Context, storage Storage, branchPath string, asOf time.Time) (string, error) {
+	commit, known, err := headLogAsOf(ctx, storage, branchPath, asOf)
+	if err != nil {
+		return "", err
+	}
+	if !known {
+		limit := strings.Split(asOf.UTC().Format("2006/01/02/15/04"), "/")
+		commit, err = latestCommitFolder(ctx, storage, branchPath+"/", limit, 0, true)
+		if err != nil {
+			return "", err
+		}
+	}
+	if commit == "" {
+		return "", fmt.Errorf("no commit on %s as of %s", branchPath, asOf.UTC().Format(time.RFC3339))
+	}
+	return commit, nil
+}
+
+// headLogAsOf replays HEAD.log up to asOf, returning what HEAD pointed to
+// then, and whether the log tells. It doesn't for branches committed to
+// before HEAD.log was kept, as of times before their first entry.
+func headLogAsOf(ctx context.Context, storage Storage, branchPath string, asOf time.Time) (string, bool, error) {
+	entries, err := readHeadLog(ctx, storage, branchPath)
+	if err != nil || len(entries) == 0 {
+		return "", false, err
+	}
+
+	// A branch whose log starts from no HEAD had no commit before then
+	head, known := "", entries[0].Previous == ""
+	for _, entry := range entries {
+		if entry.Time.After(asOf) {
+			break
+		}
+		head, known = entry.Target, true
+	}
+	return head, known, nil
+}
+
+// latestCommitFolder walks down the year/month/day/hour folders below prefix
+// newest first, rather than listing every commit, returning the newest commit
+// at or before limit that has a manifest. Commits without one were never
+// completed.
+func latestCommitFolder(ctx context.Context, storage Storage, prefix string, limit []string, depth int, bounded bool) (string, error) {
+	names, err := storage.ListPrefixes(ctx, prefix)
+	if err != nil {
+		return "", err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	for _, name := range names {
+		if !commitFolderPatterns[depth].MatchString(name) {
+			continue
+		}
+		value := name
+		if depth == len(commitFolderPatterns)-1 {
+			value = name[:2]
+		}
+		if bounded && value > limit[depth] {
+			continue
+		}
+		if depth == len(commitFolderPatterns)-1 {
+			complete, err := objectExists(ctx, storage, prefix+name+"/"+manifestFile)
+			if err != nil {
+				return "", err
+			}
+			if complete {
+				return prefix + name, nil
+			}
+			continue
+		}
+
+		commit, err := latestCommitFolder(ctx, storage, prefix+name+"/", limit, depth+1, bounded && value == limit[depth])
+		if err != nil || commit != "" {
+			return commit, err
+		}
+	}
+	return "", nil
+}
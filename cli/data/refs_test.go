@@ -0,0 +1,86 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseAsOf(t *testing.T) {
+	for value, expected := range map[string]time.Time{
+		"2019-03-03T12:30:00Z":      time.Date(2019, 3, 3, 12, 30, 0, 0, time.UTC),
+		"2019-03-03T13:30:00+01:00": time.Date(2019, 3, 3, 12, 30, 0, 0, time.UTC),
+		"2019-03-03T12:30":          time.Date(2019, 3, 3, 12, 30, 0, 0, time.UTC),
+		"2019-03-03":                time.Date(2019, 3, 3, 0, 0, 0, 0, time.UTC),
+	} {
+		parsed, err := parseAsOf(value)
+		if err != nil || !parsed.Equal(expected) {
+			t.Errorf("%s should parse as %v, got: %v (%v)", value, expected, parsed, err)
+		}
+	}
+	if _, err := parseAsOf("yesterday"); err == nil {
+		t.Error("It should reject invalid times")
+	}
+}
+
+func TestCommitAsOf(t *testing.T) {
+	storage := memStorage(map[string]string{
+		"model/v1/master/HEAD":                                   "model/v1/master/2019/03/04/09/00_DdD",
+		"model/v1/master/tags/release":                           `{"commit":"model/v1/master/2019/03/04/09/00_DdD"}`,
+		"model/v1/master/2019/02/28/23/59_AaA/MANIFEST.json":     "{}",
+		"model/v1/master/2019/03/02/10/15_BbB/MANIFEST.json":     "{}",
+		"model/v1/master/2019/03/02/18/40_CcC/MANIFEST.json":     "{}",
+		"model/v1/master/2019/03/04/09/00_DdD/MANIFEST.json":     "{}",
+		"model/v1/experiment/2019/03/01/00/00_EeE/MANIFEST.json": "{}",
+		"model/v1/master/2019/03/03/12/30_Xx/notcommit":          "",
+	})
+
+	for asOf, expected := range map[time.Time]string{
+		time.Date(2019, 3, 3, 0, 0, 0, 0, time.UTC):   "model/v1/master/2019/03/02/18/40_CcC",
+		time.Date(2019, 3, 2, 18, 40, 0, 0, time.UTC): "model/v1/master/2019/03/02/18/40_CcC",
+		time.Date(2019, 3, 2, 18, 39, 0, 0, time.UTC): "model/v1/master/2019/03/02/10/15_BbB",
+		time.Date(2019, 3, 1, 0, 0, 0, 0, time.UTC):   "model/v1/master/2019/02/28/23/59_AaA",
+		time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC):   "model/v1/master/2019/03/04/09/00_DdD",
+		time.Date(2019, 3, 3, 12, 30, 0, 0, time.UTC): "model/v1/master/2019/03/02/18/40_CcC",
+	} {
+		commit, err := commitAsOf(context.Background(), storage, "model/v1/master", asOf)
+		if err != nil || commit != expected {
+			t.Errorf("As of %v it should pick %s, got: %s (%v)", asOf, expected, commit, err)
+		}
+	}
+
+	_, err := commitAsOf(context.Background(), storage, "model/v1/master", time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+	if err == nil {
+		t.Error("It should return an error when there was no commit yet")
+	}
+}
+
+func TestCommitAsOfReplaysHeadLog(t *testing.T) {
+	storage := memStorage(map[string]string{
+		"model/v1/master/HEAD": "model/v1/master/2019/03/02/18/40_CcC",
+		"model/v1/master/HEAD.log": `{"time":"2019-03-01T09:00:00Z","action":"commit","previous":"model/v1/master/2019/02/28/23/59_AaA","new":"model/v1/master/2019/03/01/09/00_BbB"}
+{"time":"2019-03-02T18:40:00Z","action":"commit","previous":"model/v1/master/2019/03/01/09/00_BbB","new":"model/v1/master/2019/03/02/18/40_CcC"}
+{"time":"2019-03-03T10:00:00Z","action":"rollback","previous":"model/v1/master/2019/03/02/18/40_CcC","new":"model/v1/master/2019/03/01/09/00_BbB"}
+`,
+		"model/v1/master/2019/02/28/23/59_AaA/MANIFEST.json": "{}",
+		"model/v1/master/2019/02/28/20/00_ZzZ/MANIFEST.json": "{}",
+	})
+
+	for asOf, expected := range map[time.Time]string{
+		time.Date(2019, 3, 2, 0, 0, 0, 0, time.UTC):   "model/v1/master/2019/03/01/09/00_BbB",
+		time.Date(2019, 3, 3, 0, 0, 0, 0, time.UTC):   "model/v1/master/2019/03/02/18/40_CcC",
+		time.Date(2019, 3, 4, 0, 0, 0, 0, time.UTC):   "model/v1/master/2019/03/01/09/00_BbB",
+		time.Date(2019, 2, 28, 21, 0, 0, 0, time.UTC): "model/v1/master/2019/02/28/20/00_ZzZ",
+	} {
+		commit, err := commitAsOf(context.Background(), storage, "model/v1/master", asOf)
+		if err != nil || commit != expected {
+			t.Errorf("As of %v it should pick %s, got: %s (%v)", asOf, expected, commit, err)
+		}
+	}
+
+	putObject(context.Background(), storage, "model/v1/experiment/HEAD.log", []byte(`{"time":"2019-03-01T09:00:00Z","action":"create","previous":"","new":"model/v1/master/2019/03/01/09/00_BbB"}`))
+	_, err := commitAsOf(context.Background(), storage, "model/v1/experiment", time.Date(2019, 2, 1, 0, 0, 0, 0, time.UTC))
+	if err == nil {
+		t.Error("It should return an error before the branch was created")
+	}
+}
@@ -0,0 +1,86 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// retryPolicy is how gets and puts are retried: up to attempts times, waiting
+// a random delay between zero and a cap that starts at baseDelay and doubles
+// after every attempt, up to maxDelay.
+type retryPolicy struct {
+	attempts  int
+	baseDelay time.Duration
+	maxDelay  time.Duration
+}
+
+const defaultRetryAttempts = 10
+
+var transferRetries = retryPolicy{
+	attempts:  defaultRetryAttempts,
+	baseDelay: 500 * time.Millisecond,
+	maxDelay:  30 * time.Second,
+}
+
+// retrySleep waits between attempts. It is replaced in tests so they don't
+// have to wait.
+var retrySleep = sleep
+
+// sleep waits for the given delay unless ctx is cancelled first
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// do calls fn until it succeeds, fails with an error that trying again won't
+// fix, runs out of attempts or ctx is cancelled. action describes fn in log
+// messages, e.g. "fetching some/key".
+func (p retryPolicy) do(ctx context.Context, action string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil || !isRetryable(err) {
+			return err
+		}
+		if attempt >= p.attempts {
+			return errors.Wrapf(err, "giving up after %d attempts", attempt)
+		}
+
+		delay := p.backoff(attempt)
+		fmt.Fprintf(os.Stderr, "Error %s (%v); will retry in %v...\n", action, err, delay)
+		if err := retrySleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// backoff returns how long to wait after the given attempt. The delay is
+// picked at random up to the cap, so parallel transfers failing together
+// don't all retry at the same time.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	limit := p.baseDelay
+	for i := 1; i < attempt && limit < p.maxDelay; i++ {
+		limit *= 2
+	}
+	if limit > p.maxDelay {
+		limit = p.maxDelay
+	}
+	if limit <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(limit) + 1))
+}
@@ -0,0 +1,111 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func noSleep(context.Context, time.Duration) error {
+	return nil
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := retryPolicy{attempts: 10, baseDelay: time.Second, maxDelay: 10 * time.Second}
+	limits := map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 5: 10 * time.Second, 30: 10 * time.Second}
+
+	for attempt, limit := range limits {
+		for i := 0; i < 100; i++ {
+			if delay := policy.backoff(attempt); delay < 0 || delay > limit {
+				t.Errorf("Delay after attempt %d was incorrect, got: %v, want at most: %v.", attempt, delay, limit)
+			}
+		}
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	var delays []time.Duration
+	retrySleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	policy := retryPolicy{attempts: 3, baseDelay: time.Millisecond, maxDelay: time.Second}
+
+	calls := 0
+	err := policy.do(context.Background(), "testing", func() error {
+		calls++
+		return errors.New("connection reset")
+	})
+	if err == nil || !strings.Contains(err.Error(), "giving up after 3 attempts: connection reset") {
+		t.Errorf("It should give up, got: %v", err)
+	}
+	if calls != 3 || len(delays) != 2 {
+		t.Errorf("It should try 3 times, got: %d calls and %d sleeps", calls, len(delays))
+	}
+}
+
+func TestRetryUntilSuccess(t *testing.T) {
+	retrySleep = noSleep
+	policy := retryPolicy{attempts: 5, baseDelay: time.Millisecond, maxDelay: time.Second}
+
+	calls := 0
+	err := policy.do(context.Background(), "testing", func() error {
+		calls++
+		if calls < 3 {
+			return errors.New("slow down")
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("It should succeed on the third attempt, got: %d calls (%v)", calls, err)
+	}
+}
+
+func TestRetryStopsOnPermanentErrors(t *testing.T) {
+	retrySleep = noSleep
+	s3 := &s3Storage{}
+
+	permanent := []error{
+		&notFoundError{"key"},
+		s3.translate("key", awserr.New("NoSuchKey", "missing", nil)),
+		s3.translate("key", awserr.New("AccessDenied", "denied", nil)),
+		s3.translate("key", awserr.New("NoSuchBucket", "missing", nil)),
+	}
+	for _, failure := range permanent {
+		calls := 0
+		err := transferRetries.do(context.Background(), "testing", func() error {
+			calls++
+			return failure
+		})
+		if err != failure || calls != 1 {
+			t.Errorf("It should fail straight away on %v, got: %d calls (%v)", failure, calls, err)
+		}
+	}
+
+	if !isRetryable(s3.translate("key", awserr.New("SlowDown", "throttled", nil))) {
+		t.Error("It should retry when throttled")
+	}
+}
+
+func TestRetryStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	policy := retryPolicy{attempts: 5, baseDelay: time.Hour, maxDelay: time.Hour}
+	retrySleep = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+
+	calls := 0
+	err := policy.do(ctx, "testing", func() error {
+		calls++
+		return errors.New("connection reset")
+	})
+	if err != context.Canceled || calls != 1 {
+		t.Errorf("It should stop retrying once cancelled, got: %d calls (%v)", calls, err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	rollbackBranch string
+	rollbackBucket string
+	rollbackTo     string
+	rollbackSteps  int
+	rollbackForce  bool
+)
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback [step/version]",
+	Short: "Move HEAD back to an earlier commit",
+	Args:  cobra.ExactArgs(1),
+	Long: `Point the HEAD of a branch back to an earlier commit.
+
+By default HEAD goes back to what it pointed to before its last update, as
+recorded in HEAD.log; --steps goes further back in that history. Rollbacks
+undo updates rather than count as ones, so rolling back twice goes back two
+commits. A specific commit can be given with --to instead.
+
+Example:
+
+$ paddle data rollback -b experimental trained-model/version1
+$ paddle data rollback -b experimental --steps 3 trained-model/version1
+$ paddle data rollback -b experimental --to 2019/03/01/12/30_AbC123XyZ0 trained-model/version1
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if rollbackBucket == "" {
+			rollbackBucket = viper.GetString("bucket")
+		}
+		if rollbackBucket == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+		if rollbackTo != "" && cmd.Flags().Changed("steps") {
+			exitErrorf("Use either --to or --steps, not both")
+		}
+		if rollbackSteps < 1 {
+			exitErrorf("--steps must be at least 1")
+		}
+
+		branchPath := fmt.Sprintf("%s/%s", args[0], rollbackBranch)
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		storage, err := openStorage(rollbackBucket)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		current, err := headTarget(ctx, storage, branchPath)
+		if err != nil {
+			exitErrorf("Unable to read %s/HEAD: %v", branchPath, err)
+		}
+
+		target, err := rollbackTarget(ctx, storage, branchPath, current, rollbackTo, rollbackSteps)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		err = updateHead(ctx, storage, branchPath, target, current, rollbackForce, "rollback")
+		if _, logFailed := err.(*headLogError); logFailed {
+			exitErrorf("%v", err)
+		}
+		if err != nil {
+			exitErrorf("Unable to update HEAD: %v", err)
+		}
+		fmt.Printf("%s/HEAD: %s -> %s\n", branchPath, describeHead(current), target)
+	},
+}
+
+func init() {
+	rollbackCmd.Flags().StringVarP(&rollbackBranch, "branch", "b", "master", "Branch to work on")
+	rollbackCmd.Flags().StringVar(&rollbackBucket, "bucket", "", "Bucket to use")
+	rollbackCmd.Flags().StringVar(&rollbackTo, "to", "", "Commit to point HEAD to")
+	rollbackCmd.Flags().IntVar(&rollbackSteps, "steps", 1, "Number of HEAD updates to go back")
+	rollbackCmd.Flags().BoolVar(&rollbackForce, "force", false, "Update HEAD even if the branch is locked")
+}
+
+// rollbackTarget works out the commit HEAD should go back to, either the one
+// given explicitly or the one it pointed to the given number of updates ago.
+func rollbackTarget(ctx context.Context, storage Storage, branchPath string, current string, to string, steps int) (string, error) {
+	var target string
+
+	if to != "" {
+		target = qualifyHead(branchPath, to)
+		found, err := hasObjects(ctx, storage, target+"/")
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return "", fmt.Errorf("commit %s not found", target)
+		}
+	} else {
+		history, err := readHeadLog(ctx, storage, branchPath)
+		if err != nil {
+			return "", err
+		}
+		if len(history) == 0 {
+			return "", fmt.Errorf("no HEAD history recorded for %s, use --to with a commit listed by 'paddle data ls'", branchPath)
+		}
+		if steps > len(history) {
+			return "", fmt.Errorf("HEAD of %s was only updated %d times", branchPath, len(history))
+		}
+		heads := headHistory(history, current)
+		if steps >= len(heads) {
+			return "", fmt.Errorf("%s had no HEAD %d updates ago", branchPath, steps)
+		}
+		target = heads[len(heads)-1-steps]
+	}
+
+	if target == current {
+		return "", fmt.Errorf("HEAD of %s already points to %s", branchPath, target)
+	}
+	return target, nil
+}
+
+// headHistory replays HEAD.log into the commits HEAD has pointed to, oldest
+// first and ending with current. A rollback takes back the updates since
+// the commit it went back to instead of adding to the history.
+func headHistory(log []headLogEntry, current string) []string {
+	var heads []string
+	for _, entry := range log {
+		if len(heads) == 0 && entry.Previous != "" {
+			heads = append(heads, entry.Previous)
+		}
+		if entry.Action == "rollback" {
+			for i := len(heads) - 1; i >= 0; i-- {
+				if heads[i] == entry.Target {
+					heads = heads[:i]
+					break
+				}
+			}
+		}
+		heads = append(heads, entry.Target)
+	}
+	if len(heads) == 0 || heads[len(heads)-1] != current {
+		heads = append(heads, current)
+	}
+	return heads
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+var rollbackObjects = map[string]string{
+	"model/v1/master/HEAD": "model/v1/master/c",
+	"model/v1/master/HEAD.log": `{"action":"commit","previous":"","new":"model/v1/master/a"}
+{"action":"commit","previous":"model/v1/master/a","new":"model/v1/master/b"}
+{"action":"commit","previous":"model/v1/master/b","new":"model/v1/master/c"}
+`,
+	"model/v1/master/a/file": "a",
+	"model/v1/master/b/file": "b",
+	"model/v1/master/c/file": "c",
+}
+
+func TestRollbackTargetSteps(t *testing.T) {
+	bucket := memStorage(rollbackObjects)
+
+	target, err := rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/c", "", 1)
+	if err != nil || target != "model/v1/master/b" {
+		t.Errorf("It should roll back to b, got: %s (%v)", target, err)
+	}
+
+	target, err = rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/c", "", 2)
+	if err != nil || target != "model/v1/master/a" {
+		t.Errorf("It should roll back to a, got: %s (%v)", target, err)
+	}
+
+	_, err = rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/c", "", 3)
+	if err == nil || !strings.Contains(err.Error(), "had no HEAD 3 updates ago") {
+		t.Errorf("It should not roll back past the first commit, got: %v", err)
+	}
+
+	_, err = rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/c", "", 4)
+	if err == nil {
+		t.Error("It should return an error")
+	}
+}
+
+func TestRollbackTargetTo(t *testing.T) {
+	bucket := memStorage(rollbackObjects)
+
+	target, err := rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/c", "a", 1)
+	if err != nil || target != "model/v1/master/a" {
+		t.Errorf("It should roll back to a, got: %s (%v)", target, err)
+	}
+
+	_, err = rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/c", "d", 1)
+	if err == nil || err.Error() != "commit model/v1/master/d not found" {
+		t.Errorf("It should not roll back to a missing commit, got: %v", err)
+	}
+
+	_, err = rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/c", "c", 1)
+	if err == nil {
+		t.Error("It should not roll back to the current HEAD")
+	}
+}
+
+func TestRollbackRecordsHistory(t *testing.T) {
+	bucket := memStorage(rollbackObjects)
+
+	err := updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/b", "model/v1/master/c", false, "rollback")
+	if err != nil {
+		t.Fatalf("It should update HEAD, but %v", err)
+	}
+
+	history, err := readHeadLog(context.Background(), bucket, "model/v1/master")
+	if err != nil || len(history) != 4 {
+		t.Fatalf("Expected four history entries, got: %v (%v)", history, err)
+	}
+
+	last := history[3]
+	if last.Action != "rollback" || last.Previous != "model/v1/master/c" || last.Target != "model/v1/master/b" || last.Committer == "" {
+		t.Errorf("Unexpected history entry: %+v", last)
+	}
+}
+
+func TestRollbackTwiceInARow(t *testing.T) {
+	bucket := memStorage(rollbackObjects)
+
+	for _, expected := range []string{"model/v1/master/b", "model/v1/master/a"} {
+		current, _ := headTarget(context.Background(), bucket, "model/v1/master")
+		target, err := rollbackTarget(context.Background(), bucket, "model/v1/master", current, "", 1)
+		if err != nil || target != expected {
+			t.Fatalf("It should roll back from %s to %s, got: %s (%v)", current, expected, target, err)
+		}
+		updateHead(context.Background(), bucket, "model/v1/master", target, current, false, "rollback")
+	}
+
+	_, err := rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/a", "", 1)
+	if err == nil {
+		t.Error("It should not roll back past the first commit")
+	}
+
+	// a commit after rolling back goes on from where HEAD was rolled back to
+	updateHead(context.Background(), bucket, "model/v1/master", "model/v1/master/d", "model/v1/master/a", false, "commit")
+	target, err := rollbackTarget(context.Background(), bucket, "model/v1/master", "model/v1/master/d", "", 1)
+	if err != nil || target != "model/v1/master/a" {
+		t.Errorf("It should roll back to a, got: %s (%v)", target, err)
+	}
+}
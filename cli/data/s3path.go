@@ -21,3 +21,9 @@ func (p *S3Path) Dirname() string {
 	}
 	return strings.Join(components[:len(components)-1], "/")
 }
+
+// NewS3Path returns the path to a key in a bucket, e.g. the
+// step/version/branch to commit to or the step/version/branch/HEAD to get.
+func NewS3Path(bucket string, path string) S3Path {
+	return S3Path{bucket: bucket, path: path}
+}
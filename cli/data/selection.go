@@ -0,0 +1,72 @@
+package data
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// selection picks the files of a commit to fetch: the exact keys given, if
+// any, narrowed down by include and exclude glob patterns.
+//
+// Patterns are matched against paths relative to the commit. Besides the
+// wildcards of path.Match, "**" matches any number of folders, and a pattern
+// matching a folder matches everything in it, so "debug" excludes debug/ and
+// "features/**/*.parquet" includes every parquet file under features/.
+type selection struct {
+	keys    []string
+	include []string
+	exclude []string
+}
+
+func newSelection(keys []string, include []string, exclude []string) (selection, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		for _, part := range strings.Split(pattern, "/") {
+			if _, err := path.Match(part, ""); err != nil {
+				return selection{}, fmt.Errorf("invalid pattern %s: %v", pattern, err)
+			}
+		}
+	}
+	return selection{keys: keys, include: include, exclude: exclude}, nil
+}
+
+// matches reports whether a file passes the include and exclude patterns
+func (s selection) matches(name string) bool {
+	if len(s.include) > 0 && !matchesAny(s.include, name) {
+		return false
+	}
+	return !matchesAny(s.exclude, name)
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(strings.Split(strings.Trim(pattern, "/"), "/"), strings.Split(name, "/")) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches the folders and name of a path against the parts of a
+// pattern. Running out of pattern first means the pattern matched a folder
+// the file is in.
+func matchGlob(pattern []string, parts []string) bool {
+	if len(pattern) == 0 {
+		return true
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(parts); i++ {
+			if matchGlob(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+		return false
+	}
+	return matchGlob(pattern[1:], parts[1:])
+}
@@ -0,0 +1,62 @@
+package data
+
+import (
+	"testing"
+)
+
+func TestSelectionMatches(t *testing.T) {
+	sel, err := newSelection(nil, []string{"features/**/*.parquet", "labels.csv"}, []string{"debug", "**/tmp_*"})
+	if err != nil {
+		t.Fatalf("It should accept the patterns, but %v", err)
+	}
+
+	cases := map[string]bool{
+		"features/a.parquet":            true,
+		"features/2019/03/b.parquet":    true,
+		"features/2019/tmp_c.parquet":   false,
+		"features/a.csv":                false,
+		"labels.csv":                    true,
+		"debug/labels.csv":              false,
+		"other/labels.csv":              false,
+		"features/debug/x.parquet":      true,
+		"debug/features/a.parquet":      false,
+		"features/2019/03/b.parquet.gz": false,
+	}
+
+	for name, expectation := range cases {
+		if sel.matches(name) != expectation {
+			t.Errorf("Match of %s was incorrect, got: %v, want: %v.", name, !expectation, expectation)
+		}
+	}
+}
+
+func TestSelectionWithoutPatterns(t *testing.T) {
+	sel, _ := newSelection(nil, nil, nil)
+	if !sel.matches("any/file") {
+		t.Error("It should select everything without patterns")
+	}
+}
+
+func TestSelectionInvalidPattern(t *testing.T) {
+	if _, err := newSelection(nil, []string{"features/[a"}, nil); err == nil {
+		t.Error("It should reject invalid patterns")
+	}
+}
+
+func TestFilterObjectsWithPatterns(t *testing.T) {
+	var (
+		s3Path  = S3Path{bucket: "bucket", path: "path/"}
+		objects = []*Object{{Key: "path/a.csv"}, {Key: "path/b.json"}, {Key: "path/debug/c.csv"}}
+		sel, _  = newSelection(nil, []string{"**/*.csv"}, []string{"debug"})
+	)
+
+	result, err := filterObjects(s3Path, objects, sel)
+	if err != nil || len(result) != 1 || result[0].Key != "path/a.csv" {
+		t.Errorf("It should filter objects by pattern, got: %v (%v)", result, err)
+	}
+
+	sel.keys = []string{"a.csv", "missing.csv"}
+	if _, err := filterObjects(s3Path, objects, sel); err == nil {
+		t.Error("It should still fail on missing keys")
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	showBranch     string
+	showBucket     string
+	showCommitPath string
+	showOutput     string
+)
+
+var showCmd = &cobra.Command{
+	Use:   "show [step/version]",
+	Short: "Show the metadata of a commit",
+	Args:  cobra.ExactArgs(1),
+	Long: `Show what a commit contains and where it came from: the pipeline, image and
+git commit that produced it, who made it and when, and its tags.
+
+Example:
+
+$ paddle data show trained-model/version1
+$ paddle data show -b experimental -p 2019/03/01/12/30_AbC123XyZ0 trained-model/version1
+$ paddle data show -p tag:release-2019-q1 trained-model/version1
+$ paddle data show -o json trained-model/version1
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if showBucket == "" {
+			showBucket = viper.GetString("bucket")
+		}
+		if showBucket == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+		if showOutput != "table" && showOutput != "json" {
+			exitErrorf("Unknown output format %s, expected table or json", showOutput)
+		}
+
+		source := S3Path{
+			bucket: showBucket,
+			path:   fmt.Sprintf("%s/%s/%s", args[0], showBranch, showCommitPath),
+		}
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		storage, err := openStorage(source.bucket)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		details, err := show(ctx, storage, source)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		if showOutput == "json" {
+			err = details.writeJSON(os.Stdout)
+		} else {
+			err = details.writeTable(os.Stdout)
+		}
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+	},
+}
+
+func init() {
+	showCmd.Flags().StringVarP(&showBranch, "branch", "b", "master", "Branch to work on")
+	showCmd.Flags().StringVar(&showBucket, "bucket", "", "Bucket to use")
+	showCmd.Flags().StringVarP(&showCommitPath, "path", "p", "HEAD", "Commit or tag:<name> to show (instead of HEAD)")
+	showCmd.Flags().StringVarP(&showOutput, "output", "o", "table", "Output format (table or json)")
+}
+
+type commitDetails struct {
+	Commit   string          `json:"commit"`
+	Files    int             `json:"files"`
+	Size     int64           `json:"size"`
+	Metadata *commitMetadata `json:"metadata,omitempty"`
+}
+
+// show describes the commit source refers to
+func show(ctx context.Context, storage Storage, source S3Path) (*commitDetails, error) {
+	commit, err := resolveCommit(ctx, storage, source)
+	if err != nil {
+		return nil, err
+	}
+	prefix := commit + "/"
+
+	details := &commitDetails{Commit: commit}
+
+	manifest, err := readManifest(ctx, storage, prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading manifest")
+	}
+	if manifest != nil {
+		for _, entry := range manifest.Files {
+			details.Files++
+			details.Size += entry.Size
+		}
+	} else {
+		// commits made before manifests were recorded
+		err = storage.List(ctx, prefix, func(objects []*Object) error {
+			for _, obj := range objects {
+				if !isReservedFile(strings.TrimPrefix(obj.Key, prefix)) {
+					details.Files++
+					details.Size += obj.Size
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if details.Files == 0 {
+			return nil, fmt.Errorf("%s not found", commit)
+		}
+	}
+
+	details.Metadata, err = readMetadata(ctx, storage, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return details, nil
+}
+
+func (d *commitDetails) writeJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(d)
+}
+
+func (d *commitDetails) writeTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "Commit:\t%s\n", d.Commit)
+	fmt.Fprintf(tw, "Files:\t%d (%s)\n", d.Files, formatBytes(d.Size))
+
+	m := d.Metadata
+	if m == nil {
+		fmt.Fprintln(tw, "No metadata was recorded for this commit")
+		return tw.Flush()
+	}
+	fields := []struct{ name, value string }{
+		{"Pipeline", m.Pipeline},
+		{"Image", m.Image},
+		{"Image digest", m.ImageDigest},
+		{"Git SHA", m.GitSHA},
+		{"Run ID", m.RunID},
+		{"Copied from", m.CopiedFrom},
+		{"Host", m.Host},
+		{"Committer", m.Committer},
+		{"Started", m.Started.Format(time.RFC3339)},
+		{"Finished", m.Finished.Format(time.RFC3339)},
+	}
+	for _, field := range fields {
+		if field.value != "" {
+			fmt.Fprintf(tw, "%s:\t%s\n", field.name, field.value)
+		}
+	}
+	if e := m.Encryption; e != nil {
+		fmt.Fprintf(tw, "Encryption:\t%s (%s %s)\n", e.Scheme, e.Provider, e.KeyID)
+	}
+	if len(m.Tags) > 0 {
+		fmt.Fprintf(tw, "Tags:\t%s\n", strings.Replace(formatTags(m.Tags), ",", " ", -1))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,54 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestShow(t *testing.T) {
+	storage := memStorage(map[string]string{
+		"model/v1/master/HEAD":                                        "model/v1/master/2019/03/01/12/30_AbC123XyZ0",
+		"model/v1/master/2019/03/01/12/30_AbC123XyZ0/a":               "aaa",
+		"model/v1/master/2019/03/01/12/30_AbC123XyZ0/" + manifestFile: `{"files":[{"path":"a","size":3}]}`,
+		"model/v1/master/2019/03/01/12/30_AbC123XyZ0/" + metadataFile: `{"pipeline":"training","committer":"jane@host","tags":{"a":"1"}}`,
+	})
+
+	details, err := show(context.Background(), storage, NewS3Path("bucket", "model/v1/master/HEAD"))
+	if err != nil {
+		t.Fatalf("It should show the commit, but %v", err)
+	}
+	if details.Commit != "model/v1/master/2019/03/01/12/30_AbC123XyZ0" || details.Files != 1 || details.Size != 3 {
+		t.Errorf("Unexpected details: %+v", details)
+	}
+
+	var out bytes.Buffer
+	details.writeTable(&out)
+	for _, line := range []string{"Pipeline:   training", "Committer:  jane@host", "Tags:       a=1"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected %q in output:\n%s", line, out.String())
+		}
+	}
+}
+
+func TestShowWithoutMetadata(t *testing.T) {
+	storage := memStorage(map[string]string{
+		"model/v1/master/2019/03/01/12/30_AbC123XyZ0/a": "aaa",
+	})
+
+	details, err := show(context.Background(), storage, NewS3Path("bucket", "model/v1/master/2019/03/01/12/30_AbC123XyZ0"))
+	if err != nil {
+		t.Fatalf("It should show the commit, but %v", err)
+	}
+	if details.Files != 1 || details.Metadata != nil {
+		t.Errorf("Unexpected details: %+v", details)
+	}
+}
+
+func TestShowMissingCommit(t *testing.T) {
+	_, err := show(context.Background(), memStorage(map[string]string{}), NewS3Path("bucket", "model/v1/master/HEAD"))
+	if err == nil {
+		t.Error("It should return an error")
+	}
+}
@@ -0,0 +1,227 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+// Storage is where commits, HEADs and everything else the data commands
+// manage are kept. Keys are slash separated paths, as in S3.
+type Storage interface {
+	// List calls fn with every object whose key starts with prefix, a page
+	// at a time, in key order.
+	List(ctx context.Context, prefix string, fn func(objects []*Object) error) error
+	// ListPrefixes returns the names of the "folders" directly under prefix.
+	ListPrefixes(ctx context.Context, prefix string) ([]string, error)
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Put(ctx context.Context, key string, body io.Reader) error
+	Delete(ctx context.Context, key string) error
+	// Head returns the object's metadata without fetching its contents.
+	Head(ctx context.Context, key string) (*Object, error)
+}
+
+// multipartStorage is implemented by storages that upload large objects in
+// parts, to let commits tune the size and number of parts uploaded at once.
+type multipartStorage interface {
+	setMultipart(partSize int64, concurrency int) error
+}
+
+// rangeStorage is implemented by storages that can fetch part of an object,
+// to let gets read single files out of the chunks of packed commits.
+type rangeStorage interface {
+	getRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error)
+}
+
+// copyingStorage is implemented by storages that can copy objects from some
+// other storages without downloading them, as S3 can between buckets.
+type copyingStorage interface {
+	// copyFrom copies an object of source of the given size, or reports
+	// false without doing anything if it can't copy from source.
+	copyFrom(ctx context.Context, source Storage, sourceKey string, key string, size int64) (bool, error)
+}
+
+type Object struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+type notFoundError struct {
+	key string
+}
+
+func (e *notFoundError) Error() string {
+	return fmt.Sprintf("%s not found", e.key)
+}
+
+// isNotFound reports whether err is a storage telling us the object does
+// not exist
+func isNotFound(err error) bool {
+	_, ok := errors.Cause(err).(*notFoundError)
+	return ok
+}
+
+// permanentError wraps errors that trying again won't fix, such as being
+// denied access
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+// isRetryable reports whether a failed get or put is worth trying again
+func isRetryable(err error) bool {
+	switch errors.Cause(err).(type) {
+	case *notFoundError, *permanentError:
+		return false
+	}
+	return true
+}
+
+// getRange returns length bytes of an object starting at offset, skipping
+// what comes before on storages that can't fetch part of an object.
+func getRange(ctx context.Context, storage Storage, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if ranged, ok := storage.(rangeStorage); ok {
+		return ranged.getRange(ctx, key, offset, length)
+	}
+
+	body, err := storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(ioutil.Discard, body, offset); err != nil {
+		body.Close()
+		return nil, errors.Wrapf(err, "skipping to %d in %s", offset, key)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(body, length), body}, nil
+}
+
+// copyObject copies an object from one storage to another, server side when
+// the destination can, or else streaming it through.
+func copyObject(ctx context.Context, from Storage, fromKey string, to Storage, toKey string, size int64) error {
+	err := transferRetries.do(ctx, "copying "+fromKey+" to "+toKey, func() error {
+		if copier, ok := to.(copyingStorage); ok {
+			copied, err := copier.copyFrom(ctx, from, fromKey, toKey, size)
+			if copied || err != nil {
+				return err
+			}
+		}
+
+		body, err := from.Get(ctx, fromKey)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		return to.Put(ctx, toKey, body)
+	})
+	if err != nil {
+		return errors.Wrapf(err, "failed to copy %s to %s", fromKey, toKey)
+	}
+	return nil
+}
+
+// errStopListing can be returned by a List callback to stop early
+var errStopListing = errors.New("stop listing")
+
+// openStorage returns the storage holding a bucket, as configured by the
+// 'storage' setting: S3 by default, or a local directory given as
+// file:///some/path, in which each bucket is a subdirectory.
+func openStorage(bucket string) (Storage, error) {
+	location := viper.GetString("storage")
+
+	switch {
+	case location == "" || location == "s3":
+		return newS3Storage(bucket), nil
+	case strings.HasPrefix(location, "file://"):
+		root := strings.TrimPrefix(location, "file://")
+		return newFileStorage(afero.NewOsFs(), filepath.Join(root, bucket)), nil
+	}
+	return nil, fmt.Errorf("unsupported storage %s, expected s3 or file:///path", location)
+}
+
+// readObjectIfExists reads a small object in one go and reports whether it
+// was found.
+func readObjectIfExists(ctx context.Context, storage Storage, key string) ([]byte, bool, error) {
+	var contents []byte
+	err := transferRetries.do(ctx, "fetching "+key, func() error {
+		body, err := storage.Get(ctx, key)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		contents, err = ioutil.ReadAll(body)
+		return err
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return contents, true, nil
+}
+
+func putObject(ctx context.Context, storage Storage, key string, data []byte) error {
+	err := transferRetries.do(ctx, "uploading "+key, func() error {
+		return storage.Put(ctx, key, bytes.NewReader(data))
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to update %s", key)
+	}
+	return nil
+}
+
+func objectExists(ctx context.Context, storage Storage, key string) (bool, error) {
+	_, err := storage.Head(ctx, key)
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// hasObjects reports whether there is anything stored under prefix
+func hasObjects(ctx context.Context, storage Storage, prefix string) (bool, error) {
+	found := false
+	err := storage.List(ctx, prefix, func(objects []*Object) error {
+		found = len(objects) > 0
+		return errStopListing
+	})
+	if err != nil && err != errStopListing {
+		return false, err
+	}
+	return found, nil
+}
+
+// contextReader fails reads once ctx is cancelled, so copies that don't
+// watch the context themselves still stop part way through.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
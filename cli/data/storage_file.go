@@ -0,0 +1,218 @@
+package data
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// fileListPageSize mirrors the number of keys S3 returns per page
+const fileListPageSize = 1000
+
+// fileStorage keeps objects as files under a root directory, so the data
+// commands can run without AWS (e.g. on a laptop or in CI).
+type fileStorage struct {
+	fs   afero.Fs
+	root string
+}
+
+func newFileStorage(fs afero.Fs, root string) *fileStorage {
+	return &fileStorage{fs: fs, root: root}
+}
+
+func (s *fileStorage) path(key string) string {
+	return filepath.Join(s.root, filepath.FromSlash(key))
+}
+
+func (s *fileStorage) List(ctx context.Context, prefix string, fn func(objects []*Object) error) error {
+	// Only walk the directory the prefix is in, not the whole storage
+	dir := s.root
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = s.path(prefix[:i])
+	}
+
+	var objects []*Object
+	err := afero.Walk(s.fs, dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, &Object{
+				Key:          key,
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].Key < objects[j].Key })
+
+	for len(objects) > 0 {
+		page := objects
+		if len(page) > fileListPageSize {
+			page = page[:fileListPageSize]
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+		objects = objects[len(page):]
+	}
+	return nil
+}
+
+func (s *fileStorage) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	dir, base := path.Split(prefix)
+
+	infos, err := afero.ReadDir(s.fs, s.path(dir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var names []string
+	for _, info := range infos {
+		if info.IsDir() && strings.HasPrefix(info.Name(), base) {
+			names = append(names, strings.TrimPrefix(info.Name(), base))
+		}
+	}
+	return names, nil
+}
+
+func (s *fileStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, err := s.fs.Open(s.path(key))
+	if err != nil {
+		return nil, s.translate(key, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&contextReader{ctx, file}, file}, nil
+}
+
+func (s *fileStorage) getRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	file, err := s.fs.Open(s.path(key))
+	if err != nil {
+		return nil, s.translate(key, err)
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, s.translate(key, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{&contextReader{ctx, io.LimitReader(file, length)}, file}, nil
+}
+
+// Put writes to a temporary file first, so readers never see a partially
+// written object.
+func (s *fileStorage) Put(ctx context.Context, key string, body io.Reader) error {
+	target := s.path(key)
+	err := s.fs.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return s.translate(key, err)
+	}
+
+	file, err := afero.TempFile(s.fs, filepath.Dir(target), ".paddle")
+	if err != nil {
+		return s.translate(key, err)
+	}
+	_, err = io.Copy(file, &contextReader{ctx, body})
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.fs.Rename(file.Name(), target)
+	}
+	if err != nil {
+		s.fs.Remove(file.Name())
+		return s.translate(key, err)
+	}
+	return nil
+}
+
+// Delete removes the object along with any directories left empty, so they
+// don't show up as prefixes.
+func (s *fileStorage) Delete(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	target := s.path(key)
+	err := s.fs.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for dir := filepath.Dir(target); dir != s.root && strings.HasPrefix(dir, s.root); dir = filepath.Dir(dir) {
+		infos, err := afero.ReadDir(s.fs, dir)
+		if err != nil || len(infos) > 0 {
+			break
+		}
+		s.fs.Remove(dir)
+	}
+	return nil
+}
+
+func (s *fileStorage) Head(ctx context.Context, key string) (*Object, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	info, err := s.fs.Stat(s.path(key))
+	if err != nil {
+		return nil, s.translate(key, err)
+	}
+	if info.IsDir() {
+		return nil, &notFoundError{key}
+	}
+	return &Object{
+		Key:          key,
+		Size:         info.Size(),
+		LastModified: info.ModTime(),
+	}, nil
+}
+
+func (s *fileStorage) translate(key string, err error) error {
+	if os.IsNotExist(err) {
+		return &notFoundError{key}
+	}
+	if os.IsPermission(err) {
+		return &permanentError{err}
+	}
+	return err
+}
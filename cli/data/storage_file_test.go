@@ -0,0 +1,154 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// memStorage returns a file storage kept in memory, holding the given objects
+func memStorage(objects map[string]string) *fileStorage {
+	storage := newFileStorage(afero.NewMemMapFs(), "/bucket")
+	modified := time.Date(2019, 3, 1, 12, 30, 0, 0, time.UTC)
+	for key, contents := range objects {
+		putObject(context.Background(), storage, key, []byte(contents))
+		storage.fs.Chtimes(storage.path(key), modified, modified)
+	}
+	return storage
+}
+
+// readString returns the contents of an object, or "" if it doesn't exist
+func readString(storage Storage, key string) string {
+	contents, _, _ := readObjectIfExists(context.Background(), storage, key)
+	return string(contents)
+}
+
+func TestFileStorageList(t *testing.T) {
+	storage := memStorage(map[string]string{
+		"model/v1/a":   "a",
+		"model/v1/b/c": "bc",
+		"model/v10/a":  "a",
+		"other/a":      "a",
+	})
+
+	var keys []string
+	err := storage.List(context.Background(), "model/v1/", func(objects []*Object) error {
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("It should list objects, but %v", err)
+	}
+
+	if fmt.Sprint(keys) != "[model/v1/a model/v1/b/c]" {
+		t.Errorf("Listed keys were incorrect, got: %v", keys)
+	}
+
+	keys = nil
+	storage.List(context.Background(), "model/v1", func(objects []*Object) error {
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+		return nil
+	})
+	if len(keys) != 3 {
+		t.Errorf("It should match prefixes that aren't folders, got: %v", keys)
+	}
+}
+
+func TestFileStorageListPages(t *testing.T) {
+	objects := make(map[string]string)
+	for i := 0; i < fileListPageSize+1; i++ {
+		objects[fmt.Sprintf("path/%04d", i)] = ""
+	}
+	storage := memStorage(objects)
+
+	var pages []int
+	storage.List(context.Background(), "path/", func(objects []*Object) error {
+		pages = append(pages, len(objects))
+		return nil
+	})
+	if fmt.Sprint(pages) != fmt.Sprintf("[%d 1]", fileListPageSize) {
+		t.Errorf("Pages were incorrect, got: %v", pages)
+	}
+}
+
+func TestFileStorageListPrefixes(t *testing.T) {
+	storage := memStorage(map[string]string{
+		"model/v1/master/HEAD": "",
+		"model/v2/master/HEAD": "",
+		"model/HEAD":           "",
+	})
+
+	names, err := storage.ListPrefixes(context.Background(), "model/")
+	if err != nil || fmt.Sprint(names) != "[v1 v2]" {
+		t.Errorf("Prefixes were incorrect, got: %v (%v)", names, err)
+	}
+
+	names, err = storage.ListPrefixes(context.Background(), "missing/")
+	if err != nil || len(names) != 0 {
+		t.Errorf("It should list nothing under a missing prefix, got: %v (%v)", names, err)
+	}
+}
+
+func TestFileStorageNotFound(t *testing.T) {
+	storage := memStorage(map[string]string{"path/file": "contents"})
+
+	if _, err := storage.Get(context.Background(), "path/missing"); !isNotFound(err) {
+		t.Errorf("Get should report a missing object, got: %v", err)
+	}
+	if _, err := storage.Head(context.Background(), "path"); !isNotFound(err) {
+		t.Errorf("Head should not find a folder, got: %v", err)
+	}
+
+	obj, err := storage.Head(context.Background(), "path/file")
+	if err != nil || obj.Size != 8 {
+		t.Errorf("Head was incorrect, got: %+v (%v)", obj, err)
+	}
+}
+
+func TestFileStoragePutAndDelete(t *testing.T) {
+	storage := memStorage(map[string]string{"path/keep": ""})
+
+	err := putObject(context.Background(), storage, "path/to/file", []byte("contents"))
+	if err != nil || readString(storage, "path/to/file") != "contents" {
+		t.Fatalf("It should store the object, got: %v", err)
+	}
+
+	if err := storage.Delete(context.Background(), "path/to/file"); err != nil {
+		t.Fatalf("It should delete the object, but %v", err)
+	}
+	if found, _ := objectExists(context.Background(), storage, "path/to/file"); found {
+		t.Error("The object should be gone")
+	}
+
+	infos, _ := afero.ReadDir(storage.fs, storage.path("path"))
+	if len(infos) != 1 || infos[0].Name() != "keep" {
+		t.Errorf("It should remove empty folders, found: %v", infos)
+	}
+
+	if err := storage.Delete(context.Background(), "path/missing"); err != nil {
+		t.Errorf("Deleting a missing object should succeed, but %v", err)
+	}
+}
+
+func TestFileStorageGet(t *testing.T) {
+	storage := memStorage(map[string]string{"path/file": "contents"})
+
+	body, err := storage.Get(context.Background(), "path/file")
+	if err != nil {
+		t.Fatalf("It should get the object, but %v", err)
+	}
+	defer body.Close()
+
+	contents, _ := ioutil.ReadAll(body)
+	if string(contents) != "contents" {
+		t.Errorf("Contents were incorrect, got: %s, want: contents.", contents)
+	}
+}
@@ -0,0 +1,298 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+type s3Storage struct {
+	bucket   string
+	svc      *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func newS3Storage(bucket string) *s3Storage {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+	}))
+
+	return &s3Storage{
+		bucket:   bucket,
+		svc:      s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}
+}
+
+func (s *s3Storage) setMultipart(partSize int64, concurrency int) error {
+	if partSize != 0 {
+		if partSize < s3manager.MinUploadPartSize {
+			return fmt.Errorf("part size must be at least %s", formatBytes(s3manager.MinUploadPartSize))
+		}
+		s.uploader.PartSize = partSize
+	}
+	if concurrency != 0 {
+		s.uploader.Concurrency = concurrency
+	}
+	return nil
+}
+
+func (s *s3Storage) List(ctx context.Context, prefix string, fn func(objects []*Object) error) error {
+	query := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	}
+
+	for {
+		response, err := s.svc.ListObjectsV2WithContext(ctx, query)
+		if err != nil {
+			return s.translate(prefix, err)
+		}
+
+		objects := make([]*Object, len(response.Contents))
+		for i, obj := range response.Contents {
+			objects[i] = &Object{
+				Key:          aws.StringValue(obj.Key),
+				Size:         aws.Int64Value(obj.Size),
+				ETag:         strings.Trim(aws.StringValue(obj.ETag), `"`),
+				LastModified: aws.TimeValue(obj.LastModified),
+			}
+		}
+		if err := fn(objects); err != nil {
+			return err
+		}
+
+		// Check if more results
+		query.ContinuationToken = response.NextContinuationToken
+
+		if !(*response.IsTruncated) {
+			return nil
+		}
+	}
+}
+
+func (s *s3Storage) ListPrefixes(ctx context.Context, prefix string) ([]string, error) {
+	var names []string
+	query := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s.bucket),
+		Prefix:    aws.String(prefix),
+		Delimiter: aws.String("/"),
+	}
+
+	for {
+		response, err := s.svc.ListObjectsV2WithContext(ctx, query)
+		if err != nil {
+			return nil, s.translate(prefix, err)
+		}
+
+		for _, p := range response.CommonPrefixes {
+			names = append(names, strings.TrimSuffix(strings.TrimPrefix(*p.Prefix, prefix), "/"))
+		}
+
+		// Check if more results
+		query.ContinuationToken = response.NextContinuationToken
+
+		if !(*response.IsTruncated) {
+			return names, nil
+		}
+	}
+}
+
+func (s *s3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s.translate(key, err)
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) getRange(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+length-1)),
+	})
+	if err != nil {
+		return nil, s.translate(key, err)
+	}
+	return out.Body, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, key string, body io.Reader) error {
+	_, err := s.uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   body,
+	})
+	if err != nil {
+		return s.translate(key, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s.translate(key, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Head(ctx context.Context, key string) (*Object, error) {
+	out, err := s.svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, s.translate(key, err)
+	}
+	return &Object{
+		Key:          key,
+		Size:         aws.Int64Value(out.ContentLength),
+		ETag:         strings.Trim(aws.StringValue(out.ETag), `"`),
+		LastModified: aws.TimeValue(out.LastModified),
+	}, nil
+}
+
+// maxCopyObjectSize is the largest object S3 copies in one request. Larger
+// ones are copied in parts of at least minCopyPartSize, and at most
+// maxCopyParts of them.
+const (
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+	minCopyPartSize   = 256 * 1024 * 1024
+	maxCopyParts      = 10000
+)
+
+// copyFrom copies objects of other buckets in S3 without them leaving S3
+func (s *s3Storage) copyFrom(ctx context.Context, source Storage, sourceKey string, key string, size int64) (bool, error) {
+	from, ok := source.(*s3Storage)
+	if !ok {
+		return false, nil
+	}
+	copySource := copySource(from.bucket, sourceKey)
+
+	if size <= maxCopyObjectSize {
+		_, err := s.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(s.bucket),
+			Key:        aws.String(key),
+			CopySource: aws.String(copySource),
+		})
+		if err != nil {
+			return true, s.translate(sourceKey, err)
+		}
+		return true, nil
+	}
+	return true, s.copyParts(ctx, copySource, sourceKey, key, size)
+}
+
+// copyParts copies a large object with a multipart upload of ranges of it,
+// s.uploader.Concurrency parts at a time.
+func (s *s3Storage) copyParts(ctx context.Context, copySource string, sourceKey string, key string, size int64) error {
+	upload, err := s.svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return s.translate(key, err)
+	}
+
+	partSize := int64(minCopyPartSize)
+	if size/maxCopyParts >= partSize {
+		partSize = size/maxCopyParts + 1
+	}
+	parts := make([]*s3.CompletedPart, (size+partSize-1)/partSize)
+
+	copies := newTransfers(ctx, s.uploader.Concurrency)
+	for i := range parts {
+		i, start := i, int64(i)*partSize
+		end := start + partSize - 1
+		if end >= size {
+			end = size - 1
+		}
+		copies.Go(func() error {
+			out, err := s.svc.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+				Bucket:          aws.String(s.bucket),
+				Key:             aws.String(key),
+				UploadId:        upload.UploadId,
+				PartNumber:      aws.Int64(int64(i + 1)),
+				CopySource:      aws.String(copySource),
+				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+			})
+			if err != nil {
+				return s.translate(sourceKey, err)
+			}
+			parts[i] = &s3.CompletedPart{ETag: out.CopyPartResult.ETag, PartNumber: aws.Int64(int64(i + 1))}
+			return nil
+		})
+	}
+	err = copies.Wait()
+	if err == nil {
+		_, err = s.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s.bucket),
+			Key:             aws.String(key),
+			UploadId:        upload.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+		err = s.translate(key, err)
+	}
+	if err != nil {
+		// don't leave the parts copied so far around to be paid for
+		s.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(s.bucket),
+			Key:      aws.String(key),
+			UploadId: upload.UploadId,
+		})
+		return err
+	}
+	return nil
+}
+
+// copySource returns the URL encoded bucket/key CopyObject expects
+func copySource(bucket string, key string) string {
+	parts := strings.Split(key, "/")
+	for i, part := range parts {
+		parts[i] = strings.Replace(url.PathEscape(part), "+", "%2B", -1)
+	}
+	return bucket + "/" + strings.Join(parts, "/")
+}
+
+// s3PermanentErrors are the error codes retrying won't help with
+var s3PermanentErrors = map[string]bool{
+	"AccessDenied":          true,
+	"AllAccessDisabled":     true,
+	"ExpiredToken":          true,
+	"InvalidAccessKeyId":    true,
+	"InvalidBucketName":     true,
+	"InvalidObjectState":    true,
+	"InvalidToken":          true,
+	s3.ErrCodeNoSuchBucket:  true,
+	"SignatureDoesNotMatch": true,
+}
+
+// translate turns S3's missing key errors into notFoundError, and marks the
+// ones that won't go away by retrying as permanent.
+func (s *s3Storage) translate(key string, err error) error {
+	if aerr, ok := err.(awserr.Error); ok {
+		if aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound" {
+			return &notFoundError{key}
+		}
+		if s3PermanentErrors[aerr.Code()] {
+			return &permanentError{err}
+		}
+	}
+	return err
+}
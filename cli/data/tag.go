@@ -0,0 +1,192 @@
+// Copyright © 2017 RooFoods LTD
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	tagBranch     string
+	tagBucket     string
+	tagCommitPath string
+	tagList       bool
+)
+
+var tagCmd = &cobra.Command{
+	Use:   "tag [step/version] [name]",
+	Short: "Name a commit with a tag",
+	Args:  cobra.RangeArgs(1, 2),
+	Long: `Give a commit of a branch, its HEAD unless --path says otherwise, a name that
+can be used instead of the commit path wherever one is accepted, as
+tag:<name>. Tags are stored next to the branch's HEAD and can't be moved once
+created, so they always name the same commit. 'paddle data gc' never deletes
+tagged commits.
+
+Example:
+
+$ paddle data tag trained-model/version1 release-2019-q1
+$ paddle data tag -b experimental -p 2019/03/01/12/30_AbC123XyZ0 trained-model/version1 baseline
+$ paddle data tag --list trained-model/version1
+$ paddle data get -p tag:release-2019-q1 trained-model/version1 dest/path
+`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if tagBucket == "" {
+			tagBucket = viper.GetString("bucket")
+		}
+		if tagBucket == "" {
+			exitErrorf("Bucket not defined. Please define 'bucket' in your config file.")
+		}
+		if tagList != (len(args) == 1) {
+			exitErrorf("Expected a step/version and a tag name, or --list and a step/version")
+		}
+
+		branchPath := fmt.Sprintf("%s/%s", strings.Trim(args[0], "/"), tagBranch)
+
+		ctx, cancel := commandContext()
+		defer cancel()
+
+		storage, err := openStorage(tagBucket)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+
+		if tagList {
+			tags, err := listTags(ctx, storage, branchPath)
+			if err != nil {
+				exitErrorf("%v", err)
+			}
+			writeTags(os.Stdout, tags)
+			return
+		}
+
+		commit, err := createTag(ctx, storage, branchPath, args[1], tagCommitPath)
+		if err != nil {
+			exitErrorf("%v", err)
+		}
+		fmt.Printf("Tagged %s as %s\n", commit, args[1])
+	},
+}
+
+func init() {
+	tagCmd.Flags().StringVarP(&tagBranch, "branch", "b", "master", "Branch to work on")
+	tagCmd.Flags().StringVar(&tagBucket, "bucket", "", "Bucket to use")
+	tagCmd.Flags().StringVarP(&tagCommitPath, "path", "p", "HEAD", "Commit to tag (instead of HEAD)")
+	tagCmd.Flags().BoolVarP(&tagList, "list", "l", false, "List the tags of the branch")
+}
+
+type tagInfo struct {
+	Name string
+	tagRecord
+}
+
+// createTag names a commit of a branch, given as a path relative to the
+// branch or in full, HEAD or an existing tag, returning the path of the
+// commit tagged.
+func createTag(ctx context.Context, storage Storage, branchPath string, name string, commit string) (string, error) {
+	if name == "" || name == "HEAD" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("invalid tag name %s", name)
+	}
+
+	target := qualifyHead(branchPath, commit)
+	if commit == "HEAD" || strings.HasPrefix(commit, tagPrefix) {
+		var err error
+		target, err = resolveCommit(ctx, storage, S3Path{path: branchPath + "/" + commit})
+		if err != nil {
+			return "", err
+		}
+	}
+	found, err := hasObjects(ctx, storage, target+"/")
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return "", fmt.Errorf("commit %s not found", target)
+	}
+
+	// Holding the branch's lock keeps two tags of the same name from both
+	// being created
+	unlock, err := lockHead(ctx, storage, branchPath, false)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	existing, err := readTag(ctx, storage, branchPath, name)
+	if err != nil {
+		return "", err
+	}
+	if existing != nil {
+		return "", fmt.Errorf("tag %s already names %s, tags can't be moved", name, existing.Commit)
+	}
+
+	data, err := json.Marshal(tagRecord{
+		Commit:    target,
+		Created:   time.Now().UTC(),
+		Committer: committer(),
+	})
+	if err != nil {
+		return "", err
+	}
+	return target, putObject(ctx, storage, tagKey(branchPath, name), data)
+}
+
+// listTags returns the tags of a branch sorted by name
+func listTags(ctx context.Context, storage Storage, branchPath string) ([]tagInfo, error) {
+	prefix := branchPath + "/" + tagsFolder + "/"
+
+	var names []string
+	err := storage.List(ctx, prefix, func(objects []*Object) error {
+		for _, obj := range objects {
+			names = append(names, strings.TrimPrefix(obj.Key, prefix))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	tags := []tagInfo{}
+	for _, name := range names {
+		tag, err := readTag(ctx, storage, branchPath, name)
+		if err != nil {
+			return nil, err
+		}
+		if tag != nil {
+			tags = append(tags, tagInfo{Name: name, tagRecord: *tag})
+		}
+	}
+	return tags, nil
+}
+
+func writeTags(w io.Writer, tags []tagInfo) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TAG\tCOMMIT\tCREATED\tCOMMITTER\t")
+	for _, tag := range tags {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t\n", tag.Name, tag.Commit, tag.Created.Format(time.RFC3339), tag.Committer)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,74 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCreateTag(t *testing.T) {
+	storage := memStorage(branchObjects)
+
+	commit, err := createTag(context.Background(), storage, "model/v1/master", "release", "HEAD")
+	if err != nil || commit != branchCommit {
+		t.Fatalf("It should tag HEAD, got: %s (%v)", commit, err)
+	}
+
+	_, err = createTag(context.Background(), storage, "model/v1/master", "release", "2019/02/01/09/00_ZyX321cBa0")
+	if err == nil || !strings.Contains(err.Error(), "can't be moved") {
+		t.Errorf("It should not move a tag, got: %v", err)
+	}
+
+	commit, err = createTag(context.Background(), storage, "model/v1/master", "old", "model/v1/master/2019/02/01/09/00_ZyX321cBa0")
+	if err != nil || commit != "model/v1/master/2019/02/01/09/00_ZyX321cBa0" {
+		t.Errorf("It should tag a commit, got: %s (%v)", commit, err)
+	}
+
+	commit, err = createTag(context.Background(), storage, "model/v1/master", "again", "tag:old")
+	if err != nil || commit != "model/v1/master/2019/02/01/09/00_ZyX321cBa0" {
+		t.Errorf("It should tag what another tag names, got: %s (%v)", commit, err)
+	}
+
+	for _, name := range []string{"", "HEAD", "a/b"} {
+		if _, err := createTag(context.Background(), storage, "model/v1/master", name, "HEAD"); err == nil {
+			t.Errorf("It should reject the tag name %q", name)
+		}
+	}
+	if _, err := createTag(context.Background(), storage, "model/v1/master", "missing", "2019/01/01/00/00_Nope"); err == nil {
+		t.Error("It should not tag a missing commit")
+	}
+
+	tags, err := listTags(context.Background(), storage, "model/v1/master")
+	if err != nil || len(tags) != 3 || tags[2].Name != "release" || tags[2].Commit != branchCommit {
+		t.Errorf("Unexpected tags: %+v (%v)", tags, err)
+	}
+
+	var out bytes.Buffer
+	writeTags(&out, tags)
+	if !strings.Contains(out.String(), "release  "+branchCommit) {
+		t.Errorf("Unexpected output:\n%s", out.String())
+	}
+}
+
+func TestResolveCommit(t *testing.T) {
+	storage := memStorage(branchObjects)
+	createTag(context.Background(), storage, "model/v1/master", "release", "HEAD")
+
+	for path, expected := range map[string]string{
+		"model/v1/master/HEAD":                         branchCommit,
+		"model/v1/master/tag:release":                  branchCommit,
+		"model/v1/master/2019/02/01/09/00_ZyX321cBa0/": "model/v1/master/2019/02/01/09/00_ZyX321cBa0",
+	} {
+		commit, err := resolveCommit(context.Background(), storage, NewS3Path("bucket", path))
+		if err != nil || commit != expected {
+			t.Errorf("%s should resolve to %s, got: %s (%v)", path, expected, commit, err)
+		}
+	}
+
+	for _, path := range []string{"model/v1/missing/HEAD", "model/v1/master/tag:missing"} {
+		if _, err := resolveCommit(context.Background(), storage, NewS3Path("bucket", path)); err == nil {
+			t.Errorf("%s should not resolve", path)
+		}
+	}
+}
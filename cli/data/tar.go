@@ -0,0 +1,67 @@
+package data
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// extractTar writes the files and directories of a tar stream under dir.
+// Anything else, such as links, is skipped.
+func extractTar(r io.Reader, dir string) error {
+	archive := tar.NewReader(r)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading tar")
+		}
+
+		name := path.Clean(header.Name)
+		if name == "." {
+			continue
+		}
+		if name == ".." || strings.HasPrefix(name, "../") || path.IsAbs(name) {
+			return fmt.Errorf("refusing to extract %s from tar, it is outside the commit", header.Name)
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = AppFs.MkdirAll(target, 0755)
+		case tar.TypeReg:
+			err = extractTarFile(archive, target)
+		default:
+			fmt.Fprintf(os.Stderr, "Skipping %s, only files and directories can be committed\n", header.Name)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "extracting %s", header.Name)
+		}
+	}
+}
+
+func extractTarFile(r io.Reader, target string) error {
+	err := AppFs.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := AppFs.Create(target)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	return err
+}
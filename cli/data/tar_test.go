@@ -0,0 +1,80 @@
+package data
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+)
+
+func tarball(files map[string]string) *bytes.Buffer {
+	var buf bytes.Buffer
+	archive := tar.NewWriter(&buf)
+	for name, contents := range files {
+		if strings.HasSuffix(name, "/") {
+			archive.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeDir, Mode: 0755})
+			continue
+		}
+		archive.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644, Size: int64(len(contents))})
+		archive.Write([]byte(contents))
+	}
+	archive.Close()
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+
+	err := extractTar(tarball(map[string]string{
+		"./":          "",
+		"./a.csv":     "a",
+		"./empty/":    "",
+		"./dir/b.csv": "bb",
+	}), "dest")
+	if err != nil {
+		t.Fatalf("It should extract the tar, but %v", err)
+	}
+
+	list := filesToKeys("dest")
+	if strings.Join(list, ",") != "dest/a.csv,dest/dir/b.csv" {
+		t.Errorf("Extracted files were incorrect, got: %v", list)
+	}
+	contents, _ := afero.ReadFile(AppFs, "dest/dir/b.csv")
+	if string(contents) != "bb" {
+		t.Errorf("Contents were incorrect, got: %s, want: bb.", contents)
+	}
+}
+
+func TestExtractTarOutsideDestination(t *testing.T) {
+	AppFs = afero.NewMemMapFs()
+
+	err := extractTar(tarball(map[string]string{"../escape": "x"}), "dest")
+	if err == nil || !strings.Contains(err.Error(), "outside the commit") {
+		t.Errorf("It should refuse paths outside the destination, got: %v", err)
+	}
+}
+
+func TestCommitTar(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "paddle")
+	defer os.RemoveAll(dir)
+	viper.Set("storage", "file://"+dir)
+	defer viper.Set("storage", "")
+	AppFs = afero.NewMemMapFs()
+
+	err := CommitTar(context.Background(), tarball(map[string]string{"model.bin": "weights"}), NewS3Path("bucket", "model/v1/master"), CommitOptions{})
+	if err != nil {
+		t.Fatalf("It should commit the tar, but %v", err)
+	}
+
+	storage, _ := openStorage("bucket")
+	head := readString(storage, "model/v1/master/HEAD")
+	if readString(storage, head+"/model.bin") != "weights" {
+		t.Errorf("It should store the files of the tar, HEAD: %s", head)
+	}
+}
@@ -0,0 +1,96 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// transfers runs gets or puts concurrently, at most limit at a time, and
+// collects the errors of all of them rather than stopping at the first.
+type transfers struct {
+	ctx  context.Context
+	sem  chan struct{}
+	wg   sync.WaitGroup
+	mu   sync.Mutex
+	errs []error
+}
+
+func newTransfers(ctx context.Context, limit int) *transfers {
+	return &transfers{
+		ctx: ctx,
+		sem: make(chan struct{}, limit),
+	}
+}
+
+// Go runs fn in the background as soon as a slot is free. Once ctx is
+// cancelled nothing new is started.
+func (t *transfers) Go(fn func() error) {
+	// block if limit transfers are already running
+	select {
+	case t.sem <- struct{}{}:
+	case <-t.ctx.Done():
+		return
+	}
+	if t.ctx.Err() != nil {
+		<-t.sem
+		return
+	}
+
+	t.wg.Add(1)
+	go func() {
+		defer func() {
+			// frees up the slot
+			<-t.sem
+			t.wg.Done()
+		}()
+
+		if err := fn(); err != nil {
+			t.mu.Lock()
+			t.errs = append(t.errs, err)
+			t.mu.Unlock()
+		}
+	}()
+}
+
+// Wait waits for every transfer started to finish and returns their errors
+// as one, or the context's error if it was cancelled.
+func (t *transfers) Wait() error {
+	t.wg.Wait()
+
+	if err := t.ctx.Err(); err != nil {
+		return err
+	}
+	switch len(t.errs) {
+	case 0:
+		return nil
+	case 1:
+		return t.errs[0]
+	}
+	return transferErrors(t.errs)
+}
+
+type transferErrors []error
+
+func (e transferErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d transfers failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+// formatBytes returns a size in a human readable unit, e.g. 1.5 MB
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,72 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTransfersCollectsAllErrors(t *testing.T) {
+	downloads := newTransfers(context.Background(), 2)
+
+	var done int32
+	for _, name := range []string{"a", "b", "c", "d"} {
+		name := name
+		downloads.Go(func() error {
+			atomic.AddInt32(&done, 1)
+			if name == "b" || name == "d" {
+				return errors.New(name + " failed")
+			}
+			return nil
+		})
+	}
+
+	err := downloads.Wait()
+	if done != 4 {
+		t.Errorf("It should run every transfer, ran: %d", done)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), "2 transfers failed: ") ||
+		!strings.Contains(err.Error(), "b failed") || !strings.Contains(err.Error(), "d failed") {
+		t.Errorf("It should report both failures, got: %v", err)
+	}
+}
+
+func TestTransfersStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	downloads := newTransfers(ctx, 1)
+
+	started := 0
+	for i := 0; i < 3; i++ {
+		downloads.Go(func() error {
+			started++
+			cancel()
+			return ctx.Err()
+		})
+	}
+
+	if err := downloads.Wait(); err != context.Canceled {
+		t.Errorf("It should report the cancellation, got: %v", err)
+	}
+	if started != 1 {
+		t.Errorf("It should not start transfers once cancelled, started: %d", started)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		0:                      "0 B",
+		1023:                   "1023 B",
+		1536:                   "1.5 KB",
+		5 * 1024 * 1024:        "5.0 MB",
+		3 * 1024 * 1024 * 1024: "3.0 GB",
+	}
+
+	for size, expectation := range cases {
+		if result := formatBytes(size); result != expectation {
+			t.Errorf("Size was incorrect, got: %s, want: %s.", result, expectation)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package pipeline
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// stepGraph holds the steps of a pipeline together with the dependencies
+// between them. A step depends on another when one of its inputs reads the
+// output of that step (inputs with an explicit bucket reach into another
+// pipeline, so they are not considered dependencies).
+type stepGraph struct {
+	steps      []*PipelineDefinitionStep
+	upstream   [][]int
+	downstream [][]int
+}
+
+type stepResult struct {
+	index int
+	err   error
+}
+
+func newStepGraph(steps []*PipelineDefinitionStep) (*stepGraph, error) {
+	g := &stepGraph{
+		steps:      steps,
+		upstream:   make([][]int, len(steps)),
+		downstream: make([][]int, len(steps)),
+	}
+
+	byName := make(map[string][]int)
+	for i, step := range steps {
+		byName[step.Step] = append(byName[step.Step], i)
+	}
+
+	for i, step := range steps {
+		seen := make(map[int]bool)
+		for _, input := range step.Inputs {
+			if input.Bucket != "" {
+				continue
+			}
+			for _, j := range g.producers(byName[input.Step], input.Version) {
+				// A step reading its own previous output is not a dependency
+				if j == i || seen[j] {
+					continue
+				}
+				seen[j] = true
+				g.upstream[i] = append(g.upstream[i], j)
+				g.downstream[j] = append(g.downstream[j], i)
+			}
+		}
+	}
+
+	if cycle := g.cycle(); len(cycle) > 0 {
+		return nil, fmt.Errorf("dependency cycle between steps: %s", strings.Join(cycle, ", "))
+	}
+
+	return g, nil
+}
+
+// producers narrows the steps matching an input name down to the ones with
+// the same version, falling back to all of them if none matches.
+func (g *stepGraph) producers(candidates []int, version string) []int {
+	if len(candidates) < 2 {
+		return candidates
+	}
+	var matching []int
+	for _, i := range candidates {
+		if g.steps[i].Version == version {
+			matching = append(matching, i)
+		}
+	}
+	if len(matching) == 0 {
+		return candidates
+	}
+	return matching
+}
+
+// cycle returns the names of the steps that can never be scheduled because
+// they are part of (or depend on) a dependency cycle.
+func (g *stepGraph) cycle() []string {
+	pending := make([]int, len(g.steps))
+	var queue []int
+	for i := range g.steps {
+		pending[i] = len(g.upstream[i])
+		if pending[i] == 0 {
+			queue = append(queue, i)
+		}
+	}
+
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		for _, j := range g.downstream[i] {
+			pending[j]--
+			if pending[j] == 0 {
+				queue = append(queue, j)
+			}
+		}
+	}
+
+	var names []string
+	for i, step := range g.steps {
+		if pending[i] > 0 {
+			names = append(names, step.Step)
+		}
+	}
+	return names
+}
+
+// execute runs every step once all of its upstream steps have succeeded,
+// with at most parallel steps running at the same time. Steps downstream of
+// a failed step are skipped; unrelated branches of the graph keep running.
+// The returned errors are in pipeline order.
+func (g *stepGraph) execute(parallel int, run func(step *PipelineDefinitionStep) error) []error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var (
+		pending = make([]int, len(g.steps))
+		errs    = make([]error, len(g.steps))
+		done    = make([]bool, len(g.steps))
+		ready   []int
+		results = make(chan stepResult)
+		running = 0
+		left    = len(g.steps)
+		wg      sync.WaitGroup
+	)
+
+	for i := range g.steps {
+		pending[i] = len(g.upstream[i])
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	var skip func(i int, cause string)
+	skip = func(i int, cause string) {
+		for _, j := range g.downstream[i] {
+			if done[j] {
+				continue
+			}
+			done[j] = true
+			left--
+			errs[j] = fmt.Errorf("step %s skipped: upstream step %s failed", g.steps[j].Step, cause)
+			skip(j, cause)
+		}
+	}
+
+	for left > 0 {
+		for running < parallel && len(ready) > 0 {
+			i := ready[0]
+			ready = ready[1:]
+			running++
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results <- stepResult{i, run(g.steps[i])}
+			}(i)
+		}
+
+		result := <-results
+		running--
+		left--
+		done[result.index] = true
+
+		if result.err != nil {
+			errs[result.index] = fmt.Errorf("step %s failed: %s", g.steps[result.index].Step, result.err.Error())
+			skip(result.index, g.steps[result.index].Step)
+			continue
+		}
+
+		for _, j := range g.downstream[result.index] {
+			pending[j]--
+			if pending[j] == 0 && !done[j] {
+				ready = append(ready, j)
+			}
+		}
+		// keep the pipeline definition order among steps that became ready
+		sort.Ints(ready)
+	}
+	wg.Wait()
+
+	var failures []error
+	for _, err := range errs {
+		if err != nil {
+			failures = append(failures, err)
+		}
+	}
+	return failures
+}
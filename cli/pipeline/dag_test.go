@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func loadStepGraph(path string) (*stepGraph, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		panic(err.Error())
+	}
+	pipeline := ParsePipeline(data)
+
+	var steps []*PipelineDefinitionStep
+	for i := range pipeline.Steps {
+		steps = append(steps, &pipeline.Steps[i])
+	}
+	return newStepGraph(steps)
+}
+
+func TestStepGraphDependencies(t *testing.T) {
+	graph, err := loadStepGraph("test/sample_steps_dag.yml")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectation := [][]int{nil, {0}, nil, {1, 2}}
+	for i, upstream := range graph.upstream {
+		if !reflect.DeepEqual(upstream, expectation[i]) {
+			t.Errorf("step %s depends on %v, want: %v", graph.steps[i].Step, upstream, expectation[i])
+		}
+	}
+}
+
+func TestStepGraphCycle(t *testing.T) {
+	_, err := loadStepGraph("test/sample_steps_cycle.yml")
+	if err == nil {
+		t.Fatal("expected a dependency cycle error")
+	}
+
+	expectation := "dependency cycle between steps: step1, step2"
+	if err.Error() != expectation {
+		t.Errorf("error was %s, want: %s", err.Error(), expectation)
+	}
+}
+
+func TestExecuteOrder(t *testing.T) {
+	graph, _ := loadStepGraph("test/sample_steps_dag.yml")
+
+	var order []string
+	failures := graph.execute(1, func(step *PipelineDefinitionStep) error {
+		order = append(order, step.Step)
+		return nil
+	})
+
+	if len(failures) != 0 {
+		t.Errorf("expected no failures, got %v", failures)
+	}
+
+	expectation := []string{"extract", "features", "reference", "train"}
+	if !reflect.DeepEqual(order, expectation) {
+		t.Errorf("order was %v, want: %v", order, expectation)
+	}
+}
+
+func TestExecuteFailureOnlyBlocksDownstream(t *testing.T) {
+	graph, _ := loadStepGraph("test/sample_steps_dag.yml")
+
+	var (
+		mu  sync.Mutex
+		ran = make(map[string]bool)
+	)
+	failures := graph.execute(4, func(step *PipelineDefinitionStep) error {
+		mu.Lock()
+		ran[step.Step] = true
+		mu.Unlock()
+		if step.Step == "extract" {
+			return errors.New("boom")
+		}
+		return nil
+	})
+
+	if !ran["reference"] {
+		t.Error("expected unrelated step reference to run")
+	}
+	if ran["features"] || ran["train"] {
+		t.Error("expected steps downstream of extract to be skipped")
+	}
+
+	expectation := []string{
+		"step extract failed: boom",
+		"step features skipped: upstream step extract failed",
+		"step train skipped: upstream step extract failed",
+	}
+	if len(failures) != len(expectation) {
+		t.Fatalf("expected %d failures, got %v", len(expectation), failures)
+	}
+	for i, failure := range failures {
+		if failure.Error() != expectation[i] {
+			t.Errorf("failure was %s, want: %s", failure.Error(), expectation[i])
+		}
+	}
+}
+
+func TestExecuteParallelLimit(t *testing.T) {
+	graph, _ := loadStepGraph("test/sample_steps_dag.yml")
+
+	var (
+		mu      sync.Mutex
+		running int
+		maximum int
+	)
+	graph.execute(2, func(step *PipelineDefinitionStep) error {
+		mu.Lock()
+		running++
+		if running > maximum {
+			maximum = running
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+
+	if maximum != 2 {
+		t.Errorf("expected independent steps to run two at a time, got %d", maximum)
+	}
+}
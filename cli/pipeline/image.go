@@ -0,0 +1,54 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+var ecrImage = regexp.MustCompile(`^(\d+)\.dkr\.ecr\.([a-z0-9-]+)\.amazonaws\.com/([^:@]+)(?::([^@]+))?$`)
+
+// ecrClient connects to ECR in the given region, and is replaced in tests
+var ecrClient = func(region string) ecriface.ECRAPI {
+	sess := session.Must(session.NewSessionWithOptions(session.Options{
+		SharedConfigState: session.SharedConfigEnable,
+		Config:            aws.Config{Region: aws.String(region)},
+	}))
+	return ecr.New(sess)
+}
+
+// imageDigest returns the digest of the image a step runs, so the commits
+// it makes record exactly what produced them. Images already pinned to a
+// digest need no lookup; tags are resolved for images hosted on ECR, and
+// left unresolved for any other registry.
+func imageDigest(image string) (string, error) {
+	if i := strings.Index(image, "@"); i >= 0 {
+		return image[i+1:], nil
+	}
+	matches := ecrImage.FindStringSubmatch(image)
+	if matches == nil {
+		return "", nil
+	}
+	registry, region, repository, tag := matches[1], matches[2], matches[3], matches[4]
+	if tag == "" {
+		tag = "latest"
+	}
+
+	out, err := ecrClient(region).DescribeImages(&ecr.DescribeImagesInput{
+		RegistryId:     aws.String(registry),
+		RepositoryName: aws.String(repository),
+		ImageIds:       []*ecr.ImageIdentifier{{ImageTag: aws.String(tag)}},
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(out.ImageDetails) == 0 || out.ImageDetails[0].ImageDigest == nil {
+		return "", fmt.Errorf("image %s not found", image)
+	}
+	return *out.ImageDetails[0].ImageDigest, nil
+}
@@ -0,0 +1,59 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+)
+
+// fakeECR knows the digest of the latest paddlecontainer image
+type fakeECR struct {
+	ecriface.ECRAPI
+	input *ecr.DescribeImagesInput
+}
+
+func (e *fakeECR) DescribeImages(input *ecr.DescribeImagesInput) (*ecr.DescribeImagesOutput, error) {
+	e.input = input
+	if *input.RepositoryName != "paddlecontainer" || *input.ImageIds[0].ImageTag != "latest" {
+		return &ecr.DescribeImagesOutput{}, nil
+	}
+	return &ecr.DescribeImagesOutput{ImageDetails: []*ecr.ImageDetail{{ImageDigest: aws.String("sha256:4567def")}}}, nil
+}
+
+func fakeECRClient(region string) ecriface.ECRAPI {
+	return &fakeECR{}
+}
+
+func TestImageDigest(t *testing.T) {
+	defer func(client func(string) ecriface.ECRAPI) { ecrClient = client }(ecrClient)
+	fake := &fakeECR{}
+	var region string
+	ecrClient = func(r string) ecriface.ECRAPI {
+		region = r
+		return fake
+	}
+
+	digest, err := imageDigest("219541440308.dkr.ecr.eu-west-1.amazonaws.com/paddlecontainer:latest")
+	if err != nil || digest != "sha256:4567def" {
+		t.Errorf("It should resolve the tag of an ECR image, got: %s (%v)", digest, err)
+	}
+	if region != "eu-west-1" || *fake.input.RegistryId != "219541440308" {
+		t.Errorf("It should ask the registry of the image, got: %s in %s", *fake.input.RegistryId, region)
+	}
+
+	if _, err := imageDigest("219541440308.dkr.ecr.eu-west-1.amazonaws.com/paddlecontainer:missing"); err == nil {
+		t.Error("It should fail for a tag ECR doesn't have")
+	}
+
+	fake.input = nil
+	digest, err = imageDigest("219541440308.dkr.ecr.eu-west-1.amazonaws.com/paddlecontainer@sha256:89ab")
+	if err != nil || digest != "sha256:89ab" || fake.input != nil {
+		t.Errorf("It should take the digest of a pinned image as is, got: %s (%v)", digest, err)
+	}
+	digest, err = imageDigest("ubuntu:18.04")
+	if err != nil || digest != "" || fake.input != nil {
+		t.Errorf("It should leave images outside ECR unresolved, got: %s (%v)", digest, err)
+	}
+}
@@ -20,7 +20,10 @@ type PipelineDefinitionStep struct {
 		Path    string   `yaml:"path" json:"path"`
 		Bucket  string   `yaml:"bucket" json:"bucket"`
 		Keys    []string `yaml:"keys" json:"keys"`
+		Include []string `yaml:"include" json:"include"`
+		Exclude []string `yaml:"exclude" json:"exclude"`
 		Subdir  string   `yaml:"subdir" json:"subdir"`
+		AsOf    string   `yaml:"as_of" json:"as_of"`
 	} `yaml:"inputs" json:"inputs"`
 	Commands  []string `yaml:"commands" json:"commands"`
 	Resources struct {
@@ -34,6 +37,7 @@ type PipelineDefinition struct {
 	Pipeline  string                   `yaml:"pipeline"`
 	Bucket    string                   `yaml:"bucket"`
 	Namespace string                   `yaml:"namespace"`
+	GitSHA    string                   `yaml:"git_sha"`
 	Steps     []PipelineDefinitionStep `yaml:"steps"`
 	Secrets   []string
 }
@@ -19,9 +19,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/deliveroo/paddle/git"
 	"github.com/spf13/cobra"
 	v1 "k8s.io/api/core/v1"
 	k8errors "k8s.io/apimachinery/pkg/api/errors"
@@ -34,6 +36,7 @@ import (
 type runCmdFlagsStruct struct {
 	StepName           string
 	BucketName         string
+	GitSHA             string
 	ImageTag           string
 	StepBranch         string
 	StepVersion        string
@@ -42,6 +45,7 @@ type runCmdFlagsStruct struct {
 	Secrets            []string
 	Env                []string
 	BucketOverrides    []string
+	Parallel           int
 	DeletePollInterval time.Duration
 	StartTimeout       time.Duration
 }
@@ -49,6 +53,7 @@ type runCmdFlagsStruct struct {
 const defaultDeletePollInterval = 2 * time.Second
 const deleteTimeout = 120 * time.Second
 const defaultStartTimeout = 10 * time.Minute
+const defaultParallel = 1
 
 var runCmdFlags *runCmdFlagsStruct
 var clientset kubernetes.Interface
@@ -61,9 +66,19 @@ var runCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Long: `Run a pipeline (or a single step) on the Kubernetes cluster.
 
+Steps are scheduled according to the dependencies declared by their inputs.
+Independent steps can run in parallel (see --parallel), and a failing step
+only prevents its downstream steps from running.
+
+Commits made by a step record the digest of its image, resolved from its tag
+for images hosted on ECR, and the git commit the pipeline is run from, taken
+from git_sha in the pipeline, --git-sha, or the repository the pipeline file
+is in.
+
 Example:
 
 $ paddle pipeline run test_pipeline.yaml
+$ paddle pipeline run --parallel 4 test_pipeline.yaml
 `,
 	Run: func(cmd *cobra.Command, args []string) {
 		runPipeline(args[0], runCmdFlags)
@@ -74,6 +89,7 @@ func init() {
 	runCmdFlags = &runCmdFlagsStruct{}
 	runCmd.Flags().StringVarP(&runCmdFlags.StepName, "step", "s", "", "Single step to execute")
 	runCmd.Flags().StringVarP(&runCmdFlags.BucketName, "bucket", "b", "", "Bucket name")
+	runCmd.Flags().StringVar(&runCmdFlags.GitSHA, "git-sha", "", "Git commit the pipeline is run from, recorded in the commits it makes (default the commit checked out where the pipeline is)")
 	runCmd.Flags().StringVarP(&runCmdFlags.ImageTag, "tag", "t", "", "Image tag (overrides the one defined in the pipeline)")
 	runCmd.Flags().StringVarP(&runCmdFlags.StepBranch, "step-branch", "B", "", "Step branch (overrides the one defined in the pipeline)")
 	runCmd.Flags().StringVarP(&runCmdFlags.StepVersion, "step-version", "V", "", "Step version (overrides the one defined in the pipeline)")
@@ -82,6 +98,7 @@ func init() {
 	runCmd.Flags().StringSliceVarP(&runCmdFlags.Secrets, "secret", "S", []string{}, "Secret to pull into the environment (in the form ENV_VAR:secret_store:key_name)")
 	runCmd.Flags().StringSliceVarP(&runCmdFlags.Env, "env", "e", []string{}, "Environment variables to set (in the form name:value)")
 	runCmd.Flags().StringSliceVar(&runCmdFlags.BucketOverrides, "replace-input-buckets", []string{}, "Override input bucket names (in the form original_bucket_name:new_bucket_name)")
+	runCmd.Flags().IntVarP(&runCmdFlags.Parallel, "parallel", "P", defaultParallel, "Maximum number of independent steps to run at the same time")
 	runCmdFlags.DeletePollInterval = defaultDeletePollInterval
 	runCmdFlags.StartTimeout = defaultStartTimeout
 
@@ -104,8 +121,16 @@ func runPipeline(path string, flags *runCmdFlagsStruct) {
 	if flags.BucketName != "" {
 		pipeline.Bucket = flags.BucketName
 	}
+	if flags.GitSHA != "" {
+		pipeline.GitSHA = flags.GitSHA
+	}
+	if pipeline.GitSHA == "" {
+		pipeline.GitSHA = git.HeadSHA(filepath.Dir(path))
+	}
 
-	for _, step := range pipeline.Steps {
+	var steps []*PipelineDefinitionStep
+	for i := range pipeline.Steps {
+		step := &pipeline.Steps[i]
 		if flags.StepName != "" && step.Step != flags.StepName {
 			continue
 		}
@@ -118,10 +143,28 @@ func runPipeline(path string, flags *runCmdFlagsStruct) {
 		if flags.StepVersion != "" {
 			step.OverrideVersion(flags.StepVersion, flags.OverrideInputs)
 		}
-		err = runPipelineStep(pipeline, &step, flags)
+		steps = append(steps, step)
+	}
+
+	graph, err := newStepGraph(steps)
+	if err != nil {
+		logFatalf("[paddle] %s", err.Error())
+		return
+	}
+
+	failures := graph.execute(flags.Parallel, func(step *PipelineDefinitionStep) error {
+		err := runPipelineStep(pipeline, step, flags)
 		if err != nil {
-			logFatalf("[paddle] %s", err.Error())
+			log.Printf("[paddle] Step %s failed: %s", step.Step, err.Error())
 		}
+		return err
+	})
+	if len(failures) > 0 {
+		msgs := make([]string, len(failures))
+		for i, failure := range failures {
+			msgs[i] = failure.Error()
+		}
+		logFatalf("[paddle] %s", strings.Join(msgs, "; "))
 	}
 }
 
@@ -131,10 +174,15 @@ func runPipelineStep(pipeline *PipelineDefinition, step *PipelineDefinitionStep,
 	podDefinition.parseSecrets(flags.Secrets)
 	podDefinition.parseEnv(flags.Env)
 	podDefinition.setBucketOverrides(flags.BucketOverrides)
+	digest, err := imageDigest(step.Image)
+	if err != nil {
+		log.Printf("[paddle] Unable to resolve the digest of %s: %s", step.Image, err.Error())
+	}
+	podDefinition.ImageDigest = digest
 
 	stepPodBuffer := podDefinition.compile()
 	pod := &v1.Pod{}
-	err := yaml.NewYAMLOrJSONDecoder(stepPodBuffer, 4096).Decode(pod)
+	err = yaml.NewYAMLOrJSONDecoder(stepPodBuffer, 4096).Decode(pod)
 	if err != nil {
 		return err
 	}
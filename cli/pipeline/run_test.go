@@ -2,6 +2,7 @@ package pipeline
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -71,6 +72,7 @@ func createPodStatus(phase v1.PodPhase, containers map[string]bool) v1.PodStatus
 func TestRunPipelineSuccess(t *testing.T) {
 	client := fake.NewSimpleClientset()
 	clientset = client
+	ecrClient = fakeECRClient
 
 	fakeWatch := watch.NewFake()
 	client.PrependWatchReactor("pods", ktesting.DefaultWatchReactor(fakeWatch, nil))
@@ -139,6 +141,7 @@ func TestRunPipelineFailure(t *testing.T) {
 
 	client := fake.NewSimpleClientset()
 	clientset = client
+	ecrClient = fakeECRClient
 
 	fakeWatch := watch.NewFake()
 	client.PrependWatchReactor("pods", ktesting.DefaultWatchReactor(fakeWatch, nil))
@@ -162,8 +165,12 @@ func TestRunPipelineFailure(t *testing.T) {
 
 	runPipeline("test/sample_steps_passing.yml", testRunFlags)
 
-	if len(errors) != 2 {
-		t.Errorf("expected two errors, actual %v", len(errors))
+	// step2 depends on step1, so it is skipped rather than run
+	if len(errors) != 1 {
+		t.Errorf("expected one error, actual %v", len(errors))
+	}
+	if len(errors) == 1 && !strings.Contains(errors[0], "step step2 skipped: upstream step step1 failed") {
+		t.Errorf("expected step2 to be skipped, got %s", errors[0])
 	}
 }
 
@@ -184,6 +191,7 @@ func TestRunPipelineStartTimeout(t *testing.T) {
 
 	client := fake.NewSimpleClientset()
 	clientset = client
+	ecrClient = fakeECRClient
 
 	fakeWatch := watch.NewFake()
 	client.PrependWatchReactor("pods", ktesting.DefaultWatchReactor(fakeWatch, nil))
@@ -205,12 +213,12 @@ func TestRunPipelineStartTimeout(t *testing.T) {
 
 	runPipeline("test/sample_steps_passing.yml", &flags)
 
-	if len(errors) != 2 {
-		t.Errorf("expected two errors, actual %v", len(errors))
+	if len(errors) != 1 {
+		t.Errorf("expected one error, actual %v", len(errors))
 	}
-	msg := "[paddle] [Timed out waiting for pod to start. Cluster might not have sufficient resources.]"
+	msg := "step step1 failed: Timed out waiting for pod to start. Cluster might not have sufficient resources."
 	for _, err := range errors {
-		if err != msg {
+		if !strings.Contains(err, msg) {
 			t.Errorf("Expected timeout error, got %s", err)
 		}
 	}
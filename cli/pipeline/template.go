@@ -20,11 +20,14 @@ type PodEnvVariable struct {
 
 type PodDefinition struct {
 	PodName         string
+	PipelineName    string
 	StepName        string
 	StepVersion     string
 	BranchName      string
 	Namespace       string
 	Bucket          string
+	ImageDigest     string
+	GitSHA          string
 	Secrets         []PodSecret
 	Env             []PodEnvVariable
 	BucketOverrides map[string]string
@@ -66,7 +69,7 @@ spec:
   containers:
     -
       name: main
-      image: "{{ .Step.Image }}"
+      image: "{{ .Step.Image | pinImage }}"
       imagePullPolicy: Always
       volumeMounts:
         -
@@ -131,9 +134,10 @@ spec:
       command:
         - "/bin/sh"
         - "-c"
-        - "mkdir -p $INPUT_PATH $OUTPUT_PATH &&
+        - "export PADDLE_STARTED=$(date -u +%Y-%m-%dT%H:%M:%SZ) &&
+          mkdir -p $INPUT_PATH $OUTPUT_PATH &&
           {{ range $index, $input := .Step.Inputs }}
-          paddle data get {{ $input.Step }}/{{ $input.Version }} $INPUT_PATH -b {{ $input.Branch | sanitizeName }} -p {{ $input.Path }} {{ $input.Bucket | bucketParam }} {{$input.Keys | keysParam}} {{ $input.Subdir | subdirParam }} &&
+          paddle data get {{ $input.Step }}/{{ $input.Version }} $INPUT_PATH -b {{ $input.Branch | sanitizeName }} -p {{ $input.Path }} {{ $input.Bucket | bucketParam }} {{$input.Keys | keysParam}} {{ $input.Include | includeParam }} {{ $input.Exclude | excludeParam }} {{ $input.Subdir | subdirParam }} {{ $input.AsOf | asOfParam }} &&
           {{ end }}
           touch /data/first-step.txt &&
           echo first step finished &&
@@ -159,6 +163,23 @@ spec:
         -
           name: OUTPUT_PATH
           value: /data/output
+        -
+          name: PADDLE_PIPELINE
+          value: "{{ .PipelineName }}"
+        -
+          name: PADDLE_IMAGE
+          value: "{{ .Step.Image }}"
+        -
+          name: PADDLE_IMAGE_DIGEST
+          value: "{{ .ImageDigest }}"
+        -
+          name: PADDLE_GIT_SHA
+          value: "{{ .GitSHA }}"
+        -
+          name: PADDLE_RUN_ID
+          valueFrom:
+            fieldRef:
+              fieldPath: metadata.uid
         -
           name: AWS_ACCESS_KEY_ID
           valueFrom:
@@ -195,9 +216,11 @@ func NewPodDefinition(pipelineDefinition *PipelineDefinition, pipelineDefinition
 
 	return &PodDefinition{
 		PodName:         podName,
+		PipelineName:    pipelineDefinition.Pipeline,
 		Namespace:       pipelineDefinition.Namespace,
 		Step:            *pipelineDefinitionStep,
 		Bucket:          pipelineDefinition.Bucket,
+		GitSHA:          pipelineDefinition.GitSHA,
 		StepName:        stepName,
 		StepVersion:     stepVersion,
 		BranchName:      branchName,
@@ -211,7 +234,11 @@ func (p PodDefinition) compile() *bytes.Buffer {
 		"sanitizeName": sanitizeName,
 		"bucketParam":  p.bucketParam,
 		"keysParam":    p.keysParam,
+		"includeParam": p.includeParam,
+		"excludeParam": p.excludeParam,
 		"subdirParam":  p.subdirParam,
+		"asOfParam":    p.asOfParam,
+		"pinImage":     p.pinImage,
 	}
 	tmpl := template.Must(template.New("podTemplate").Funcs(fmap).Parse(podTemplate))
 	buffer := new(bytes.Buffer)
@@ -279,6 +306,34 @@ func (p *PodDefinition) keysParam(keys []string) string {
 	return ""
 }
 
+func (p *PodDefinition) includeParam(patterns []string) string {
+	return patternsParam("--include", patterns)
+}
+
+func (p *PodDefinition) excludeParam(patterns []string) string {
+	return patternsParam("--exclude", patterns)
+}
+
+// patternsParam quotes glob patterns so the shell running paddle data get
+// doesn't expand them
+func patternsParam(flag string, patterns []string) string {
+	params := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		params[i] = flag + " '" + pattern + "'"
+	}
+	return strings.Join(params, " ")
+}
+
+// pinImage pins an image to the digest resolved for it, so the step runs
+// exactly the image its commits record. Images already pinned are left as
+// they are.
+func (p *PodDefinition) pinImage(image string) string {
+	if p.ImageDigest == "" || strings.Contains(image, "@") {
+		return image
+	}
+	return image + "@" + p.ImageDigest
+}
+
 func (p *PodDefinition) subdirParam(subdir string) string {
 	if subdir != "" {
 		return "-d " + subdir
@@ -286,6 +341,13 @@ func (p *PodDefinition) subdirParam(subdir string) string {
 	return ""
 }
 
+func (p *PodDefinition) asOfParam(asOf string) string {
+	if asOf != "" {
+		return "--as-of '" + asOf + "'"
+	}
+	return ""
+}
+
 func sanitizeName(name string) string {
 	str := strings.ToLower(name)
 	str = strings.Replace(str, "_", "-", -1)
@@ -133,3 +133,132 @@ func TestKeys(t *testing.T) {
 		t.Errorf("Failed to build paddle get, keys flag is missing")
 	}
 }
+
+func TestIncludeExclude(t *testing.T) {
+	data, err := ioutil.ReadFile("test/sample_keys.yml")
+	if err != nil {
+		panic(err.Error())
+	}
+
+	pipeline := ParsePipeline(data)
+	podDefinition := NewPodDefinition(pipeline, &pipeline.Steps[1])
+
+	include := podDefinition.Step.Inputs[0].Include
+	if len(include) != 2 {
+		t.Errorf("Failed to parse include patterns, got: %v, want: 2.", len(include))
+	}
+
+	stepPodBuffer := podDefinition.compile()
+
+	pod := &v1.Pod{}
+	yaml.NewYAMLOrJSONDecoder(stepPodBuffer, 4096).Decode(pod)
+
+	command := pod.Spec.Containers[1].Command[2]
+	if !strings.Contains(command, "--include 'features/**/*.parquet' --include 'labels.csv' --exclude 'debug'") {
+		t.Errorf("Failed to build paddle get, include and exclude flags are missing: %s", command)
+	}
+}
+
+func TestCommitMetadataEnv(t *testing.T) {
+	data, err := ioutil.ReadFile("test/sample_steps_passing.yml")
+	if err != nil {
+		panic(err.Error())
+	}
+	pipeline := ParsePipeline(data)
+	pipeline.GitSHA = "0123abc"
+
+	podDefinition := NewPodDefinition(pipeline, &pipeline.Steps[0])
+	podDefinition.ImageDigest = "sha256:4567def"
+
+	stepPodBuffer := podDefinition.compile()
+
+	pod := &v1.Pod{}
+	yaml.NewYAMLOrJSONDecoder(stepPodBuffer, 4096).Decode(pod)
+
+	env := map[string]v1.EnvVar{}
+	for _, value := range pod.Spec.Containers[1].Env {
+		env[value.Name] = value
+	}
+
+	if env["PADDLE_PIPELINE"].Value != "sample-steps-passing" {
+		t.Errorf("PADDLE_PIPELINE is %s", env["PADDLE_PIPELINE"].Value)
+	}
+	if env["PADDLE_IMAGE"].Value != pipeline.Steps[0].Image {
+		t.Errorf("PADDLE_IMAGE is %s", env["PADDLE_IMAGE"].Value)
+	}
+	if env["PADDLE_IMAGE_DIGEST"].Value != "sha256:4567def" {
+		t.Errorf("PADDLE_IMAGE_DIGEST is %s", env["PADDLE_IMAGE_DIGEST"].Value)
+	}
+	if env["PADDLE_GIT_SHA"].Value != "0123abc" {
+		t.Errorf("PADDLE_GIT_SHA is %s", env["PADDLE_GIT_SHA"].Value)
+	}
+	if pod.Spec.Containers[0].Image != pipeline.Steps[0].Image+"@sha256:4567def" {
+		t.Errorf("Expected the step to run the image it records, got %s", pod.Spec.Containers[0].Image)
+	}
+	if runID := env["PADDLE_RUN_ID"].ValueFrom; runID == nil || runID.FieldRef == nil || runID.FieldRef.FieldPath != "metadata.uid" {
+		t.Errorf("PADDLE_RUN_ID should come from the pod uid")
+	}
+	if !strings.HasPrefix(pod.Spec.Containers[1].Command[2], "export PADDLE_STARTED=") {
+		t.Errorf("Expected the paddle command to record when the step started")
+	}
+}
+
+func TestPinnedImage(t *testing.T) {
+	data, err := ioutil.ReadFile("test/sample_steps_passing.yml")
+	if err != nil {
+		panic(err.Error())
+	}
+	pipeline := ParsePipeline(data)
+	pipeline.Steps[0].Image = "219541440308.dkr.ecr.eu-west-1.amazonaws.com/paddlecontainer@sha256:4567def"
+
+	podDefinition := NewPodDefinition(pipeline, &pipeline.Steps[0])
+	podDefinition.ImageDigest = "sha256:4567def"
+
+	stepPodBuffer := podDefinition.compile()
+
+	pod := &v1.Pod{}
+	yaml.NewYAMLOrJSONDecoder(stepPodBuffer, 4096).Decode(pod)
+
+	if pod.Spec.Containers[0].Image != pipeline.Steps[0].Image {
+		t.Errorf("Expected an image pinned already to be left as it is, got %s", pod.Spec.Containers[0].Image)
+	}
+}
+
+func TestInputTag(t *testing.T) {
+	data, err := ioutil.ReadFile("test/sample_keys.yml")
+	if err != nil {
+		panic(err.Error())
+	}
+	pipeline := ParsePipeline(data)
+	pipeline.Steps[0].Inputs[0].Path = "tag:release-2019-q1"
+
+	podDefinition := NewPodDefinition(pipeline, &pipeline.Steps[0])
+
+	stepPodBuffer := podDefinition.compile()
+
+	pod := &v1.Pod{}
+	yaml.NewYAMLOrJSONDecoder(stepPodBuffer, 4096).Decode(pod)
+
+	if !strings.Contains(pod.Spec.Containers[1].Command[2], "-p tag:release-2019-q1") {
+		t.Errorf("Expected the paddle get command to fetch the tag, got: %s", pod.Spec.Containers[1].Command[2])
+	}
+}
+
+func TestInputAsOf(t *testing.T) {
+	data, err := ioutil.ReadFile("test/sample_keys.yml")
+	if err != nil {
+		panic(err.Error())
+	}
+	pipeline := ParsePipeline(data)
+
+	podDefinition := NewPodDefinition(pipeline, &pipeline.Steps[1])
+
+	stepPodBuffer := podDefinition.compile()
+
+	pod := &v1.Pod{}
+	yaml.NewYAMLOrJSONDecoder(stepPodBuffer, 4096).Decode(pod)
+
+	if !strings.Contains(pod.Spec.Containers[1].Command[2], "--as-of '2019-03-03T00:00:00Z'") {
+		t.Errorf("Expected the paddle get command to fetch the input as of a time, got: %s", pod.Spec.Containers[1].Command[2])
+	}
+}
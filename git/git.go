@@ -0,0 +1,16 @@
+package git
+
+import (
+	"os/exec"
+	"strings"
+)
+
+// HeadSHA returns the commit checked out in the git repository dir is in,
+// or an empty string if dir isn't in one.
+func HeadSHA(dir string) string {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}